@@ -5,40 +5,64 @@ import (
 	"log"
 	"time"
 
+	"github.com/NoorBnHossam/Authentication_Types/internal/config"
 	"github.com/NoorBnHossam/Authentication_Types/internal/db"
 	"github.com/NoorBnHossam/Authentication_Types/internal/models"
-	"go.mongodb.org/mongo-driver/bson"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/NoorBnHossam/Authentication_Types/internal/password"
+	"github.com/joho/godotenv"
 )
 
 func main() {
-	if err := db.Connect(); err != nil {
-		log.Fatal("Failed to connect to MongoDB:", err)
+	if err := godotenv.Load("../../.env"); err != nil {
+		log.Println("Warning: No .env file found, using environment variables")
 	}
-	defer db.Disconnect()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("admin123"), bcrypt.DefaultCost)
+	// Hashed under the configured policy, so checking it takes as long as
+	// checking a password for an unknown username
+	cfg := config.Load()
+	hasher, err := password.New(password.Policy{
+		Algorithm: cfg.PasswordHash,
+		Params:    cfg.PasswordHashParams,
+		Pepper:    []byte(cfg.PasswordPepper),
+	})
+	if err != nil {
+		log.Fatal("Invalid password hashing policy:", err)
+	}
+	hashedPassword, err := hasher.Hash("admin123")
 	if err != nil {
 		log.Fatal("Failed to hash password:", err)
 	}
 
 	user := models.User{
-		Username:  "admin",
-		Password:  string(hashedPassword),
-		Email:     "admin@example.com",
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		Username:      "admin",
+		Password:      hashedPassword,
+		Email:         "admin@example.com",
+		Role:          "admin",
+		EmailVerified: true,
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+	}
+
+	stores, err := db.Stores(cfg)
+	if err != nil {
+		log.Fatal("Failed to open storage:", err)
 	}
+	defer db.Disconnect()
+	users := stores.Users
 
-	var existingUser models.User
-	err = db.Collection.FindOne(context.Background(), bson.M{"username": user.Username}).Decode(&existingUser)
+	existingUser, err := users.FindByUsername(context.Background(), user.Username)
 	if err == nil {
+		// Users created before roles were assigned have none
+		if existingUser.Role == "" {
+			if err := users.SetRole(context.Background(), existingUser.ID.Hex(), user.Role); err != nil {
+				log.Fatal("Failed to set test user role:", err)
+			}
+		}
 		log.Println("Test user already exists")
 		return
 	}
 
-	_, err = db.Collection.InsertOne(context.Background(), user)
-	if err != nil {
+	if err := users.Create(context.Background(), &user); err != nil {
 		log.Fatal("Failed to insert test user:", err)
 	}
 
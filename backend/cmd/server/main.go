@@ -1,17 +1,10 @@
 package main
 
 import (
-	"context"
 	"log"
-	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
-	"time"
 
 	"github.com/NoorBnHossam/Authentication_Types/internal/config"
-	"github.com/NoorBnHossam/Authentication_Types/internal/db"
-	"github.com/NoorBnHossam/Authentication_Types/internal/routes"
+	"github.com/NoorBnHossam/Authentication_Types/internal/server"
 	"github.com/joho/godotenv"
 )
 
@@ -20,41 +13,7 @@ func main() {
 		log.Println("Warning: No .env file found, using environment variables")
 	}
 
-	cfg := config.Load()
-
-	if err := db.Connect(); err != nil {
-		log.Fatal("Failed to connect to MongoDB:", err)
-	}
-	defer db.Disconnect()
-
-	router := routes.SetupRouter(cfg)
-
-	srv := &http.Server{
-		Addr:         ":" + cfg.Port,
-		Handler:      router,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
-	}
-
-	go func() {
-		log.Printf("Server starting on port %s in %s mode", cfg.Port, cfg.Env)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatal("Failed to start server:", err)
-		}
-	}()
-
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	log.Println("Shutting down server...")
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown:", err)
+	if err := server.Run(config.Load()); err != nil {
+		log.Fatal(err)
 	}
-
-	log.Println("Server exited gracefully")
 }
@@ -0,0 +1,148 @@
+// Package audit records security events, such as logins and token
+// revocations, to one or more sinks.
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Type is the kind of security event
+type Type string
+
+const (
+	LoginSuccess Type = "login.success"
+	LoginFailure Type = "login.failure"
+	Logout       Type = "logout"
+	TokenIssued  Type = "token.issued"
+	TokenRevoked Type = "token.revoked"
+	// SessionHijack is a session cookie presented from a different client
+	// than the one it was issued to
+	SessionHijack Type = "session.hijack"
+	// SessionIdleExpired is a session ended by the idle timeout
+	SessionIdleExpired Type = "session.idle_expired"
+	// RefreshReuse is an already-rotated refresh token presented again
+	RefreshReuse Type = "refresh.reuse"
+	// AccountLockout is a username crossing a failed login threshold, or
+	// being unlocked
+	AccountLockout Type = "account.lockout"
+)
+
+// Outcome says whether the action the event describes succeeded
+type Outcome string
+
+const (
+	Success Outcome = "success"
+	Failure Outcome = "failure"
+)
+
+// Event is one audit record
+type Event struct {
+	ID      string    `json:"id" bson:"_id"`
+	Time    time.Time `json:"time" bson:"time"`
+	Type    Type      `json:"type" bson:"type"`
+	Outcome Outcome   `json:"outcome" bson:"outcome"`
+	// Actor is the username the event is about, as given by the client for
+	// failed logins
+	Actor     string `json:"actor,omitempty" bson:"actor,omitempty"`
+	UserID    string `json:"user_id,omitempty" bson:"user_id,omitempty"`
+	IP        string `json:"ip,omitempty" bson:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty" bson:"user_agent,omitempty"`
+	// Method is the authentication method, e.g. "jwt" or "session"
+	Method string `json:"method,omitempty" bson:"method,omitempty"`
+	// Reason explains the outcome, e.g. "invalid_credentials"
+	Reason string `json:"reason,omitempty" bson:"reason,omitempty"`
+}
+
+// Sink stores or forwards events. Sinks are only called from the logger's
+// delivery goroutine.
+type Sink interface {
+	Write(ctx context.Context, event Event) error
+}
+
+// queueSize is how many events may wait for delivery before new ones are
+// dropped
+const queueSize = 1024
+
+// sinkTimeout bounds each delivery to a sink
+const sinkTimeout = 5 * time.Second
+
+// Logger delivers events to its sinks in the background, so a slow sink
+// does not hold up requests. A nil *Logger discards events.
+type Logger struct {
+	sinks []Sink
+	queue chan Event
+	done  chan struct{}
+	once  sync.Once
+}
+
+// New starts a logger writing to sinks
+func New(sinks ...Sink) *Logger {
+	l := &Logger{
+		sinks: sinks,
+		queue: make(chan Event, queueSize),
+		done:  make(chan struct{}),
+	}
+	go l.deliver()
+	return l
+}
+
+// Record queues event for delivery, filling in its ID and time when unset
+func (l *Logger) Record(event Event) {
+	if l == nil {
+		return
+	}
+	if event.ID == "" {
+		event.ID = newID()
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	select {
+	case l.queue <- event:
+	default:
+		log.Printf("[audit] Queue full, dropped %s event for %s", event.Type, event.Actor)
+	}
+}
+
+// Close delivers the queued events, stops the logger and closes the sinks
+// that can be closed. Record must not be called afterwards.
+func (l *Logger) Close() {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() {
+		close(l.queue)
+		<-l.done
+		for _, sink := range l.sinks {
+			if closer, ok := sink.(io.Closer); ok {
+				closer.Close()
+			}
+		}
+	})
+}
+
+func (l *Logger) deliver() {
+	defer close(l.done)
+	for event := range l.queue {
+		for _, sink := range l.sinks {
+			ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+			if err := sink.Write(ctx, event); err != nil {
+				log.Printf("[audit] Error writing %s event %s to %T: %v", event.Type, event.ID, sink, err)
+			}
+			cancel()
+		}
+	}
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,39 @@
+package audit
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/config"
+	"github.com/NoorBnHossam/Authentication_Types/internal/db"
+)
+
+// Open starts a logger with the sinks listed in AUDIT_SINKS, or none for
+// "none". The mongo sink writes to the database the mongo storage driver
+// connected to, so call db.Stores first.
+func Open(cfg *config.Config) (*Logger, error) {
+	var sinks []Sink
+	for _, name := range cfg.AuditSinks {
+		switch name {
+		case "none":
+		case "stdout":
+			sinks = append(sinks, NewStdoutSink())
+		case "file":
+			sink, err := NewFileSink(cfg.AuditFile)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		case "mongo":
+			if db.Database == nil {
+				return nil, fmt.Errorf("audit: the mongo sink needs a MongoDB connection")
+			}
+			sinks = append(sinks, NewMongoSink(db.Database.Collection(db.AuditEventsCollection)))
+		case "webhook":
+			sinks = append(sinks, NewWebhookSink(cfg.AuditWebhookURL, &http.Client{Timeout: sinkTimeout}))
+		default:
+			return nil, fmt.Errorf("audit: unknown sink %q", name)
+		}
+	}
+	return New(sinks...), nil
+}
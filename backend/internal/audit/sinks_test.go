@@ -0,0 +1,125 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the events POSTed to it and answers with status
+type webhookReceiver struct {
+	mu     sync.Mutex
+	events []Event
+	status int
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "want a JSON POST", http.StatusBadRequest)
+		return
+	}
+	var event Event
+	if err := json.NewDecoder(req.Body).Decode(&event); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	w.WriteHeader(r.status)
+}
+
+func (r *webhookReceiver) received() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+func TestWebhookSink(t *testing.T) {
+	receiver := &webhookReceiver{status: http.StatusNoContent}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	event := Event{
+		ID:      "1",
+		Time:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Type:    LoginSuccess,
+		Outcome: Success,
+		Actor:   "alice",
+		Method:  "jwt",
+	}
+	sink := NewWebhookSink(server.URL, server.Client())
+	if err := sink.Write(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+
+	got := receiver.received()
+	if len(got) != 1 || got[0] != event {
+		t.Fatalf("webhook received %+v, want %+v", got, event)
+	}
+}
+
+func TestWebhookSinkErrors(t *testing.T) {
+	receiver := &webhookReceiver{status: http.StatusServiceUnavailable}
+	server := httptest.NewServer(receiver)
+
+	sink := NewWebhookSink(server.URL, server.Client())
+	if err := sink.Write(context.Background(), Event{Type: Logout}); err == nil {
+		t.Fatal("Write succeeded against a 503")
+	}
+
+	server.Close()
+	if err := sink.Write(context.Background(), Event{Type: Logout}); err == nil {
+		t.Fatal("Write succeeded against a closed server")
+	}
+}
+
+func TestWebhookSinkTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := NewWebhookSink(server.URL, server.Client()).Write(ctx, Event{Type: Logout}); err == nil {
+		t.Fatal("Write succeeded after its context expired")
+	}
+}
+
+func TestLoggerDeliversToWebhook(t *testing.T) {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(output)
+
+	receiver := &webhookReceiver{status: http.StatusOK}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	logger := New(NewWebhookSink(server.URL, server.Client()))
+	logger.Record(Event{Type: LoginFailure, Outcome: Failure, Actor: "bob", Reason: "invalid_credentials"})
+	logger.Record(Event{Type: Logout, Outcome: Success, Actor: "bob"})
+	logger.Close()
+
+	got := receiver.received()
+	if len(got) != 2 {
+		t.Fatalf("webhook received %d events, want 2", len(got))
+	}
+	for _, event := range got {
+		if event.ID == "" || event.Time.IsZero() {
+			t.Errorf("event %+v has no ID or time", event)
+		}
+	}
+	if got[0].Type != LoginFailure || got[1].Type != Logout {
+		t.Errorf("events arrived as %s, %s", got[0].Type, got[1].Type)
+	}
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"github.com/NoorBnHossam/Authentication_Types/internal/audit"
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+// auditLog receives security events. Until UseAuditLog is called it is nil,
+// which discards them.
+var auditLog *audit.Logger
+
+// UseAuditLog sets where security events are recorded. Call it before the
+// router serves requests.
+func UseAuditLog(l *audit.Logger) {
+	auditLog = l
+}
+
+func init() {
+	OnLockoutEvent(func(e LockoutEvent) {
+		outcome := audit.Failure
+		if e.Type == LockoutUnlocked {
+			outcome = audit.Success
+		}
+		auditLog.Record(audit.Event{
+			Time:    e.Time.UTC(),
+			Type:    audit.AccountLockout,
+			Outcome: outcome,
+			Actor:   e.Username,
+			IP:      e.IP,
+			Reason:  e.Type,
+		})
+	})
+}
+
+// recordAudit adds the client's address and user agent to event and
+// records it
+func recordAudit(c *gin.Context, event audit.Event) {
+	event.IP = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+	auditLog.Record(event)
+}
+
+// auditLoginSuccess records a completed login
+func auditLoginSuccess(c *gin.Context, user models.User, method string) {
+	recordAudit(c, audit.Event{
+		Type:    audit.LoginSuccess,
+		Outcome: audit.Success,
+		Actor:   user.Username,
+		UserID:  user.ID.Hex(),
+		Method:  method,
+	})
+}
+
+// auditLoginFailure records a rejected login for the username the client
+// gave
+func auditLoginFailure(c *gin.Context, username, method, reason string) {
+	recordAudit(c, audit.Event{
+		Type:    audit.LoginFailure,
+		Outcome: audit.Failure,
+		Actor:   username,
+		Method:  method,
+		Reason:  reason,
+	})
+}
@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/audit"
+	"github.com/crewjam/saml"
+)
+
+// recordingSink keeps the events delivered to it
+type recordingSink struct {
+	mu     sync.Mutex
+	events []audit.Event
+}
+
+func (s *recordingSink) Write(ctx context.Context, event audit.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+// recordAuditEvents sends audit events to a recording sink for the rest of
+// the test. The returned function flushes the log and returns the events of
+// type eventType.
+func recordAuditEvents(t *testing.T) func(eventType audit.Type) []audit.Event {
+	t.Helper()
+	sink := &recordingSink{}
+	logger := audit.New(sink)
+	UseAuditLog(logger)
+	t.Cleanup(func() {
+		UseAuditLog(nil)
+		logger.Close()
+	})
+
+	return func(eventType audit.Type) []audit.Event {
+		t.Helper()
+		UseAuditLog(nil)
+		logger.Close()
+
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		var events []audit.Event
+		for _, event := range sink.events {
+			if event.Type == eventType {
+				events = append(events, event)
+			}
+		}
+		return events
+	}
+}
+
+func TestSessionEventsNameTheActor(t *testing.T) {
+	login := request{method: http.MethodPost, path: "/api/session-auth/login", body: map[string]string{
+		"username": "alice",
+		"password": testPassword,
+	}}
+
+	cases := map[audit.Type]func(s *testServer, session *http.Cookie){
+		audit.Logout: func(s *testServer, session *http.Cookie) {
+			s.do(request{method: http.MethodPost, path: "/api/session-auth/logout", cookies: []*http.Cookie{session}})
+		},
+		audit.SessionHijack: func(s *testServer, session *http.Cookie) {
+			s.do(request{
+				method:  http.MethodGet,
+				path:    "/api/session-auth/protected",
+				cookies: []*http.Cookie{session},
+				header:  http.Header{"User-Agent": {"another-browser"}},
+			})
+		},
+		audit.SessionIdleExpired: func(s *testServer, session *http.Cookie) {
+			idle := defaultSessionConfig.IdleTimeout
+			defaultSessionConfig.IdleTimeout = time.Nanosecond
+			defer func() { defaultSessionConfig.IdleTimeout = idle }()
+			s.do(request{method: http.MethodGet, path: "/api/session-auth/protected", cookies: []*http.Cookie{session}})
+		},
+	}
+	for eventType, end := range cases {
+		t.Run(string(eventType), func(t *testing.T) {
+			s := newTestServer(t)
+			user := s.createUser("alice", testPassword)
+			events := recordAuditEvents(t)
+
+			end(s, cookie(s.do(login), "session_id"))
+
+			recorded := events(eventType)
+			if len(recorded) != 1 {
+				t.Fatalf("%d %s events recorded, want 1", len(recorded), eventType)
+			}
+			if recorded[0].Actor != "alice" || recorded[0].UserID != user.ID.Hex() {
+				t.Fatalf("event actor %q, user ID %q; want alice, %s", recorded[0].Actor, recorded[0].UserID, user.ID.Hex())
+			}
+		})
+	}
+}
+
+func TestLoginFailuresAreAudited(t *testing.T) {
+	idp := useTestIdP(t)
+	newMockOAuthProvider(t)
+	persistent := string(saml.PersistentNameIDFormat)
+
+	cases := []struct {
+		name   string
+		actor  string
+		reason string
+		fail   func(t *testing.T, s *testServer)
+	}{
+		{"basic unverified email", "olivia", "email_not_verified", func(t *testing.T, s *testServer) {
+			t.Setenv("REQUIRE_EMAIL_VERIFICATION", "true")
+			s.createUnverifiedUser("olivia", testPassword)
+			credentials := base64.StdEncoding.EncodeToString([]byte("olivia:" + testPassword))
+			w := s.do(request{method: http.MethodGet, path: "/api/basic-auth/protected", header: http.Header{"Authorization": {"Basic " + credentials}}})
+			expectStatus(t, w, http.StatusForbidden)
+		}},
+		{"SAML response from an untrusted signer", "", "invalid_response", func(t *testing.T, s *testServer) {
+			impostor := newTestIdP(t, idp.MetadataURL.String())
+			expectStatus(t, samlLogin(t, s, impostor, samlSession("peggy-id", persistent, "peggy@example.com")), http.StatusUnauthorized)
+		}},
+		{"SAML subject without an account", "peggy-id", "no_matching_user", func(t *testing.T, s *testServer) {
+			expectStatus(t, samlLogin(t, s, idp, samlSession("peggy-id", persistent, "peggy@example.com")), http.StatusForbidden)
+		}},
+		{"OAuth code exchange", "", "code_exchange_failed", func(t *testing.T, s *testServer) {
+			w := s.do(request{method: http.MethodGet, path: "/api/oauth/login"})
+			location, _ := url.Parse(w.Header().Get("Location"))
+			w = s.do(request{
+				method:  http.MethodGet,
+				path:    "/api/oauth/callback?code=bad-code&state=" + url.QueryEscape(location.Query().Get("state")),
+				cookies: []*http.Cookie{cookie(w, oauthStateCookie)},
+			})
+			expectStatus(t, w, http.StatusUnauthorized)
+		}},
+		{"WebAuthn cloned authenticator", "rupert", "cloned_authenticator", func(t *testing.T, s *testServer) {
+			s.mountWebAuthn()
+			s.createUser("rupert", testPassword)
+			authenticator := newSoftAuthenticator(t)
+			s.registerPasskey(s.accessToken("rupert"), authenticator)
+			options, ceremony := s.beginLogin("", "jwt")
+			expectStatus(t, s.finishLogin(authenticator.get(options), ceremony), http.StatusOK)
+
+			options, ceremony = s.beginLogin("", "jwt")
+			authenticator.signCount--
+			expectStatus(t, s.finishLogin(authenticator.get(options), ceremony), http.StatusUnauthorized)
+		}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			events := recordAuditEvents(t)
+
+			tt.fail(t, s)
+
+			recorded := events(audit.LoginFailure)
+			if len(recorded) != 1 {
+				t.Fatalf("%d login failure events recorded, want 1: %+v", len(recorded), recorded)
+			}
+			if recorded[0].Actor != tt.actor || recorded[0].Reason != tt.reason {
+				t.Fatalf("event actor %q, reason %q; want %q, %q", recorded[0].Actor, recorded[0].Reason, tt.actor, tt.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+// authRealm is the realm advertised in WWW-Authenticate challenges
+const authRealm = "auth-service"
+
+// Principal describes the authenticated caller of a request. Authentication
+// middlewares store it in the context under "principal".
+type Principal struct {
+	User models.User
+	// Method is the name of the authenticator that accepted the request, e.g.
+	// "basic", "token", "jwt", "session" or "oauth"
+	Method string
+	// Claims is set for JWT authentication
+	Claims *JWTClaims
+	// Session is set for session based authentication. Session.AuthMethod
+	// tells which login flow created it.
+	Session *models.Session
+}
+
+// Authenticator verifies the credentials a request carries and returns the
+// principal they belong to
+type Authenticator interface {
+	// Name selects the authenticator in Authenticate, e.g. "jwt"
+	Name() string
+	// Challenge is the WWW-Authenticate challenge for the scheme, or "" for
+	// schemes without one such as cookies
+	Challenge() string
+	// Authenticate returns ErrNoCredentials when the request carries none of
+	// the authenticator's credentials, so the next one can be tried. Other
+	// errors reject the request; use *AuthError to choose the status.
+	Authenticate(c *gin.Context) (Principal, error)
+}
+
+// RouteProvider is implemented by authenticators that serve their own
+// endpoints, such as login, logout and callbacks
+type RouteProvider interface {
+	RegisterRoutes(r gin.IRouter)
+}
+
+// ErrNoCredentials means the request carries no credentials for an
+// authenticator
+var ErrNoCredentials = errors.New("no credentials for scheme")
+
+// AuthError is an authentication error with the status and client-facing
+// message to answer with. Other errors are answered with 401 and their
+// message.
+type AuthError struct {
+	Status  int
+	Message string
+}
+
+func (e *AuthError) Error() string { return e.Message }
+
+func unauthorized(message string) error {
+	return &AuthError{Status: http.StatusUnauthorized, Message: message}
+}
+
+// defaultSchemes is the order Authenticate tries authenticators in when none
+// are given
+var defaultSchemes = []string{"jwt", "token", "session", "basic"}
+
+// Authenticate accepts any of the named registered authenticators, tried in
+// order. The first one the request has credentials for decides the outcome.
+// Failures carry a WWW-Authenticate header listing every accepted scheme.
+func Authenticate(names ...string) gin.HandlerFunc {
+	if len(names) == 0 {
+		names = defaultSchemes
+	}
+
+	authenticators := make([]Authenticator, len(names))
+	var challenges []string
+	for i, name := range names {
+		authenticator, ok := Lookup(name)
+		if !ok {
+			panic(fmt.Sprintf("auth: unknown authenticator %q", name))
+		}
+		authenticators[i] = authenticator
+		if challenge := authenticator.Challenge(); challenge != "" && !containsString(challenges, challenge) {
+			challenges = append(challenges, challenge)
+		}
+	}
+
+	return func(c *gin.Context) {
+		for _, authenticator := range authenticators {
+			principal, err := authenticator.Authenticate(c)
+			if err == ErrNoCredentials {
+				continue
+			}
+			if err != nil {
+				rejectAuthentication(c, err, challenges)
+				return
+			}
+
+			setPrincipal(c, principal)
+			c.Next()
+			return
+		}
+
+		message := "Authorization header required"
+		switch {
+		case c.GetHeader("Authorization") != "":
+			message = "Invalid authorization format"
+		case len(challenges) == 0:
+			message = "Session required"
+		}
+		rejectAuthentication(c, unauthorized(message), challenges)
+	}
+}
+
+func rejectAuthentication(c *gin.Context, err error, challenges []string) {
+	status, message := http.StatusUnauthorized, err.Error()
+	var failure *AuthError
+	if errors.As(err, &failure) {
+		status = failure.Status
+	}
+
+	if status == http.StatusUnauthorized && len(challenges) > 0 {
+		c.Header("WWW-Authenticate", strings.Join(challenges, ", "))
+	}
+	c.JSON(status, gin.H{"error": message})
+	c.Abort()
+}
+
+// setPrincipal stores the principal, and the values the single-scheme
+// middlewares have always set, in the context
+func setPrincipal(c *gin.Context, principal Principal) {
+	c.Set("principal", principal)
+	c.Set("user", principal.User)
+	if principal.Claims != nil {
+		c.Set("claims", principal.Claims)
+	}
+	if principal.Session != nil {
+		c.Set("session", *principal.Session)
+	}
+}
+
+// CurrentPrincipal returns the principal set by an authentication middleware
+func CurrentPrincipal(c *gin.Context) (Principal, bool) {
+	value, exists := c.Get("principal")
+	if !exists {
+		return Principal{}, false
+	}
+	principal, ok := value.(Principal)
+	return principal, ok
+}
+
+// bearerToken returns the bearer token from the Authorization header
+func bearerToken(c *gin.Context) (string, bool) {
+	auth := c.GetHeader("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	return strings.TrimPrefix(auth, "Bearer "), true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
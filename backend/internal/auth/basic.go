@@ -1,96 +1,77 @@
 package auth
 
 import (
-	"context"
 	"encoding/base64"
 	"net/http"
 	"strings"
 
-	"github.com/NoorBnHossam/Authentication_Types/internal/db"
 	"github.com/NoorBnHossam/Authentication_Types/internal/models"
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // BasicAuthLogin handles basic authentication login
 func BasicAuthLogin(c *gin.Context) {
-	var loginReq models.LoginRequest
-	if err := c.ShouldBindJSON(&loginReq); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
-		return
-	}
-
-	// Find user in database
-	var user models.User
-	err := db.Collection.FindOne(context.Background(), bson.M{"username": loginReq.Username}).Decode(&user)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-		return
-	}
-
-	// Compare passwords
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(loginReq.Password))
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-		return
-	}
+	passwordLogin(c, "basic")
+}
 
+func completeBasicLogin(c *gin.Context, user models.User) {
 	c.JSON(http.StatusOK, user.ToResponse())
 }
 
 // BasicAuthMiddleware handles basic authentication middleware
 func BasicAuthMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		auth := c.GetHeader("Authorization")
-		if auth == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
-			c.Abort()
-			return
-		}
+	return Authenticate("basic")
+}
 
-		// Check if it's Basic Auth
-		if !strings.HasPrefix(auth, "Basic ") {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization format"})
-			c.Abort()
-			return
-		}
+// authenticateBasic checks HTTP Basic credentials
+func authenticateBasic(c *gin.Context) (Principal, error) {
+	auth := c.GetHeader("Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return Principal{}, ErrNoCredentials
+	}
 
-		// Decode credentials
-		payload, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-			c.Abort()
-			return
-		}
+	// Decode credentials
+	payload, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return Principal{}, unauthorized(errInvalidCredentials.Error())
+	}
 
-		credentials := strings.SplitN(string(payload), ":", 2)
-		if len(credentials) != 2 {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials format"})
-			c.Abort()
-			return
-		}
+	credentials := strings.SplitN(string(payload), ":", 2)
+	if len(credentials) != 2 {
+		return Principal{}, unauthorized(errInvalidCredentials.Error())
+	}
 
-		username, password := credentials[0], credentials[1]
+	username, password := credentials[0], credentials[1]
 
-		// Find user in database
-		var user models.User
-		err = db.Collection.FindOne(context.Background(), bson.M{"username": username}).Decode(&user)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-			c.Abort()
-			return
-		}
+	wait, failures := checkLockout(c.Request.Context(), username)
+	if wait > 0 {
+		auditLoginFailure(c, username, "basic", "locked")
+		setRetryAfter(c, wait)
+		return Principal{}, &AuthError{Status: http.StatusTooManyRequests, Message: errAccountLocked}
+	}
+
+	user, err := verifyPassword(c.Request.Context(), username, password)
+	if err != nil {
+		recordLoginFailure(c, username)
+		auditLoginFailure(c, username, "basic", "invalid_credentials")
+		return Principal{}, unauthorized(err.Error())
+	}
+	if err := checkLoginAllowed(user); err != nil {
+		auditLoginFailure(c, username, "basic", "email_not_verified")
+		return Principal{}, &AuthError{Status: http.StatusForbidden, Message: err.Error()}
+	}
 
-		// Compare passwords
-		err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-			c.Abort()
-			return
+	// Credentials sent with every request cannot carry a second factor
+	if user.MFAEnabled {
+		auditLoginFailure(c, username, "basic", "mfa_required")
+		return Principal{}, &AuthError{
+			Status:  http.StatusForbidden,
+			Message: "Multi-factor authentication is enabled for this account; use a login that supports it",
 		}
+	}
 
-		c.Set("user", user)
-		c.Next()
+	if failures > 0 {
+		clearLoginFailures(c.Request.Context(), username)
 	}
+	return Principal{User: user, Method: "basic"}, nil
 }
@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+const testPassword = "plum-orchard-lantern-42"
+
+func TestRegisterAndVerifyEmail(t *testing.T) {
+	t.Setenv("REQUIRE_EMAIL_VERIFICATION", "true")
+	s := newTestServer(t)
+
+	w := s.do(request{method: http.MethodPost, path: "/api/users/register", body: map[string]string{
+		"username": "alice",
+		"email":    "Alice@Example.com",
+		"password": testPassword,
+	}})
+	expectStatus(t, w, http.StatusCreated)
+
+	w = s.do(request{method: http.MethodPost, path: "/api/users/register", body: map[string]string{
+		"username": "alice",
+		"email":    "other@example.com",
+		"password": testPassword,
+	}})
+	expectStatus(t, w, http.StatusConflict)
+
+	w = s.do(request{method: http.MethodPost, path: "/api/users/register", body: map[string]string{
+		"username": "bob",
+		"email":    "bob@example.com",
+		"password": "short",
+	}})
+	expectStatus(t, w, http.StatusBadRequest)
+
+	login := request{method: http.MethodPost, path: "/api/token-auth/login", body: map[string]string{
+		"username": "alice",
+		"password": testPassword,
+	}}
+	expectStatus(t, s.do(login), http.StatusForbidden)
+
+	token := testMail.lastToken(t, "alice@example.com")
+	expectStatus(t, s.do(request{method: http.MethodGet, path: "/api/users/verify?token=" + url.QueryEscape(token)}), http.StatusOK)
+	// Links are single-use
+	expectStatus(t, s.do(request{method: http.MethodGet, path: "/api/users/verify?token=" + url.QueryEscape(token)}), http.StatusBadRequest)
+
+	expectStatus(t, s.do(login), http.StatusOK)
+}
+
+func TestPasswordLogin(t *testing.T) {
+	for _, method := range []string{"basic", "token", "jwt", "session"} {
+		t.Run(method, func(t *testing.T) {
+			s := newTestServer(t)
+			s.createUser("alice", testPassword)
+			path := "/api/" + method + "-auth/login"
+
+			wrong := s.do(request{method: http.MethodPost, path: path, body: map[string]string{
+				"username": "alice",
+				"password": "not-the-password",
+			}})
+			expectStatus(t, wrong, http.StatusUnauthorized)
+			unknown := s.do(request{method: http.MethodPost, path: path, body: map[string]string{
+				"username": "mallory",
+				"password": "not-the-password",
+			}})
+			expectStatus(t, unknown, http.StatusUnauthorized)
+			if wrong.Body.String() != unknown.Body.String() {
+				t.Errorf("unknown user answered %s, wrong password %s", unknown.Body, wrong.Body)
+			}
+
+			w := s.do(request{method: http.MethodPost, path: path, body: map[string]string{
+				"username": "alice",
+				"password": testPassword,
+			}})
+			expectStatus(t, w, http.StatusOK)
+		})
+	}
+}
+
+func TestTokenLogin(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser("alice", testPassword)
+
+	w := s.do(request{method: http.MethodPost, path: "/api/token-auth/login", body: map[string]string{
+		"username": "alice",
+		"password": testPassword,
+	}})
+	expectStatus(t, w, http.StatusOK)
+	token, _ := decode(t, w)["token"].(string)
+
+	w = s.do(request{method: http.MethodGet, path: "/api/token-auth/protected", bearer: token})
+	expectStatus(t, w, http.StatusOK)
+	expectStatus(t, s.do(request{method: http.MethodGet, path: "/api/token-auth/protected", bearer: "forged"}), http.StatusUnauthorized)
+	expectStatus(t, s.do(request{method: http.MethodGet, path: "/api/token-auth/protected"}), http.StatusUnauthorized)
+}
+
+func TestSessionLogin(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser("alice", testPassword)
+	login := request{method: http.MethodPost, path: "/api/session-auth/login", body: map[string]string{
+		"username": "alice",
+		"password": testPassword,
+	}}
+
+	t.Run("protected and logout", func(t *testing.T) {
+		w := s.do(login)
+		expectStatus(t, w, http.StatusOK)
+		session := cookie(w, "session_id")
+		if session == nil || !session.HttpOnly || !session.Secure {
+			t.Fatalf("session cookie = %+v, want HttpOnly and Secure", session)
+		}
+
+		protected := request{method: http.MethodGet, path: "/api/session-auth/protected", cookies: []*http.Cookie{session}}
+		w = s.do(protected)
+		expectStatus(t, w, http.StatusOK)
+		if method := decode(t, w)["auth_method"]; method != "session" {
+			t.Errorf("auth_method = %v, want session", method)
+		}
+
+		expectStatus(t, s.do(request{method: http.MethodPost, path: "/api/session-auth/logout", cookies: []*http.Cookie{session}}), http.StatusOK)
+		expectStatus(t, s.do(protected), http.StatusUnauthorized)
+	})
+
+	t.Run("user agent change", func(t *testing.T) {
+		session := cookie(s.do(login), "session_id")
+		w := s.do(request{
+			method:  http.MethodGet,
+			path:    "/api/session-auth/protected",
+			cookies: []*http.Cookie{session},
+			header:  http.Header{"User-Agent": {"another-browser"}},
+		})
+		expectStatus(t, w, http.StatusUnauthorized)
+		// The session is gone for the owner too
+		expectStatus(t, s.do(request{method: http.MethodGet, path: "/api/session-auth/protected", cookies: []*http.Cookie{session}}), http.StatusUnauthorized)
+	})
+
+	t.Run("other login flows", func(t *testing.T) {
+		session := cookie(s.do(login), "session_id")
+		w := s.do(request{method: http.MethodGet, path: "/api/magic-link/protected", cookies: []*http.Cookie{session}})
+		expectStatus(t, w, http.StatusUnauthorized)
+	})
+}
+
+func TestJWTRefresh(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser("alice", testPassword)
+
+	w := s.do(request{method: http.MethodPost, path: "/api/jwt-auth/login", body: map[string]string{
+		"username": "alice",
+		"password": testPassword,
+	}})
+	expectStatus(t, w, http.StatusOK)
+	access, _ := decode(t, w)["access_token"].(string)
+	first := cookie(w, "refresh_token")
+	if first == nil {
+		t.Fatal("login set no refresh token cookie")
+	}
+	expectStatus(t, s.do(request{method: http.MethodGet, path: "/api/jwt-auth/protected", bearer: access}), http.StatusOK)
+
+	w = s.do(request{method: http.MethodPost, path: "/api/jwt-auth/refresh", cookies: []*http.Cookie{first}})
+	expectStatus(t, w, http.StatusOK)
+	refreshed, _ := decode(t, w)["access_token"].(string)
+	second := cookie(w, "refresh_token")
+	if second == nil || second.Value == first.Value {
+		t.Fatal("refresh did not rotate the refresh token")
+	}
+	expectStatus(t, s.do(request{method: http.MethodGet, path: "/api/jwt-auth/protected", bearer: refreshed}), http.StatusOK)
+
+	// Replaying the rotated token revokes the family, so the current token
+	// stops working as well
+	expectStatus(t, s.do(request{method: http.MethodPost, path: "/api/jwt-auth/refresh", cookies: []*http.Cookie{first}}), http.StatusUnauthorized)
+	expectStatus(t, s.do(request{method: http.MethodPost, path: "/api/jwt-auth/refresh", cookies: []*http.Cookie{second}}), http.StatusUnauthorized)
+}
+
+func TestJWTRefreshUsesCurrentUser(t *testing.T) {
+	s := newTestServer(t)
+	user := s.createUser("alice", testPassword)
+
+	w := s.do(request{method: http.MethodPost, path: "/api/jwt-auth/login", body: map[string]string{
+		"username": "alice",
+		"password": testPassword,
+	}})
+	expectStatus(t, w, http.StatusOK)
+	if err := s.stores.Users.SetRole(context.Background(), user.ID.Hex(), "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	w = s.do(request{method: http.MethodPost, path: "/api/jwt-auth/refresh", cookies: []*http.Cookie{cookie(w, "refresh_token")}})
+	expectStatus(t, w, http.StatusOK)
+	access, _ := decode(t, w)["access_token"].(string)
+	refresh := cookie(w, "refresh_token")
+	for name, token := range map[string]string{"access": access, "refresh": refresh.Value} {
+		claims, err := parseJWT(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.Role != "admin" {
+			t.Errorf("%s token role = %q after the role change, want admin", name, claims.Role)
+		}
+	}
+}
+
+func TestJWTLogout(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser("alice", testPassword)
+
+	w := s.do(request{method: http.MethodPost, path: "/api/jwt-auth/login", body: map[string]string{
+		"username": "alice",
+		"password": testPassword,
+	}})
+	expectStatus(t, w, http.StatusOK)
+	access, _ := decode(t, w)["access_token"].(string)
+	refresh := cookie(w, "refresh_token")
+
+	w = s.do(request{method: http.MethodPost, path: "/api/jwt-auth/logout", bearer: access, cookies: []*http.Cookie{refresh}})
+	expectStatus(t, w, http.StatusOK)
+
+	expectStatus(t, s.do(request{method: http.MethodGet, path: "/api/jwt-auth/protected", bearer: access}), http.StatusUnauthorized)
+	expectStatus(t, s.do(request{method: http.MethodPost, path: "/api/jwt-auth/refresh", cookies: []*http.Cookie{refresh}}), http.StatusUnauthorized)
+}
@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"sync"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/password"
+)
+
+var (
+	passwordsOnce sync.Once
+	passwords     *password.Hasher
+)
+
+// passwordHasher returns the hasher for new and upgraded passwords. The
+// default one hashes a dummy password when built, so it is only built if
+// UsePasswordHasher was not called first.
+func passwordHasher() *password.Hasher {
+	passwordsOnce.Do(func() {
+		if passwords == nil {
+			passwords = password.Default()
+		}
+	})
+	return passwords
+}
+
+// UsePasswordHasher sets the hasher for new and upgraded passwords. Call it
+// before the router serves requests.
+func UsePasswordHasher(h *password.Hasher) {
+	passwords = h
+}
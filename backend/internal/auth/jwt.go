@@ -1,107 +1,119 @@
 package auth
 
 import (
-	"context"
+	"errors"
+	"log"
 	"net/http"
 	"strings"
 	"time"
 
-	"github.com/NoorBnHossam/Authentication_Types/internal/config"
-	"github.com/NoorBnHossam/Authentication_Types/internal/db"
+	"github.com/NoorBnHossam/Authentication_Types/internal/audit"
+	"github.com/NoorBnHossam/Authentication_Types/internal/middleware"
 	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"github.com/NoorBnHossam/Authentication_Types/internal/store"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/google/uuid"
 )
 
 type JWTClaims struct {
 	UserID   string `json:"user_id"`
 	Username string `json:"username"`
 	Role     string `json:"role"`
+	TokenUse string `json:"token_use,omitempty"` // "access" or "refresh"
+	FamilyID string `json:"fid,omitempty"`       // refresh token family
 	jwt.RegisteredClaims
 }
 
-var tokenBlacklist = make(map[string]time.Time)
+// jwtIssuer is the iss claim of the service's own tokens
+const jwtIssuer = "auth-service"
 
-type RefreshAttempt struct {
-	Count       int
-	LastAttempt time.Time
-}
-
-var refreshAttempts = make(map[string]*RefreshAttempt)
+const accessTokenTTL = 15 * time.Minute // Short-lived access token
+const refreshTokenTTL = 7 * 24 * time.Hour
 
 const maxRefreshAttempts = 5
 const refreshAttemptWindow = 15 * time.Minute
 const banDuration = 1 * time.Hour
 
-func JWTAuthLogin(c *gin.Context) {
-	var loginReq models.LoginRequest
-	if err := c.ShouldBindJSON(&loginReq); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
-		return
-	}
-
-	var user models.User
-	err := db.Collection.FindOne(context.Background(), bson.M{"username": loginReq.Username}).Decode(&user)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-		return
-	}
+// refreshThrottler allows each client address maxRefreshAttempts refreshes
+// per refreshAttemptWindow, and bans it for banDuration when it exceeds that
+var refreshThrottler = middleware.NewThrottler(maxRefreshAttempts, refreshAttemptWindow, banDuration)
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(loginReq.Password))
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-		return
-	}
+func newAccessClaims(userID, username, role string) JWTClaims {
+	return newJWTClaims(userID, username, role, "access", "", accessTokenTTL)
+}
 
-	cfg := config.Load()
+func newRefreshClaims(userID, username, role, familyID string) JWTClaims {
+	return newJWTClaims(userID, username, role, "refresh", familyID, refreshTokenTTL)
+}
 
-	accessTokenClaims := JWTClaims{
-		UserID:   user.ID.Hex(),
-		Username: user.Username,
-		Role:     user.Role,
+func newJWTClaims(userID, username, role, use, familyID string, ttl time.Duration) JWTClaims {
+	now := time.Now()
+	return JWTClaims{
+		UserID:   userID,
+		Username: username,
+		Role:     role,
+		TokenUse: use,
+		FamilyID: familyID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(15 * time.Minute)), // Short-lived access token
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
-			Issuer:    "auth-service",
-			Subject:   user.ID.Hex(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Issuer:    jwtIssuer,
+			Subject:   userID,
+			ID:        uuid.NewString(),
 		},
 	}
+}
+
+func JWTAuthLogin(c *gin.Context) {
+	passwordLogin(c, "jwt")
+}
 
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessTokenClaims)
-	accessTokenString, err := accessToken.SignedString([]byte(cfg.JWTSecret))
+// issueJWTLogin returns an access token and sets the refresh token cookie for
+// a new refresh token family
+func issueJWTLogin(c *gin.Context, user models.User) {
+	accessTokenString, err := signJWT(newAccessClaims(user.ID.Hex(), user.Username, user.Role))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
 		return
 	}
 
-	refreshTokenClaims := JWTClaims{
-		UserID:   user.ID.Hex(),
-		Username: user.Username,
-		Role:     user.Role,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(7 * 24 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
-			Issuer:    "auth-service",
-			Subject:   user.ID.Hex(),
-		},
+	// Each login starts a new refresh token family
+	refreshClaims := newRefreshClaims(user.ID.Hex(), user.Username, user.Role, uuid.NewString())
+	refreshTokenString, err := signJWT(refreshClaims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate refresh token"})
+		return
 	}
 
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshTokenClaims)
-	refreshTokenString, err := refreshToken.SignedString([]byte(cfg.JWTSecret))
+	now := time.Now()
+	err = stores.RefreshFamilies.Create(c.Request.Context(), store.RefreshFamily{
+		ID:         refreshClaims.FamilyID,
+		UserID:     user.ID.Hex(),
+		CurrentJTI: refreshClaims.ID,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		ExpiresAt:  refreshClaims.ExpiresAt.Time,
+	})
 	if err != nil {
+		log.Println("[JWTAuthLogin] Error storing refresh token family:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate refresh token"})
 		return
 	}
+	recordAudit(c, audit.Event{
+		Type:    audit.TokenIssued,
+		Outcome: audit.Success,
+		Actor:   user.Username,
+		UserID:  user.ID.Hex(),
+		Method:  "jwt",
+		Reason:  "login",
+	})
 
 	c.SetCookie(
 		"refresh_token",
 		refreshTokenString,
-		int(7*24*time.Hour.Seconds()),
+		int(refreshTokenTTL.Seconds()),
 		"/",
 		"",
 		true, // Secure
@@ -111,96 +123,47 @@ func JWTAuthLogin(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"access_token": accessTokenString,
 		"token_type":   "Bearer",
-		"expires_in":   900, // 15 minutes in seconds
+		"expires_in":   int(accessTokenTTL.Seconds()),
 	})
 }
 
 func JWTAuthMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		auth := c.GetHeader("Authorization")
-		if auth == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
-			c.Abort()
-			return
-		}
-
-		if !strings.HasPrefix(auth, "Bearer ") {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization format"})
-			c.Abort()
-			return
-		}
-
-		tokenString := strings.TrimPrefix(auth, "Bearer ")
-		cfg := config.Load()
-
-		if _, blacklisted := tokenBlacklist[tokenString]; blacklisted {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
-			c.Abort()
-			return
-		}
-
-		token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrSignatureInvalid
-			}
-			return []byte(cfg.JWTSecret), nil
-		})
-
-		if err != nil || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
-			return
-		}
+	return Authenticate("jwt")
+}
 
-		claims, ok := token.Claims.(*JWTClaims)
-		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
-			c.Abort()
-			return
-		}
+// authenticateJWT checks a bearer access token. Bearer values that are not
+// shaped like a JWT are left to the opaque token scheme.
+func authenticateJWT(c *gin.Context) (Principal, error) {
+	tokenString, ok := bearerToken(c)
+	if !ok || strings.Count(tokenString, ".") != 2 {
+		return Principal{}, ErrNoCredentials
+	}
 
-		var user models.User
-		objectID, err := primitive.ObjectIDFromHex(claims.UserID)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID"})
-			c.Abort()
-			return
-		}
+	claims, err := parseJWT(tokenString)
+	if err != nil || claims.TokenUse == "refresh" {
+		return Principal{}, unauthorized("Invalid token")
+	}
 
-		err = db.Collection.FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&user)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
-			c.Abort()
-			return
-		}
+	revoked, err := isClaimsRevoked(c.Request.Context(), claims)
+	if err != nil {
+		log.Println("[JWTAuthMiddleware] Error checking token revocation:", err)
+		return Principal{}, &AuthError{Status: http.StatusInternalServerError, Message: "Could not verify token"}
+	}
+	if revoked {
+		return Principal{}, unauthorized("Token has been revoked")
+	}
 
-		c.Set("user", user)
-		c.Set("claims", claims)
-		c.Next()
+	user, err := stores.Users.FindByID(c.Request.Context(), claims.UserID)
+	if err != nil {
+		return Principal{}, unauthorized("User not found")
 	}
+
+	return Principal{User: user, Method: "jwt", Claims: claims}, nil
 }
 
 // RefreshToken handles token refresh
 func RefreshToken(c *gin.Context) {
-	clientIP := c.ClientIP()
-	attempt, exists := refreshAttempts[clientIP]
-	if exists {
-		if time.Since(attempt.LastAttempt) < banDuration {
-			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many refresh attempts. Please try again later."})
-			return
-		}
-		if time.Since(attempt.LastAttempt) > refreshAttemptWindow {
-			attempt.Count = 0
-		}
-	} else {
-		attempt = &RefreshAttempt{}
-		refreshAttempts[clientIP] = attempt
-	}
-
-	attempt.Count++
-	attempt.LastAttempt = time.Now()
-
-	if attempt.Count > maxRefreshAttempts {
+	if !refreshThrottler.AllowKey(c, c.ClientIP()) {
 		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many refresh attempts. Please try again later."})
 		return
 	}
@@ -211,83 +174,75 @@ func RefreshToken(c *gin.Context) {
 		return
 	}
 
-	cfg := config.Load()
-	token, err := jwt.ParseWithClaims(refreshToken, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(cfg.JWTSecret), nil
-	})
-
-	if err != nil || !token.Valid {
+	claims, err := parseJWT(refreshToken)
+	if err != nil || claims.TokenUse != "refresh" || claims.FamilyID == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
 		return
 	}
 
-	claims, ok := token.Claims.(*JWTClaims)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
-		return
-	}
-
-	// Verify user exists in database
-	objectID, err := primitive.ObjectIDFromHex(claims.UserID)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID"})
-		return
-	}
-
-	var user models.User
-	err = db.Collection.FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&user)
+	// The new tokens carry the user as stored now, so a rename or role
+	// change takes effect at the next refresh
+	user, err := stores.Users.FindByID(c.Request.Context(), claims.UserID)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
 		return
 	}
 
-	newAccessTokenClaims := JWTClaims{
-		UserID:   claims.UserID,
-		Username: claims.Username,
-		Role:     claims.Role,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(15 * time.Minute)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
-			Issuer:    "auth-service",
-			Subject:   claims.UserID,
-		},
-	}
-
-	newAccessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, newAccessTokenClaims)
-	newAccessTokenString, err := newAccessToken.SignedString([]byte(cfg.JWTSecret))
+	newAccessTokenString, err := signJWT(newAccessClaims(user.ID.Hex(), user.Username, user.Role))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate new token"})
 		return
 	}
 
-	// Generate new refresh token (rotation)
-	newRefreshTokenClaims := JWTClaims{
-		UserID:   claims.UserID,
-		Username: claims.Username,
-		Role:     claims.Role,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(7 * 24 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
-			Issuer:    "auth-service",
-			Subject:   claims.UserID,
-		},
-	}
-
-	newRefreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, newRefreshTokenClaims)
-	newRefreshTokenString, err := newRefreshToken.SignedString([]byte(cfg.JWTSecret))
+	// Generate new refresh token (rotation) in the same family
+	rotatedClaims := newRefreshClaims(user.ID.Hex(), user.Username, user.Role, claims.FamilyID)
+	newRefreshTokenString, err := signJWT(rotatedClaims)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate new refresh token"})
 		return
 	}
 
-	tokenBlacklist[refreshToken] = time.Now().Add(24 * time.Hour)
+	_, err = stores.RefreshFamilies.Rotate(c.Request.Context(), claims.FamilyID, claims.ID, rotatedClaims.ID, rotatedClaims.ExpiresAt.Time)
+	switch {
+	case errors.Is(err, store.ErrReused):
+		// An already-rotated token was replayed, so the family may be in an
+		// attacker's hands: the whole family has been revoked
+		log.Printf("[SECURITY] Refresh token reuse detected for user %s (family %s, jti %s) from %s",
+			claims.UserID, claims.FamilyID, claims.ID, c.ClientIP())
+		recordAudit(c, audit.Event{
+			Type:    audit.RefreshReuse,
+			Outcome: audit.Failure,
+			Actor:   claims.Username,
+			UserID:  claims.UserID,
+			Method:  "jwt",
+			Reason:  "family_revoked",
+		})
+		c.SetCookie("refresh_token", "", -1, "/", "", true, true)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	case errors.Is(err, store.ErrNotFound):
+		c.SetCookie("refresh_token", "", -1, "/", "", true, true)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	case err != nil:
+		log.Println("[RefreshToken] Error rotating refresh token:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not rotate refresh token"})
+		return
+	}
+
+	recordAudit(c, audit.Event{
+		Type:    audit.TokenIssued,
+		Outcome: audit.Success,
+		Actor:   claims.Username,
+		UserID:  claims.UserID,
+		Method:  "jwt",
+		Reason:  "refresh",
+	})
 
 	c.SetCookie(
 		"refresh_token",
 		newRefreshTokenString,
-		int(7*24*time.Hour.Seconds()),
+		int(refreshTokenTTL.Seconds()),
 		"/",
 		"",
 		true, // Secure
@@ -297,20 +252,62 @@ func RefreshToken(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"access_token": newAccessTokenString,
 		"token_type":   "Bearer",
-		"expires_in":   900,
+		"expires_in":   int(accessTokenTTL.Seconds()),
 	})
 }
 
 // Logout handles user logout and token revocation
 func Logout(c *gin.Context) {
+	var actor *JWTClaims
+
 	auth := c.GetHeader("Authorization")
 	if auth != "" && strings.HasPrefix(auth, "Bearer ") {
 		tokenString := strings.TrimPrefix(auth, "Bearer ")
-		// Add token to blacklist
-		tokenBlacklist[tokenString] = time.Now().Add(24 * time.Hour)
+		if claims, err := parseJWT(tokenString); err == nil {
+			actor = claims
+			if err := revokeClaims(c.Request.Context(), claims); err != nil {
+				log.Println("[Logout] Error revoking access token:", err)
+			} else {
+				auditTokenRevoked(c, claims, "access")
+			}
+		}
+	}
+
+	if refreshToken, err := c.Cookie("refresh_token"); err == nil {
+		if claims, err := parseJWT(refreshToken); err == nil && claims.FamilyID != "" {
+			actor = claims
+			if err := stores.RefreshFamilies.Revoke(c.Request.Context(), claims.FamilyID, "logout"); err != nil {
+				log.Println("[Logout] Error revoking refresh token family:", err)
+			} else {
+				auditTokenRevoked(c, claims, "refresh")
+			}
+		}
+	}
+
+	if actor != nil {
+		recordAudit(c, audit.Event{
+			Type:    audit.Logout,
+			Outcome: audit.Success,
+			Actor:   actor.Username,
+			UserID:  actor.UserID,
+			Method:  "jwt",
+		})
 	}
 
 	// Clear
 	c.SetCookie("refresh_token", "", -1, "/", "", true, true)
 	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
 }
+
+// auditTokenRevoked records the revocation of the token claims belongs to.
+// kind is "access" or "refresh".
+func auditTokenRevoked(c *gin.Context, claims *JWTClaims, kind string) {
+	recordAudit(c, audit.Event{
+		Type:    audit.TokenRevoked,
+		Outcome: audit.Success,
+		Actor:   claims.Username,
+		UserID:  claims.UserID,
+		Method:  "jwt",
+		Reason:  "logout_" + kind,
+	})
+}
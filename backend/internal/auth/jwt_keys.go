@@ -0,0 +1,402 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/config"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey signs and verifies the service's own JWTs
+type signingKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private interface{} // []byte for HMAC, a crypto.Signer otherwise; nil for verify-only keys
+	Public  interface{} // []byte for HMAC, a crypto.PublicKey otherwise
+}
+
+// symmetric reports whether k is an HMAC key, which only this service can
+// verify
+func (k *signingKey) symmetric() bool {
+	_, ok := k.Public.([]byte)
+	return ok
+}
+
+// publicJWK returns the JWK for asymmetric keys; HMAC keys are never
+// published
+func (k *signingKey) publicJWK() (JWK, bool) {
+	if k.symmetric() {
+		return JWK{}, false
+	}
+	jwk, err := publicJWK(k.Public, k.Method.Alg())
+	if err != nil {
+		return JWK{}, false
+	}
+	jwk.Kid = k.ID
+	return jwk, true
+}
+
+// ringKey is a key in the key ring. Retired keys only verify tokens, and
+// only until NotAfter.
+type ringKey struct {
+	*signingKey
+	Active   bool
+	NotAfter time.Time
+}
+
+func (k ringKey) usable(now time.Time) bool {
+	return k.Active || k.NotAfter.IsZero() || now.Before(k.NotAfter)
+}
+
+// keyRing holds one active signing key plus retired verification keys,
+// selected by kid
+type keyRing struct {
+	active *signingKey
+	keys   map[string]ringKey
+}
+
+func (r *keyRing) lookup(kid string, now time.Time) (*signingKey, bool) {
+	key, ok := r.keys[kid]
+	if !ok || !key.usable(now) {
+		return nil, false
+	}
+	return key.signingKey, true
+}
+
+// keyFunc returns the verification key named by the token's kid header. Each
+// key only accepts its own algorithm, which rules out alg confusion between
+// HMAC and public keys. Tokens without a kid predate key IDs and are checked
+// against the active key.
+func (r *keyRing) keyFunc(token *jwt.Token) (interface{}, error) {
+	key := r.active
+	if kid, ok := token.Header["kid"].(string); ok {
+		key, ok = r.lookup(kid, time.Now())
+		if !ok {
+			return nil, fmt.Errorf("unknown or retired key ID %q", kid)
+		}
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, jwt.ErrSignatureInvalid
+	}
+	return key.Public, nil
+}
+
+var (
+	jwtKeysMu sync.RWMutex
+	jwtKeys   *keyRing
+)
+
+// currentKeyRing returns the loaded key ring, loading it on first use
+func currentKeyRing() (*keyRing, error) {
+	jwtKeysMu.RLock()
+	ring := jwtKeys
+	jwtKeysMu.RUnlock()
+	if ring != nil {
+		return ring, nil
+	}
+
+	jwtKeysMu.Lock()
+	defer jwtKeysMu.Unlock()
+	if jwtKeys == nil {
+		ring, err := loadKeyRing(config.Load())
+		if err != nil {
+			return nil, err
+		}
+		jwtKeys = ring
+	}
+	return jwtKeys, nil
+}
+
+// ReloadJWTKeys re-reads the signing keys from configuration. The old ring
+// stays in place if the new one cannot be loaded.
+func ReloadJWTKeys() error {
+	ring, err := loadKeyRing(config.Load())
+	if err != nil {
+		return err
+	}
+
+	jwtKeysMu.Lock()
+	jwtKeys = ring
+	jwtKeysMu.Unlock()
+
+	log.Printf("[JWTKeys] Loaded %d key(s), active key %s", len(ring.keys), ring.active.ID)
+	return nil
+}
+
+// keyRingFile is the format of JWT_KEYRING_FILE
+type keyRingFile struct {
+	Keys []struct {
+		ID             string    `json:"kid"`
+		Alg            string    `json:"alg"`
+		Secret         string    `json:"secret"`
+		PrivateKeyFile string    `json:"private_key_file"`
+		PublicKeyFile  string    `json:"public_key_file"`
+		Active         bool      `json:"active"`
+		NotAfter       time.Time `json:"not_after"`
+	} `json:"keys"`
+}
+
+func loadKeyRing(cfg *config.Config) (*keyRing, error) {
+	if cfg.JWTKeyRingFile == "" {
+		key, err := newSigningKey(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &keyRing{
+			active: key,
+			keys:   map[string]ringKey{key.ID: {signingKey: key, Active: true}},
+		}, nil
+	}
+
+	data, err := os.ReadFile(cfg.JWTKeyRingFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading JWT key ring: %w", err)
+	}
+	var file keyRingFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing JWT key ring: %w", err)
+	}
+
+	ring := &keyRing{keys: make(map[string]ringKey)}
+	for _, entry := range file.Keys {
+		if entry.ID == "" {
+			return nil, errors.New("every key in the JWT key ring needs a kid")
+		}
+		if _, exists := ring.keys[entry.ID]; exists {
+			return nil, fmt.Errorf("duplicate kid %q in JWT key ring", entry.ID)
+		}
+
+		var key *signingKey
+		switch {
+		case entry.Alg == "HS256":
+			if entry.Secret == "" {
+				return nil, fmt.Errorf("key %s: HS256 needs a secret", entry.ID)
+			}
+			secret := []byte(entry.Secret)
+			key = &signingKey{ID: entry.ID, Method: jwt.SigningMethodHS256, Private: secret, Public: secret}
+		case entry.PrivateKeyFile != "":
+			signer, err := loadPrivateKey(entry.PrivateKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", entry.ID, err)
+			}
+			key, err = asymmetricSigningKey(entry.Alg, entry.ID, signer)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", entry.ID, err)
+			}
+		case entry.PublicKeyFile != "" && !entry.Active:
+			pub, err := loadPublicKey(entry.PublicKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", entry.ID, err)
+			}
+			key, err = verificationKey(entry.Alg, entry.ID, pub)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", entry.ID, err)
+			}
+		default:
+			return nil, fmt.Errorf("key %s: no key material", entry.ID)
+		}
+
+		if entry.Active {
+			if ring.active != nil {
+				return nil, errors.New("JWT key ring has more than one active key")
+			}
+			ring.active = key
+		}
+		ring.keys[entry.ID] = ringKey{signingKey: key, Active: entry.Active, NotAfter: entry.NotAfter}
+	}
+
+	if ring.active == nil {
+		return nil, errors.New("JWT key ring has no active key")
+	}
+	return ring, nil
+}
+
+func newSigningKey(cfg *config.Config) (*signingKey, error) {
+	if cfg.JWTSigningAlg == "HS256" {
+		kid := cfg.JWTKeyID
+		if kid == "" {
+			kid = "default"
+		}
+		secret := []byte(cfg.JWTSecret)
+		return &signingKey{ID: kid, Method: jwt.SigningMethodHS256, Private: secret, Public: secret}, nil
+	}
+
+	signer, err := loadPrivateKey(cfg.JWTPrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading JWT signing key: %w", err)
+	}
+	return asymmetricSigningKey(cfg.JWTSigningAlg, cfg.JWTKeyID, signer)
+}
+
+func signingMethod(alg string) (jwt.SigningMethod, error) {
+	switch alg {
+	case "RS256":
+		return jwt.SigningMethodRS256, nil
+	case "ES256":
+		return jwt.SigningMethodES256, nil
+	case "EdDSA":
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+}
+
+// checkKeyType verifies that pub is the right kind of key for alg
+func checkKeyType(alg string, pub crypto.PublicKey) error {
+	ok := false
+	switch alg {
+	case "RS256":
+		_, ok = pub.(*rsa.PublicKey)
+	case "ES256":
+		_, ok = pub.(*ecdsa.PublicKey)
+	case "EdDSA":
+		_, ok = pub.(ed25519.PublicKey)
+	}
+	if !ok {
+		return fmt.Errorf("%s cannot be used with a %T key", alg, pub)
+	}
+	return nil
+}
+
+// asymmetricSigningKey checks that signer matches alg and derives the key ID
+// from its JWK thumbprint unless kid is given
+func asymmetricSigningKey(alg, kid string, signer crypto.Signer) (*signingKey, error) {
+	key, err := verificationKey(alg, kid, signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	key.Private = signer
+	return key, nil
+}
+
+// verificationKey builds a verify-only key from a public key
+func verificationKey(alg, kid string, pub crypto.PublicKey) (*signingKey, error) {
+	method, err := signingMethod(alg)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKeyType(alg, pub); err != nil {
+		return nil, err
+	}
+
+	jwk, err := publicJWK(pub, alg)
+	if err != nil {
+		return nil, err
+	}
+	if kid == "" {
+		kid = jwk.Kid
+	}
+	return &signingKey{ID: kid, Method: method, Public: pub}, nil
+}
+
+// signJWT signs claims with the active key and sets the kid header
+func signJWT(claims jwt.Claims) (string, error) {
+	ring, err := currentKeyRing()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(ring.active.Method, claims)
+	token.Header["kid"] = ring.active.ID
+	return token.SignedString(ring.active.Private)
+}
+
+// parseJWT verifies tokenString against the key ring and returns its claims.
+// The issuer check keeps tokens from the OIDC provider, which shares the
+// ring, from being accepted as the service's own.
+func parseJWT(tokenString string) (*JWTClaims, error) {
+	ring, err := currentKeyRing()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, ring.keyFunc,
+		jwt.WithValidMethods([]string{"HS256", "RS256", "ES256", "EdDSA"}),
+		jwt.WithIssuer(jwtIssuer),
+	)
+	if err != nil || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	claims, ok := token.Claims.(*JWTClaims)
+	if !ok {
+		return nil, errors.New("invalid token claims")
+	}
+	return claims, nil
+}
+
+// JWKSHandler publishes the public JWT verification keys so resource servers
+// can verify tokens without the shared secret. Retired keys stay published
+// until their verification window ends.
+func JWKSHandler(c *gin.Context) {
+	ring, err := currentKeyRing()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Signing keys unavailable"})
+		return
+	}
+
+	set := JWKSet{Keys: []JWK{}}
+	now := time.Now()
+	for _, key := range ring.keys {
+		if !key.usable(now) {
+			continue
+		}
+		if jwk, ok := key.publicJWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, set)
+}
+
+// ListJWTKeys describes the key ring without exposing key material
+func ListJWTKeys(c *gin.Context) {
+	ring, err := currentKeyRing()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Signing keys unavailable"})
+		return
+	}
+
+	keys := make([]gin.H, 0, len(ring.keys))
+	now := time.Now()
+	for _, key := range ring.keys {
+		entry := gin.H{
+			"kid":    key.ID,
+			"alg":    key.Method.Alg(),
+			"active": key.Active,
+			"usable": key.usable(now),
+		}
+		if !key.NotAfter.IsZero() {
+			entry["not_after"] = key.NotAfter
+		}
+		keys = append(keys, entry)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i]["kid"].(string) < keys[j]["kid"].(string) })
+
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// ReloadJWTKeysHandler reloads the key ring so a rotation takes effect
+// without a restart
+func ReloadJWTKeysHandler(c *gin.Context) {
+	if err := ReloadJWTKeys(); err != nil {
+		log.Printf("[JWTKeys] Reload failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not reload signing keys"})
+		return
+	}
+	ListJWTKeys(c)
+}
@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// keepJWTKeys puts the key ring in use back when the test ends
+func keepJWTKeys(t *testing.T) {
+	t.Helper()
+	jwtKeysMu.RLock()
+	previous := jwtKeys
+	jwtKeysMu.RUnlock()
+	t.Cleanup(func() {
+		jwtKeysMu.Lock()
+		jwtKeys = previous
+		jwtKeysMu.Unlock()
+	})
+}
+
+// writePrivateKey saves key as a PKCS#8 PEM file and returns its path
+func writePrivateKey(t *testing.T, key crypto.Signer) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.CreateTemp(t.TempDir(), "jwt-*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func newECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testRingKey is an entry of a key ring file written by useKeyRing
+type testRingKey struct {
+	ID       string
+	Key      crypto.Signer
+	Active   bool
+	NotAfter time.Time
+}
+
+// useKeyRing writes ES256 keys to a key ring file and loads it
+func useKeyRing(t *testing.T, keys ...testRingKey) {
+	t.Helper()
+	keepJWTKeys(t)
+
+	var file keyRingFile
+	for _, key := range keys {
+		file.Keys = append(file.Keys, struct {
+			ID             string    `json:"kid"`
+			Alg            string    `json:"alg"`
+			Secret         string    `json:"secret"`
+			PrivateKeyFile string    `json:"private_key_file"`
+			PublicKeyFile  string    `json:"public_key_file"`
+			Active         bool      `json:"active"`
+			NotAfter       time.Time `json:"not_after"`
+		}{ID: key.ID, Alg: "ES256", PrivateKeyFile: writePrivateKey(t, key.Key), Active: key.Active, NotAfter: key.NotAfter})
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("JWT_KEYRING_FILE", path)
+	if err := ReloadJWTKeys(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// signTestJWT signs access claims for alice with key under kid
+func signTestJWT(t *testing.T, method jwt.SigningMethod, kid string, key interface{}) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, newAccessClaims("0123456789abcdef01234567", "alice", "user"))
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestJWTRejectsHS256SignedWithPublicKey(t *testing.T) {
+	keepJWTKeys(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JWT_SIGNING_ALG", "RS256")
+	t.Setenv("JWT_PRIVATE_KEY_FILE", writePrivateKey(t, key))
+	if err := ReloadJWTKeys(); err != nil {
+		t.Fatal(err)
+	}
+	ring, _ := currentKeyRing()
+
+	if _, err := parseJWT(signTestJWT(t, jwt.SigningMethodRS256, ring.active.ID, key)); err != nil {
+		t.Fatalf("RS256 token rejected: %v", err)
+	}
+
+	// The public key is no secret, so an HMAC made with it proves nothing
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	for name, secret := range map[string][]byte{"PEM": pemKey, "DER": der} {
+		for _, kid := range []string{ring.active.ID, ""} {
+			if _, err := parseJWT(signTestJWT(t, jwt.SigningMethodHS256, kid, secret)); err == nil {
+				t.Errorf("HS256 token keyed with the %s public key and kid %q was accepted", name, kid)
+			}
+		}
+	}
+}
+
+func TestJWTRejectsUnknownKeyID(t *testing.T) {
+	active := newECKey(t)
+	useKeyRing(t, testRingKey{ID: "current", Key: active, Active: true})
+
+	if _, err := parseJWT(signTestJWT(t, jwt.SigningMethodES256, "current", active)); err != nil {
+		t.Fatalf("token from the active key rejected: %v", err)
+	}
+	if _, err := parseJWT(signTestJWT(t, jwt.SigningMethodES256, "elsewhere", active)); err == nil {
+		t.Error("token with an unknown kid was accepted")
+	}
+	if _, err := parseJWT(signTestJWT(t, jwt.SigningMethodES256, "current", newECKey(t))); err == nil {
+		t.Error("token from another key under the active kid was accepted")
+	}
+}
+
+func TestJWTRetiredKeyWindow(t *testing.T) {
+	active, retired := newECKey(t), newECKey(t)
+	token := signTestJWT(t, jwt.SigningMethodES256, "old", retired)
+
+	useKeyRing(t,
+		testRingKey{ID: "new", Key: active, Active: true},
+		testRingKey{ID: "old", Key: retired, NotAfter: time.Now().Add(time.Hour)},
+	)
+	if _, err := parseJWT(token); err != nil {
+		t.Fatalf("token from a retired key rejected before NotAfter: %v", err)
+	}
+
+	useKeyRing(t,
+		testRingKey{ID: "new", Key: active, Active: true},
+		testRingKey{ID: "old", Key: retired, NotAfter: time.Now().Add(-time.Second)},
+	)
+	if _, err := parseJWT(token); err == nil {
+		t.Fatal("token from a retired key accepted after NotAfter")
+	}
+}
+
+func TestReloadJWTKeysSwapsActiveKey(t *testing.T) {
+	first, second := newECKey(t), newECKey(t)
+	useKeyRing(t, testRingKey{ID: "first", Key: first, Active: true})
+	before, err := signJWT(newAccessClaims("0123456789abcdef01234567", "alice", "user"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	useKeyRing(t,
+		testRingKey{ID: "second", Key: second, Active: true},
+		testRingKey{ID: "first", Key: first, NotAfter: time.Now().Add(time.Hour)},
+	)
+	after, err := signJWT(newAccessClaims("0123456789abcdef01234567", "alice", "user"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for token, kid := range map[string]string{before: "first", after: "second"} {
+		parsed, _, err := jwt.NewParser().ParseUnverified(token, &JWTClaims{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.Header["kid"] != kid {
+			t.Errorf("token kid = %v, want %s", parsed.Header["kid"], kid)
+		}
+		if _, err := parseJWT(token); err != nil {
+			t.Errorf("token signed by %s rejected after the reload: %v", kid, err)
+		}
+	}
+}
+
+func TestJWKSHandler(t *testing.T) {
+	active, retired, expired := newECKey(t), newECKey(t), newECKey(t)
+	useKeyRing(t,
+		testRingKey{ID: "active", Key: active, Active: true},
+		testRingKey{ID: "retired", Key: retired, NotAfter: time.Now().Add(time.Hour)},
+		testRingKey{ID: "expired", Key: expired, NotAfter: time.Now().Add(-time.Second)},
+	)
+	s := newTestServer(t)
+
+	w := s.do(request{method: http.MethodGet, path: "/.well-known/jwks.json"})
+	expectStatus(t, w, http.StatusOK)
+	var set JWKSet
+	if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]*ecdsa.PrivateKey{"active": active, "retired": retired}
+	if len(set.Keys) != len(want) {
+		t.Fatalf("JWKS has %d keys, want %d: %+v", len(set.Keys), len(want), set.Keys)
+	}
+	for _, jwk := range set.Keys {
+		key, ok := want[jwk.Kid]
+		if !ok {
+			t.Fatalf("JWKS publishes unexpected kid %q", jwk.Kid)
+		}
+		expected, err := publicJWK(&key.PublicKey, "ES256")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if jwk.Alg != "ES256" || jwk.Kty != "EC" || jwk.Use != "sig" || jwk.X != expected.X || jwk.Y != expected.Y {
+			t.Errorf("JWK %s = %+v, want the ES256 public key", jwk.Kid, jwk)
+		}
+	}
+}
+
+func TestJWKSKeyIDIsThumbprint(t *testing.T) {
+	keepJWTKeys(t)
+	key := newECKey(t)
+	t.Setenv("JWT_SIGNING_ALG", "ES256")
+	t.Setenv("JWT_PRIVATE_KEY_FILE", writePrivateKey(t, key))
+	t.Setenv("JWT_KEY_ID", "")
+	if err := ReloadJWTKeys(); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t)
+
+	var set JWKSet
+	if err := json.Unmarshal(s.do(request{method: http.MethodGet, path: "/.well-known/jwks.json"}).Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 1 {
+		t.Fatalf("JWKS has %d keys, want 1", len(set.Keys))
+	}
+	if got, want := set.Keys[0].Kid, jwkThumbprint(set.Keys[0]); got != want {
+		t.Errorf("kid = %q, want the RFC 7638 thumbprint %q", got, want)
+	}
+	ring, _ := currentKeyRing()
+	if ring.active.ID != set.Keys[0].Kid {
+		t.Errorf("tokens are signed under kid %q, JWKS publishes %q", ring.active.ID, set.Keys[0].Kid)
+	}
+}
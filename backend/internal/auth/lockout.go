@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/config"
+	"github.com/gin-gonic/gin"
+)
+
+// errAccountLocked is answered while a username is backing off. It is the
+// same whether or not the username exists.
+const errAccountLocked = "Too many failed login attempts. Please try again later."
+
+// Lockout event types
+const (
+	// LockoutBackoff is emitted when failures reach LOCKOUT_THRESHOLD and
+	// each further failure starts delaying the next attempt
+	LockoutBackoff = "backoff"
+	// LockoutLocked is emitted when the delay reaches LOCKOUT_MAX_DELAY
+	LockoutLocked = "locked"
+	// LockoutUnlocked is emitted when an administrator clears a lockout
+	LockoutUnlocked = "unlocked"
+)
+
+// LockoutEvent reports a username crossing a lockout threshold
+type LockoutEvent struct {
+	Type        string
+	Username    string
+	Failures    int
+	LockedUntil time.Time
+	IP          string
+	Time        time.Time
+}
+
+var (
+	lockoutListenersMu sync.RWMutex
+	lockoutListeners   []func(LockoutEvent)
+)
+
+// OnLockoutEvent registers fn to be called, synchronously, for every
+// lockout event
+func OnLockoutEvent(fn func(LockoutEvent)) {
+	lockoutListenersMu.Lock()
+	defer lockoutListenersMu.Unlock()
+	lockoutListeners = append(lockoutListeners, fn)
+}
+
+func emitLockoutEvent(event LockoutEvent) {
+	log.Printf("[SECURITY] Login lockout %s for user %s (%d failed logins) from %s",
+		event.Type, event.Username, event.Failures, event.IP)
+
+	lockoutListenersMu.RLock()
+	defer lockoutListenersMu.RUnlock()
+	for _, fn := range lockoutListeners {
+		fn(event)
+	}
+}
+
+// lockoutKey folds case so "Alice" and "alice" share one count
+func lockoutKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// lockoutDelay is how long the failure-th consecutive failure locks the
+// username for: nothing below the threshold, then the base delay doubling
+// with every failure up to the maximum
+func lockoutDelay(cfg *config.Config, failures int) time.Duration {
+	if failures < cfg.LockoutThreshold {
+		return 0
+	}
+	delay := cfg.LockoutBaseDelay
+	for i := cfg.LockoutThreshold; i < failures && delay < cfg.LockoutMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > cfg.LockoutMaxDelay {
+		delay = cfg.LockoutMaxDelay
+	}
+	return delay
+}
+
+// checkLockout returns how long username must wait before its next login
+// attempt, and its current failure count. Errors reading the store are
+// logged and do not block logins.
+func checkLockout(ctx context.Context, username string) (time.Duration, int) {
+	f, err := stores.Lockouts.Get(ctx, lockoutKey(username))
+	if err != nil {
+		log.Printf("[checkLockout] Error reading failed logins for user %s: %v", username, err)
+		return 0, 0
+	}
+	return time.Until(f.LockedUntil), f.Count
+}
+
+// recordLoginFailure counts a failed login for username and locks it for
+// the backoff delay, emitting an event when a threshold is crossed
+func recordLoginFailure(c *gin.Context, username string) {
+	ctx := c.Request.Context()
+	cfg := config.Load()
+	key := lockoutKey(username)
+
+	f, err := stores.Lockouts.RecordFailure(ctx, key, cfg.LockoutResetAfter)
+	if err != nil {
+		log.Printf("[recordLoginFailure] Error recording failed login for user %s: %v", username, err)
+		return
+	}
+
+	delay := lockoutDelay(cfg, f.Count)
+	if delay == 0 {
+		return
+	}
+	until := f.LastFailure.Add(delay)
+	if err := stores.Lockouts.Lock(ctx, key, until); err != nil {
+		log.Printf("[recordLoginFailure] Error locking user %s: %v", username, err)
+		return
+	}
+
+	event := LockoutEvent{Username: key, Failures: f.Count, LockedUntil: until, IP: c.ClientIP(), Time: f.LastFailure}
+	switch {
+	case delay == cfg.LockoutMaxDelay && lockoutDelay(cfg, f.Count-1) < cfg.LockoutMaxDelay:
+		event.Type = LockoutLocked
+	case f.Count == cfg.LockoutThreshold:
+		event.Type = LockoutBackoff
+	default:
+		return
+	}
+	emitLockoutEvent(event)
+}
+
+// clearLoginFailures forgets the failures for username after a successful
+// login
+func clearLoginFailures(ctx context.Context, username string) {
+	if err := stores.Lockouts.Reset(ctx, lockoutKey(username)); err != nil {
+		log.Printf("[clearLoginFailures] Error resetting failed logins for user %s: %v", username, err)
+	}
+}
+
+// setRetryAfter tells the client when a locked username may try again
+func setRetryAfter(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+}
+
+// GetLockout shows the failed login state for a username
+func GetLockout(c *gin.Context) {
+	f, err := stores.Lockouts.Get(c.Request.Context(), lockoutKey(c.Param("username")))
+	if err != nil {
+		log.Printf("[GetLockout] Error reading failed logins: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read lockout state"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"username":     f.Username,
+		"failures":     f.Count,
+		"locked":       time.Now().Before(f.LockedUntil),
+		"locked_until": f.LockedUntil,
+	})
+}
+
+// UnlockAccount clears the failed logins and any lockout for a username
+func UnlockAccount(c *gin.Context) {
+	key := lockoutKey(c.Param("username"))
+	if err := stores.Lockouts.Reset(c.Request.Context(), key); err != nil {
+		log.Printf("[UnlockAccount] Error resetting failed logins: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not unlock account"})
+		return
+	}
+
+	admin := "unknown"
+	if user, ok := contextUser(c); ok {
+		admin = user.Username
+	}
+	log.Printf("[UnlockAccount] User %s unlocked by %s", key, admin)
+	emitLockoutEvent(LockoutEvent{Type: LockoutUnlocked, Username: key, IP: c.ClientIP(), Time: time.Now()})
+
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Account %s unlocked", key)})
+}
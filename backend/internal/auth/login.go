@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"github.com/NoorBnHossam/Authentication_Types/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// errInvalidCredentials is returned for an unknown username or a wrong
+// password alike
+var errInvalidCredentials = errors.New("Invalid credentials")
+
+// loginCompleters issue the credentials each login flow ends with, once the
+// user has been authenticated
+var loginCompleters = map[string]func(*gin.Context, models.User){
+	"basic":      completeBasicLogin,
+	"token":      issueOpaqueToken,
+	"jwt":        issueJWTLogin,
+	"session":    completeSessionLogin,
+	"magic_link": completeMagicLinkLogin,
+}
+
+// verifyPassword looks the user up by username and checks the password. A
+// hash made under an older hashing policy is replaced with a current one.
+//
+// Every failure returns errInvalidCredentials after the cost of a hash
+// check, so neither the answer nor its timing reveals whether the username
+// exists.
+func verifyPassword(ctx context.Context, username, password string) (models.User, error) {
+	user, err := stores.Users.FindByUsername(ctx, username)
+	if err != nil {
+		if err != store.ErrNotFound {
+			log.Printf("[verifyPassword] Database error while looking up user %s: %v", username, err)
+		}
+		passwordHasher().VerifyDummy(password)
+		return models.User{}, errInvalidCredentials
+	}
+
+	ok, rehash, err := passwordHasher().Verify(password, user.Password)
+	if err != nil {
+		log.Printf("[verifyPassword] Cannot check password hash of user %s: %v", username, err)
+		passwordHasher().VerifyDummy(password)
+		return models.User{}, errInvalidCredentials
+	}
+	if !ok {
+		return models.User{}, errInvalidCredentials
+	}
+
+	if rehash {
+		upgradePasswordHash(ctx, &user, password)
+	}
+	return user, nil
+}
+
+// upgradePasswordHash rehashes a verified password under the current policy.
+// Failures are only logged: the old hash still works.
+func upgradePasswordHash(ctx context.Context, user *models.User, password string) {
+	hash, err := passwordHasher().Hash(password)
+	if err != nil {
+		log.Printf("[upgradePasswordHash] Error hashing password for user %s: %v", user.Username, err)
+		return
+	}
+
+	// Conditional on the old hash, so a password changed in the meantime is
+	// not overwritten
+	err = stores.Users.ReplacePasswordHash(ctx, user.ID.Hex(), user.Password, hash)
+	if err != nil {
+		if err != store.ErrNotFound {
+			log.Printf("[upgradePasswordHash] Error storing password hash for user %s: %v", user.Username, err)
+		}
+		return
+	}
+	user.Password = hash
+	log.Printf("[upgradePasswordHash] Upgraded password hash for user %s", user.Username)
+}
+
+// passwordLogin handles a username/password login and finishes it the way
+// method does, after a second factor if the user has MFA enabled
+func passwordLogin(c *gin.Context, method string) {
+	var loginReq models.LoginRequest
+	if err := c.ShouldBindJSON(&loginReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if wait, _ := checkLockout(c.Request.Context(), loginReq.Username); wait > 0 {
+		auditLoginFailure(c, loginReq.Username, method, "locked")
+		setRetryAfter(c, wait)
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": errAccountLocked})
+		return
+	}
+
+	user, err := verifyPassword(c.Request.Context(), loginReq.Username, loginReq.Password)
+	if err != nil {
+		log.Printf("[passwordLogin] Failed %s login attempt for user %s", method, loginReq.Username)
+		recordLoginFailure(c, loginReq.Username)
+		auditLoginFailure(c, loginReq.Username, method, "invalid_credentials")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := checkLoginAllowed(user); err != nil {
+		auditLoginFailure(c, user.Username, method, "email_not_verified")
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	if user.MFAEnabled {
+		startMFAChallenge(c, user, method)
+		return
+	}
+
+	completeLogin(c, user, method)
+}
+
+// completeLogin issues the credentials for method and records the login
+// once they have been issued. Failed attempts are forgotten only here, after
+// the second factor, so a known password does not reset the count of wrong
+// codes.
+func completeLogin(c *gin.Context, user models.User, method string) {
+	loginCompleters[method](c, user)
+	if c.Writer.Status() < http.StatusBadRequest {
+		clearLoginFailures(c.Request.Context(), user.Username)
+		auditLoginSuccess(c, user, method)
+	}
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"github.com/NoorBnHossam/Authentication_Types/internal/password"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestVerifyPasswordTiming checks that a wrong password for a known user,
+// whatever its hash, takes as long to refuse as any password for an unknown
+// user
+func TestVerifyPasswordTiming(t *testing.T) {
+	if testing.Short() {
+		t.Skip("timing test")
+	}
+	s := newTestServer(t)
+	ctx := context.Background()
+
+	hasher, err := password.New(password.Policy{Algorithm: "argon2id", Params: "m=8192,t=2,p=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultHasher := passwords
+	UsePasswordHasher(hasher)
+	t.Cleanup(func() { UsePasswordHasher(defaultHasher) })
+
+	s.createUser("current", testPassword)
+	legacy, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyUser := models.User{Username: "legacy", Email: "legacy@example.com", Password: string(legacy), EmailVerified: true}
+	if err := s.stores.Users.Create(ctx, &legacyUser); err != nil {
+		t.Fatal(err)
+	}
+
+	usernames := []string{"nobody", "current", "legacy"}
+	samples := make(map[string][]time.Duration)
+	for i := 0; i < 30; i++ {
+		for j := range usernames {
+			username := usernames[(i+j)%len(usernames)]
+			start := time.Now()
+			if _, err := verifyPassword(ctx, username, "not-the-password"); err != errInvalidCredentials {
+				t.Fatalf("verifyPassword(%s) = %v", username, err)
+			}
+			samples[username] = append(samples[username], time.Since(start))
+		}
+	}
+
+	median := func(d []time.Duration) time.Duration {
+		sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+		return d[len(d)/2]
+	}
+	unknown := median(samples["nobody"])
+	for _, username := range usernames[1:] {
+		known := median(samples[username])
+		ratio := float64(known) / float64(unknown)
+		t.Logf("%s: median %s, unknown user %s, ratio %.2f", username, known, unknown, ratio)
+		if ratio < 0.75 || ratio > 1.33 {
+			t.Errorf("%s: wrong password refused in %s, unknown user in %s", username, known, unknown)
+		}
+	}
+}
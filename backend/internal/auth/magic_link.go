@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/config"
+	"github.com/NoorBnHossam/Authentication_Types/internal/mailer"
+	"github.com/NoorBnHossam/Authentication_Types/internal/middleware"
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"github.com/NoorBnHossam/Authentication_Types/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	magicLinkKind = "magic_link"
+	magicLinkTTL  = 15 * time.Minute
+	// magicLinkCookie holds the browser nonce a link is bound to
+	magicLinkCookie = "magic_link"
+)
+
+// magicLinkLimiter allows 3 links per email address per 15 minutes. It is
+// keyed on the submitted address, known or not, so a 429 says nothing about
+// whether the account exists.
+var magicLinkLimiter = middleware.NewRateLimiter(middleware.Policy{
+	Name:   "magic_link_email",
+	Limit:  3,
+	Period: 15 * time.Minute,
+})
+
+// magicLink is the state behind an emailed login link. Browser is the hash of
+// the nonce cookie set on the browser that asked for the link.
+type magicLink struct {
+	UserID  string `bson:"user_id"`
+	Email   string `bson:"email"`
+	Browser string `bson:"browser"`
+}
+
+// RequestMagicLink emails a single-use login link. The response is the same,
+// and takes the same time, whether or not the address belongs to an account.
+//
+// The link carries a random token stored server side rather than a signed,
+// self-contained one: a stored token can be consumed so the link works once,
+// is voided along with the user's other states on a password reset, and
+// holds the browser binding without putting it in the URL. A signature would
+// still need a stored record for all three.
+func RequestMagicLink(c *gin.Context) {
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+
+	if !magicLinkLimiter.AllowKey(c, email) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many login links requested. Please try again later."})
+		return
+	}
+
+	nonce, err := randomURLString(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not send login link"})
+		return
+	}
+	c.SetCookie(magicLinkCookie, nonce, int(magicLinkTTL.Seconds()), "/api/magic-link", "", true, true)
+
+	user, err := stores.Users.FindByEmail(c.Request.Context(), email)
+	switch {
+	case err == nil:
+		cfg := config.Load()
+		mailInBackground(c.Request.Context(), func(ctx context.Context) {
+			if err := sendMagicLink(ctx, cfg, user, nonce); err != nil {
+				log.Printf("[RequestMagicLink] Error sending login link to user %s: %v", user.Username, err)
+			}
+		})
+	case err != store.ErrNotFound:
+		log.Printf("[RequestMagicLink] Database error: %v", err)
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "If the address belongs to an account, a login link has been sent"})
+}
+
+// MagicLinkLogin redeems a login link and creates a session. The link only
+// works in the browser that asked for it.
+func MagicLinkLogin(c *gin.Context) {
+	token := c.Query("token")
+	nonce, cookieErr := c.Cookie(magicLinkCookie)
+	if token == "" || cookieErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Open the link in the browser you requested it from"})
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	// Check the browser binding before consuming the link, so a mail scanner
+	// or another browser following it does not burn it
+	var link magicLink
+	if err := peekState(ctx, magicLinkKind, token, &link); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired login link"})
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(link.Browser), []byte(hashNonce(nonce))) != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Open the link in the browser you requested it from"})
+		return
+	}
+	if err := takeState(ctx, magicLinkKind, token, &link); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired login link"})
+		return
+	}
+	c.SetCookie(magicLinkCookie, "", -1, "/api/magic-link", "", true, true)
+
+	user, err := stores.Users.FindByID(ctx, link.UserID)
+	if err != nil || user.Email != link.Email {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired login link"})
+		return
+	}
+
+	// Following the link proves control of the address
+	if !user.EmailVerified {
+		if err := stores.Users.SetEmailVerified(ctx, link.UserID, link.Email); err != nil {
+			log.Printf("[MagicLinkLogin] Error marking email verified for user %s: %v", user.Username, err)
+		}
+		user.EmailVerified = true
+	}
+
+	if user.MFAEnabled {
+		startMFAChallenge(c, user, "magic_link")
+		return
+	}
+
+	completeLogin(c, user, "magic_link")
+}
+
+// completeMagicLinkLogin opens a session that only magic link routes accept
+func completeMagicLinkLogin(c *gin.Context, user models.User) {
+	if _, err := createSession(c, user, "magic_link"); err != nil {
+		log.Printf("[MagicLinkLogin] Error creating session for user %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create session"})
+		return
+	}
+
+	log.Printf("[MagicLinkLogin] Successful login for user %s", user.Username)
+	if redirect := config.Load().MagicLinkRedirect; redirect != "" {
+		c.Redirect(http.StatusFound, redirect)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Login successful",
+		"user":    user.ToResponse(),
+	})
+}
+
+// MagicLinkMiddleware accepts only sessions created by a magic link
+func MagicLinkMiddleware() gin.HandlerFunc {
+	return Authenticate("magic_link")
+}
+
+func sendMagicLink(ctx context.Context, cfg *config.Config, user models.User, nonce string) error {
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	err = saveUserState(ctx, magicLinkKind, token, user.ID.Hex(), magicLink{
+		UserID:  user.ID.Hex(),
+		Email:   user.Email,
+		Browser: hashNonce(nonce),
+	}, magicLinkTTL)
+	if err != nil {
+		return err
+	}
+
+	link := cfg.BaseURL + "/api/magic-link/verify?token=" + url.QueryEscape(token)
+	return outbox().Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Your login link",
+		Body: fmt.Sprintf("Hi %s,\n\nSign in by opening this link within %s, in the same browser you requested it from:\n\n%s\n\nIf you did not ask to sign in, ignore this email.",
+			user.Username, magicLinkTTL, link),
+	})
+}
+
+func hashNonce(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// followMagicLink asks for a login link for user and opens it in the same
+// browser
+func (s *testServer) followMagicLink(email string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	w := s.do(request{method: http.MethodPost, path: "/api/magic-link", body: map[string]string{"email": email}})
+	expectStatus(s.t, w, http.StatusAccepted)
+	browser := cookie(w, magicLinkCookie)
+
+	token := testMail.lastToken(s.t, email)
+	path := "/api/magic-link/verify?token=" + url.QueryEscape(token)
+
+	// Another browser cannot use the link, and does not burn it
+	expectStatus(s.t, s.do(request{method: http.MethodGet, path: path}), http.StatusBadRequest)
+
+	return s.do(request{method: http.MethodGet, path: path, cookies: []*http.Cookie{browser}})
+}
+
+func TestMagicLinkLogin(t *testing.T) {
+	s := newTestServer(t)
+	s.createUser("judy", testPassword)
+
+	w := s.followMagicLink("judy@example.com")
+	expectStatus(t, w, http.StatusOK)
+	session := cookie(w, "session_id")
+	expectStatus(t, s.do(request{method: http.MethodGet, path: "/api/magic-link/protected", cookies: []*http.Cookie{session}}), http.StatusOK)
+}
+
+func TestMagicLinkLoginWithMFA(t *testing.T) {
+	s := newTestServer(t)
+	secret := s.enableMFA(s.createUser("ken", testPassword))
+
+	w := s.followMagicLink("ken@example.com")
+	expectStatus(t, w, http.StatusOK)
+	if cookie(w, "session_id") != nil {
+		t.Fatal("session issued before the second factor")
+	}
+	ticket, _ := decode(t, w)["mfa_ticket"].(string)
+
+	w = s.verifyMFA(ticket, totpCode(t, secret))
+	expectStatus(t, w, http.StatusOK)
+	session := cookie(w, "session_id")
+	if session == nil {
+		t.Fatal("second factor did not open a session")
+	}
+
+	// The session belongs to the magic link flow, as without MFA; the
+	// magic link routes accept no other
+	expectStatus(t, s.do(request{method: http.MethodGet, path: "/api/magic-link/protected", cookies: []*http.Cookie{session}}), http.StatusOK)
+}
@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/mailer"
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"github.com/NoorBnHossam/Authentication_Types/internal/password"
+	"github.com/NoorBnHossam/Authentication_Types/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+const testUserAgent = "auth-test"
+
+func TestMain(m *testing.M) {
+	os.Setenv("JWT_SECRET_KEY", "test-secret-key-that-is-long-enough-for-hs256")
+	os.Setenv("AUDIT_SINKS", "none")
+	gin.SetMode(gin.TestMode)
+	log.SetOutput(io.Discard)
+
+	// Cheap hashes keep the tests fast
+	hasher, err := password.New(password.Policy{Algorithm: "bcrypt", Params: "r=4"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	UsePasswordHasher(hasher)
+	mailerOnce.Do(func() { appMailer = testMail })
+
+	os.Exit(m.Run())
+}
+
+// testMailer keeps the messages it is asked to send
+type testMailer struct {
+	mu   sync.Mutex
+	sent []mailer.Message
+}
+
+var testMail = &testMailer{}
+
+func (m *testMailer) Send(ctx context.Context, msg mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+var linkToken = regexp.MustCompile(`token=([^\s&]+)`)
+
+// lastToken returns the token in the link most recently mailed to address,
+// once the mails being sent in the background have gone out
+func (m *testMailer) lastToken(t *testing.T, address string) string {
+	t.Helper()
+	pendingMail.Wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.sent) - 1; i >= 0; i-- {
+		if m.sent[i].To != address {
+			continue
+		}
+		match := linkToken.FindStringSubmatch(m.sent[i].Body)
+		if match == nil {
+			t.Fatalf("no link in mail to %s: %q", address, m.sent[i].Body)
+		}
+		token, err := url.QueryUnescape(match[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	t.Fatalf("no mail sent to %s", address)
+	return ""
+}
+
+// testServer serves the auth handlers on fresh in-memory stores
+type testServer struct {
+	t      *testing.T
+	router *gin.Engine
+	stores store.Stores
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	stores := store.NewMemory()
+	UseStores(stores)
+
+	router := gin.New()
+	router.POST("/api/users/register", RegisterUser)
+	router.GET("/api/users/verify", VerifyEmail)
+	router.POST("/api/mfa/verify", VerifyMFA)
+	router.POST("/api/password/forgot", ForgotPassword)
+	router.POST("/api/password/reset", ResetPassword)
+	MountRoutes(router)
+	return &testServer{t: t, router: router, stores: stores}
+}
+
+// request describes one call to the test server
+type request struct {
+	method  string
+	path    string
+	body    any
+	form    url.Values
+	bearer  string
+	cookies []*http.Cookie
+	header  http.Header
+}
+
+func (s *testServer) do(r request) *httptest.ResponseRecorder {
+	s.t.Helper()
+	var body io.Reader
+	if r.body != nil {
+		b, err := json.Marshal(r.body)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		body = bytes.NewReader(b)
+	}
+
+	if r.form != nil {
+		body = strings.NewReader(r.form.Encode())
+	}
+
+	req := httptest.NewRequest(r.method, r.path, body)
+	req.Header.Set("User-Agent", testUserAgent)
+	if r.body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if r.form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if r.bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+r.bearer)
+	}
+	for name, values := range r.header {
+		req.Header[name] = values
+	}
+	for _, cookie := range r.cookies {
+		req.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+// createUser stores a user with a verified email and returns it
+func (s *testServer) createUser(username, pw string) models.User {
+	s.t.Helper()
+	return s.storeUser(username, pw, true)
+}
+
+// createUnverifiedUser stores a user who has not verified their email
+func (s *testServer) createUnverifiedUser(username, pw string) models.User {
+	s.t.Helper()
+	return s.storeUser(username, pw, false)
+}
+
+func (s *testServer) storeUser(username, pw string, verified bool) models.User {
+	s.t.Helper()
+	hash, err := passwordHasher().Hash(pw)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	user := models.User{
+		Username:      username,
+		Password:      hash,
+		Email:         username + "@example.com",
+		Role:          "user",
+		EmailVerified: verified,
+	}
+	if err := s.stores.Users.Create(context.Background(), &user); err != nil {
+		s.t.Fatal(err)
+	}
+	return user
+}
+
+// decode unmarshals the JSON response body into a map
+func decode(t *testing.T, w *httptest.ResponseRecorder) map[string]any {
+	t.Helper()
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("response is not JSON: %q", w.Body.String())
+	}
+	return body
+}
+
+// cookie returns the named cookie set by the response, or nil
+func cookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if w.Code != want {
+		t.Fatalf("status = %d, want %d; body %s", w.Code, want, w.Body.String())
+	}
+}
@@ -0,0 +1,291 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/config"
+	"github.com/NoorBnHossam/Authentication_Types/internal/middleware"
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	mfaTicketKind = "mfa_ticket"
+	mfaTicketTTL  = 5 * time.Minute
+	// maxMFAAttempts is the number of wrong codes a ticket survives
+	maxMFAAttempts = 5
+
+	recoveryCodeCount = 10
+)
+
+// mfaCodeThrottler limits code guesses when a signed-in user confirms or
+// disables TOTP: 5 per 15 minutes per user, then a 15 minute ban
+var mfaCodeThrottler = middleware.NewThrottler(5, 15*time.Minute, 15*time.Minute)
+
+// mfaTicket is the state between a successful password check and the second
+// factor. Method names the login flow to finish once the code is accepted.
+type mfaTicket struct {
+	UserID string `bson:"user_id"`
+	Method string `bson:"method"`
+}
+
+// startMFAChallenge answers a password login for an account with MFA enabled.
+// Nothing is issued until the ticket is exchanged at /api/mfa/verify.
+func startMFAChallenge(c *gin.Context, user models.User, method string) {
+	ticket, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start MFA challenge"})
+		return
+	}
+
+	err = saveUserState(c.Request.Context(), mfaTicketKind, ticket, user.ID.Hex(), mfaTicket{
+		UserID: user.ID.Hex(),
+		Method: method,
+	}, mfaTicketTTL)
+	if err != nil {
+		log.Printf("[MFA] Error storing ticket for user %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start MFA challenge"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"mfa_required": true,
+		"mfa_ticket":   ticket,
+		"expires_in":   int(mfaTicketTTL.Seconds()),
+	})
+}
+
+// VerifyMFA exchanges an MFA ticket and a TOTP or recovery code for the
+// token or session the original login would have returned
+func VerifyMFA(c *gin.Context) {
+	var req models.MFAVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	var ticket mfaTicket
+	if err := peekState(ctx, mfaTicketKind, req.Ticket, &ticket); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA ticket"})
+		return
+	}
+
+	user, err := stores.Users.FindByID(ctx, ticket.UserID)
+	_, known := loginCompleters[ticket.Method]
+	if err != nil || !user.MFAEnabled || !known {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA ticket"})
+		return
+	}
+
+	// Wrong codes count towards the account lockout like wrong passwords, so
+	// fresh tickets do not buy more guesses
+	if wait, _ := checkLockout(ctx, user.Username); wait > 0 {
+		auditLoginFailure(c, user.Username, ticket.Method, "locked")
+		setRetryAfter(c, wait)
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": errAccountLocked})
+		return
+	}
+
+	if !verifyMFACode(ctx, user, req.Code) {
+		recordLoginFailure(c, user.Username)
+		attempts, err := countStateAttempt(ctx, mfaTicketKind, req.Ticket)
+		if err == nil && attempts >= maxMFAAttempts {
+			// Too many guesses: the user has to start over with the password
+			var discarded mfaTicket
+			_ = takeState(ctx, mfaTicketKind, req.Ticket, &discarded)
+		}
+		log.Printf("[VerifyMFA] Invalid code for user %s", user.Username)
+		auditLoginFailure(c, user.Username, ticket.Method, "invalid_mfa_code")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	// Redeem the ticket; a concurrent request may have beaten us to it
+	if err := takeState(ctx, mfaTicketKind, req.Ticket, &ticket); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA ticket"})
+		return
+	}
+
+	completeLogin(c, user, ticket.Method)
+}
+
+// EnrollTOTP generates a new TOTP secret for the authenticated user. It only
+// takes effect once confirmed with a code from the authenticator app.
+func EnrollTOTP(c *gin.Context) {
+	user, ok := contextUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+	if user.MFAEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "MFA is already enabled"})
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate secret"})
+		return
+	}
+
+	if err := stores.Users.SetPendingTOTPSecret(c.Request.Context(), user.ID.Hex(), secret); err != nil {
+		log.Printf("[EnrollTOTP] Error storing secret for user %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start enrollment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":      secret,
+		"otpauth_uri": totpURI(config.Load().MFAIssuer, user.Username, secret),
+	})
+}
+
+// ConfirmTOTP enables MFA once the user proves the authenticator app works,
+// and returns the recovery codes. They are only shown this once.
+func ConfirmTOTP(c *gin.Context) {
+	var req models.MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	user, ok := contextUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+	if user.MFAEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "MFA is already enabled"})
+		return
+	}
+	if user.TOTPPendingSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No TOTP enrollment in progress"})
+		return
+	}
+	if !mfaCodeThrottler.AllowKey(c, user.ID.Hex()) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts. Please try again later."})
+		return
+	}
+
+	step, valid := validateTOTP(user.TOTPPendingSecret, req.Code, time.Now())
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+	mfaCodeThrottler.Reset(user.ID.Hex())
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate recovery codes"})
+		return
+	}
+
+	err = stores.Users.EnableMFA(c.Request.Context(), user.ID.Hex(), user.TOTPPendingSecret, step, hashes)
+	if err != nil {
+		log.Printf("[ConfirmTOTP] Error enabling MFA for user %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not enable MFA"})
+		return
+	}
+
+	log.Printf("[ConfirmTOTP] MFA enabled for user %s", user.Username)
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "MFA enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTOTP turns MFA off. It requires a current TOTP or recovery code so a
+// stolen session alone cannot remove the second factor.
+func DisableTOTP(c *gin.Context) {
+	var req models.MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	user, ok := contextUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+	if !user.MFAEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "MFA is not enabled"})
+		return
+	}
+	if !mfaCodeThrottler.AllowKey(c, user.ID.Hex()) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts. Please try again later."})
+		return
+	}
+	if !verifyMFACode(c.Request.Context(), user, req.Code) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+	mfaCodeThrottler.Reset(user.ID.Hex())
+
+	if err := stores.Users.DisableMFA(c.Request.Context(), user.ID.Hex()); err != nil {
+		log.Printf("[DisableTOTP] Error disabling MFA for user %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not disable MFA"})
+		return
+	}
+
+	log.Printf("[DisableTOTP] MFA disabled for user %s", user.Username)
+	c.JSON(http.StatusOK, gin.H{"message": "MFA disabled"})
+}
+
+// verifyMFACode accepts a TOTP code or an unused recovery code. Both are
+// consumed with a conditional update, so each TOTP step and each recovery
+// code works once even under concurrent requests.
+func verifyMFACode(ctx context.Context, user models.User, code string) bool {
+	code = strings.TrimSpace(code)
+
+	if step, valid := validateTOTP(user.TOTPSecret, code, time.Now()); valid {
+		return stores.Users.ConsumeTOTPStep(ctx, user.ID.Hex(), step) == nil
+	}
+
+	if err := stores.Users.ConsumeRecoveryCode(ctx, user.ID.Hex(), hashRecoveryCode(code)); err == nil {
+		log.Printf("[MFA] Recovery code used by user %s", user.Username)
+		return true
+	}
+	return false
+}
+
+// newRecoveryCodes returns fresh recovery codes and their hashes. Codes carry
+// 50 bits of randomness, so an unsalted SHA-256 is enough to store them.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes[i] = raw[:5] + "-" + raw[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// contextUser returns the user set by an authentication middleware
+func contextUser(c *gin.Context) (models.User, bool) {
+	value, exists := c.Get("user")
+	if !exists {
+		return models.User{}, false
+	}
+	user, ok := value.(models.User)
+	return user, ok
+}
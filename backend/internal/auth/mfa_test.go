@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+)
+
+// enableMFA turns TOTP on for user and returns the secret
+func (s *testServer) enableMFA(user models.User) string {
+	s.t.Helper()
+	ctx := context.Background()
+	secret, err := newTOTPSecret()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if err := s.stores.Users.SetPendingTOTPSecret(ctx, user.ID.Hex(), secret); err != nil {
+		s.t.Fatal(err)
+	}
+	if err := s.stores.Users.EnableMFA(ctx, user.ID.Hex(), secret, 0, nil); err != nil {
+		s.t.Fatal(err)
+	}
+	return secret
+}
+
+// totpCode returns the current code for secret
+func totpCode(t *testing.T, secret string) string {
+	t.Helper()
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hotp(key, uint64(time.Now().Unix()/totpPeriod))
+}
+
+// wrongCode returns a well-formed code that secret does not accept now
+func wrongCode(t *testing.T, secret string) string {
+	t.Helper()
+	for _, code := range []string{"000000", "111111", "222222"} {
+		if _, valid := validateTOTP(secret, code, time.Now()); !valid {
+			return code
+		}
+	}
+	t.Fatal("no wrong code found")
+	return ""
+}
+
+// mfaTicketFor logs username in with the password and returns the MFA ticket
+func (s *testServer) mfaTicketFor(username string) string {
+	s.t.Helper()
+	w := s.do(request{method: http.MethodPost, path: "/api/token-auth/login", body: map[string]string{
+		"username": username,
+		"password": testPassword,
+	}})
+	expectStatus(s.t, w, http.StatusOK)
+	body := decode(s.t, w)
+	if body["mfa_required"] != true {
+		s.t.Fatalf("login did not ask for MFA: %v", body)
+	}
+	return body["mfa_ticket"].(string)
+}
+
+func (s *testServer) verifyMFA(ticket, code string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	return s.do(request{method: http.MethodPost, path: "/api/mfa/verify", body: map[string]string{
+		"mfa_ticket": ticket,
+		"code":       code,
+	}})
+}
+
+func TestMFALogin(t *testing.T) {
+	s := newTestServer(t)
+	secret := s.enableMFA(s.createUser("alice", testPassword))
+
+	ticket := s.mfaTicketFor("alice")
+	expectStatus(t, s.verifyMFA(ticket, wrongCode(t, secret)), http.StatusUnauthorized)
+
+	w := s.verifyMFA(ticket, totpCode(t, secret))
+	expectStatus(t, w, http.StatusOK)
+	token, _ := decode(t, w)["token"].(string)
+	expectStatus(t, s.do(request{method: http.MethodGet, path: "/api/token-auth/protected", bearer: token}), http.StatusOK)
+
+	// Tickets are single-use
+	expectStatus(t, s.verifyMFA(ticket, totpCode(t, secret)), http.StatusUnauthorized)
+}
+
+func TestMFAWrongCodesLockAccount(t *testing.T) {
+	t.Setenv("LOCKOUT_THRESHOLD", "3")
+	t.Setenv("LOCKOUT_BASE_DELAY", "1m")
+	s := newTestServer(t)
+	secret := s.enableMFA(s.createUser("alice", testPassword))
+
+	// A fresh ticket for every guess does not reset the count
+	for i := 0; i < 3; i++ {
+		expectStatus(t, s.verifyMFA(s.mfaTicketFor("alice"), wrongCode(t, secret)), http.StatusUnauthorized)
+	}
+
+	w := s.do(request{method: http.MethodPost, path: "/api/token-auth/login", body: map[string]string{
+		"username": "alice",
+		"password": testPassword,
+	}})
+	expectStatus(t, w, http.StatusTooManyRequests)
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("locked login has no Retry-After")
+	}
+}
+
+func TestMFALockoutAppliesToOpenTickets(t *testing.T) {
+	t.Setenv("LOCKOUT_THRESHOLD", "2")
+	t.Setenv("LOCKOUT_BASE_DELAY", "1m")
+	s := newTestServer(t)
+	secret := s.enableMFA(s.createUser("alice", testPassword))
+
+	open := s.mfaTicketFor("alice")
+	guessing := s.mfaTicketFor("alice")
+	for i := 0; i < 2; i++ {
+		expectStatus(t, s.verifyMFA(guessing, wrongCode(t, secret)), http.StatusUnauthorized)
+	}
+	expectStatus(t, s.verifyMFA(open, totpCode(t, secret)), http.StatusTooManyRequests)
+}
+
+func TestPasswordAloneKeepsFailures(t *testing.T) {
+	s := newTestServer(t)
+	secret := s.enableMFA(s.createUser("alice", testPassword))
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		w := s.do(request{method: http.MethodPost, path: "/api/token-auth/login", body: map[string]string{
+			"username": "alice",
+			"password": "not-the-password",
+		}})
+		expectStatus(t, w, http.StatusUnauthorized)
+	}
+
+	ticket := s.mfaTicketFor("alice")
+	if f, _ := s.stores.Lockouts.Get(ctx, "alice"); f.Count != 2 {
+		t.Fatalf("failures after the password = %d, want 2", f.Count)
+	}
+
+	expectStatus(t, s.verifyMFA(ticket, totpCode(t, secret)), http.StatusOK)
+	if f, _ := s.stores.Lockouts.Get(ctx, "alice"); f.Count != 0 {
+		t.Fatalf("failures after the second factor = %d, want 0", f.Count)
+	}
+}
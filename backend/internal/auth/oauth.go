@@ -0,0 +1,484 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/config"
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"github.com/NoorBnHossam/Authentication_Types/internal/store"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const oauthStateKind = "oauth"
+const oauthStateTTL = 10 * time.Minute
+const oauthStateCookie = "oauth_state"
+
+// oauthHTTPClient is used for back-channel calls to the provider
+var oauthHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// OAuthState is kept server-side between OAuthLogin and OAuthCallback
+type OAuthState struct {
+	CodeVerifier string    `bson:"code_verifier"`
+	Nonce        string    `bson:"nonce"`
+	RedirectURI  string    `bson:"redirect_uri"`
+	CreatedAt    time.Time `bson:"created_at"`
+}
+
+// oauthTokenResponse is the token endpoint response (RFC 6749 section 5.1)
+type oauthTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int    `json:"expires_in"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// oauthProfile is the provider identity, merged from the ID token and the
+// userinfo endpoint
+type oauthProfile struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+}
+
+type oauthIDTokenClaims struct {
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+	jwt.RegisteredClaims
+}
+
+// randomURLString returns n random bytes encoded with the unpadded URL-safe
+// alphabet, which is valid for PKCE verifiers, state and nonce values.
+func randomURLString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// pkceChallenge derives the S256 code challenge (RFC 7636 section 4.2)
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// OAuthLogin starts the authorization code flow by redirecting the browser to
+// the provider with a fresh state, nonce and PKCE challenge.
+func OAuthLogin(c *gin.Context) {
+	cfg := config.Load()
+	if !cfg.OAuthEnabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "OAuth is not configured"})
+		return
+	}
+
+	state, err := randomURLString(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start OAuth flow"})
+		return
+	}
+	nonce, err := randomURLString(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start OAuth flow"})
+		return
+	}
+	verifier, err := randomURLString(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start OAuth flow"})
+		return
+	}
+
+	err = saveState(c.Request.Context(), oauthStateKind, state, OAuthState{
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		RedirectURI:  cfg.OAuthRedirectURL,
+		CreatedAt:    time.Now(),
+	}, oauthStateTTL)
+	if err != nil {
+		log.Printf("[OAuthLogin] Error storing state: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start OAuth flow"})
+		return
+	}
+
+	authURL, err := url.Parse(cfg.OAuthAuthURL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid OAuth authorization URL"})
+		return
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", cfg.OAuthClientID)
+	query.Set("redirect_uri", cfg.OAuthRedirectURL)
+	query.Set("scope", strings.Join(cfg.OAuthScopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", pkceChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+
+	// Bind the state to this browser so a callback cannot be replayed in
+	// another user's browser (login CSRF)
+	c.SetCookie(oauthStateCookie, state, int(oauthStateTTL.Seconds()), "/api/oauth", "", true, true)
+	c.Redirect(http.StatusFound, authURL.String())
+}
+
+// OAuthCallback completes the flow: it checks state, exchanges the code for
+// tokens, resolves the provider identity to a user and opens a session.
+func OAuthCallback(c *gin.Context) {
+	cfg := config.Load()
+	if !cfg.OAuthEnabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "OAuth is not configured"})
+		return
+	}
+
+	if providerErr := c.Query("error"); providerErr != "" {
+		log.Printf("[OAuthCallback] Provider returned error %q: %s", providerErr, c.Query("error_description"))
+		auditLoginFailure(c, "", "oauth", "authorization_denied")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization was denied"})
+		return
+	}
+
+	stateParam := c.Query("state")
+	code := c.Query("code")
+	if stateParam == "" || code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing code or state"})
+		return
+	}
+
+	stateCookie, err := c.Cookie(oauthStateCookie)
+	c.SetCookie(oauthStateCookie, "", -1, "/api/oauth", "", true, true)
+	if err != nil || subtle.ConstantTimeCompare([]byte(stateCookie), []byte(stateParam)) != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid OAuth state"})
+		return
+	}
+
+	var state OAuthState
+	if err := takeState(c.Request.Context(), oauthStateKind, stateParam, &state); err != nil {
+		if !errors.Is(err, errStateNotFound) {
+			log.Printf("[OAuthCallback] Error loading state: %v", err)
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid OAuth state"})
+		return
+	}
+
+	tokens, err := exchangeOAuthCode(c.Request.Context(), cfg, code, state)
+	if err != nil {
+		log.Printf("[OAuthCallback] Code exchange failed: %v", err)
+		auditLoginFailure(c, "", "oauth", "code_exchange_failed")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Could not exchange authorization code"})
+		return
+	}
+
+	profile, err := resolveOAuthProfile(c.Request.Context(), cfg, tokens, state.Nonce)
+	if err != nil {
+		log.Printf("[OAuthCallback] Could not resolve provider identity: %v", err)
+		reason := "invalid_identity"
+		switch {
+		case errors.Is(err, errOAuthIDToken):
+			reason = "invalid_id_token"
+		case errors.Is(err, errOAuthUserInfo):
+			reason = "userinfo_failed"
+		}
+		auditLoginFailure(c, "", "oauth", reason)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Could not verify provider identity"})
+		return
+	}
+
+	user, err := linkOAuthUser(c.Request.Context(), cfg.OAuthProvider, profile)
+	if errors.Is(err, errOAuthEmailInUse) {
+		log.Printf("[SECURITY] Refused to link %s/%s to the existing account for %s: email not verified on both sides",
+			cfg.OAuthProvider, profile.Subject, profile.Email)
+		auditLoginFailure(c, profile.Email, "oauth", "email_in_use")
+		c.JSON(http.StatusConflict, gin.H{"error": "An account with this email address already exists"})
+		return
+	}
+	if err != nil {
+		log.Printf("[OAuthCallback] Could not link identity %s/%s: %v", cfg.OAuthProvider, profile.Subject, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not link account"})
+		return
+	}
+
+	if _, err := createSession(c, user, "oauth"); err != nil {
+		log.Printf("[OAuthCallback] Error creating session for user %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create session"})
+		return
+	}
+
+	log.Printf("[OAuthCallback] Successful login for user %s via %s", user.Username, cfg.OAuthProvider)
+	auditLoginSuccess(c, user, "oauth")
+	if cfg.OAuthPostLoginRedirect != "" {
+		c.Redirect(http.StatusFound, cfg.OAuthPostLoginRedirect)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Login successful",
+		"user":    user.ToResponse(),
+	})
+}
+
+// OAuthMiddleware accepts sessions that were created by OAuthCallback
+func OAuthMiddleware() gin.HandlerFunc {
+	return Authenticate("oauth")
+}
+
+// exchangeOAuthCode redeems the authorization code at the token endpoint
+func exchangeOAuthCode(ctx context.Context, cfg *config.Config, code string, state OAuthState) (*oauthTokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", state.RedirectURI)
+	form.Set("client_id", cfg.OAuthClientID)
+	form.Set("code_verifier", state.CodeVerifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.OAuthTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if cfg.OAuthClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(cfg.OAuthClientID), url.QueryEscape(cfg.OAuthClientSecret))
+	}
+
+	resp, err := oauthHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var tokens oauthTokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("decoding token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("token endpoint returned %d: %s %s", resp.StatusCode, tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.AccessToken == "" {
+		return nil, errors.New("token response has no access_token")
+	}
+	if !strings.EqualFold(tokens.TokenType, "bearer") {
+		return nil, fmt.Errorf("unsupported token type %q", tokens.TokenType)
+	}
+	return &tokens, nil
+}
+
+// resolveOAuthProfile builds the provider identity from the ID token (if the
+// openid scope was requested) and the userinfo endpoint.
+func resolveOAuthProfile(ctx context.Context, cfg *config.Config, tokens *oauthTokenResponse, nonce string) (*oauthProfile, error) {
+	profile := &oauthProfile{}
+
+	if tokens.IDToken != "" {
+		claims, err := parseOAuthIDToken(cfg, tokens.IDToken, nonce)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errOAuthIDToken, err)
+		}
+		profile.Subject = claims.Subject
+		profile.Email = claims.Email
+		profile.EmailVerified = claims.EmailVerified
+		profile.PreferredUsername = claims.PreferredUsername
+		profile.Name = claims.Name
+	} else if hasScope(cfg.OAuthScopes, "openid") {
+		return nil, fmt.Errorf("%w: openid scope requested but none returned", errOAuthIDToken)
+	}
+
+	if cfg.OAuthUserInfoURL != "" {
+		info, err := fetchOAuthUserInfo(ctx, cfg.OAuthUserInfoURL, tokens.AccessToken)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errOAuthUserInfo, err)
+		}
+		if profile.Subject != "" && info.Subject != profile.Subject {
+			return nil, fmt.Errorf("%w: subject does not match id_token subject", errOAuthUserInfo)
+		}
+		profile.Subject = info.Subject
+		if info.Email != "" {
+			profile.Email = info.Email
+			profile.EmailVerified = info.EmailVerified
+		}
+		if info.PreferredUsername != "" {
+			profile.PreferredUsername = info.PreferredUsername
+		}
+		if info.Name != "" {
+			profile.Name = info.Name
+		}
+	}
+
+	if profile.Subject == "" {
+		return nil, errors.New("provider did not return a subject")
+	}
+	return profile, nil
+}
+
+// parseOAuthIDToken checks the claims of an ID token received directly from
+// the token endpoint. The TLS connection to the token endpoint authenticates
+// the issuer, so the signature is not verified here (OpenID Connect Core
+// section 3.1.3.7).
+func parseOAuthIDToken(cfg *config.Config, idToken, nonce string) (*oauthIDTokenClaims, error) {
+	claims := &oauthIDTokenClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(idToken, claims); err != nil {
+		return nil, fmt.Errorf("parsing id_token: %w", err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, errors.New("id_token nonce mismatch")
+	}
+	if cfg.OAuthIssuer != "" && claims.Issuer != cfg.OAuthIssuer {
+		return nil, fmt.Errorf("unexpected id_token issuer %q", claims.Issuer)
+	}
+
+	audienceOK := false
+	for _, aud := range claims.Audience {
+		if aud == cfg.OAuthClientID {
+			audienceOK = true
+			break
+		}
+	}
+	if !audienceOK {
+		return nil, errors.New("id_token audience does not include client")
+	}
+
+	if claims.ExpiresAt == nil || time.Now().After(claims.ExpiresAt.Time) {
+		return nil, errors.New("id_token has expired")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("id_token has no subject")
+	}
+	return claims, nil
+}
+
+func fetchOAuthUserInfo(ctx context.Context, userInfoURL, accessToken string) (*oauthProfile, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, userInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := oauthHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo endpoint returned %d", resp.StatusCode)
+	}
+
+	var info oauthProfile
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&info); err != nil {
+		return nil, fmt.Errorf("decoding userinfo response: %w", err)
+	}
+	return &info, nil
+}
+
+// errOAuthIDToken and errOAuthUserInfo wrap the reasons the provider's ID
+// token or userinfo response was refused
+var (
+	errOAuthIDToken  = errors.New("invalid id_token")
+	errOAuthUserInfo = errors.New("invalid userinfo response")
+)
+
+// errOAuthEmailInUse is returned when an unlinked provider identity has the
+// email address of an existing account that cannot safely be linked to it
+var errOAuthEmailInUse = errors.New("email address belongs to another account")
+
+// linkOAuthUser finds the user linked to the provider identity. An unknown
+// identity is attached to the user with the same email only when both the
+// provider and the local account have verified the address: otherwise whoever
+// registered the address first, without owning it, would be handed the
+// provider user's logins. Other matches return errOAuthEmailInUse. Identities
+// without a matching user get a new one.
+func linkOAuthUser(ctx context.Context, provider string, profile *oauthProfile) (models.User, error) {
+	identity := models.Identity{Provider: provider, Subject: profile.Subject}
+
+	user, err := stores.Users.FindByIdentity(ctx, provider, profile.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if err != store.ErrNotFound {
+		return models.User{}, err
+	}
+
+	profile.Email = strings.ToLower(strings.TrimSpace(profile.Email))
+	if profile.Email != "" {
+		user, err = stores.Users.FindByEmail(ctx, profile.Email)
+		if err == nil {
+			if !profile.EmailVerified || !user.EmailVerified {
+				return models.User{}, errOAuthEmailInUse
+			}
+			if err := stores.Users.AddIdentity(ctx, user.ID.Hex(), identity); err != nil {
+				return models.User{}, err
+			}
+			user.Identities = append(user.Identities, identity)
+			log.Printf("[OAuthCallback] Linked %s/%s to user %s by verified email", provider, profile.Subject, user.Username)
+			return user, nil
+		}
+		if err != store.ErrNotFound {
+			return models.User{}, err
+		}
+	}
+
+	username := oauthUsername(provider, profile)
+	_, err = stores.Users.FindByUsername(ctx, username)
+	if err == nil {
+		username = provider + "_" + profile.Subject
+	} else if err != store.ErrNotFound {
+		return models.User{}, err
+	}
+
+	now := time.Now()
+	user = models.User{
+		Username:      username,
+		Email:         profile.Email,
+		Role:          "user",
+		EmailVerified: profile.EmailVerified,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		Identities:    []models.Identity{identity},
+	}
+	if err := stores.Users.Create(ctx, &user); err != nil {
+		return models.User{}, err
+	}
+
+	log.Printf("[OAuthCallback] Created user %s for %s/%s", username, provider, profile.Subject)
+	return user, nil
+}
+
+func oauthUsername(provider string, profile *oauthProfile) string {
+	switch {
+	case profile.PreferredUsername != "":
+		return profile.PreferredUsername
+	case profile.Email != "":
+		return strings.SplitN(profile.Email, "@", 2)[0]
+	default:
+		return provider + "_" + profile.Subject
+	}
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockOAuthProvider is an authorization server that answers every code with
+// the identity it is currently set to
+type mockOAuthProvider struct {
+	*httptest.Server
+	mu       sync.Mutex
+	nonce    string
+	identity oauthProfile
+}
+
+func newMockOAuthProvider(t *testing.T) *mockOAuthProvider {
+	p := &mockOAuthProvider{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if r.FormValue("code") != "good-code" || r.FormValue("code_verifier") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		idToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, oauthIDTokenClaims{
+			Nonce:         p.nonce,
+			Email:         p.identity.Email,
+			EmailVerified: p.identity.EmailVerified,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    p.URL,
+				Subject:   p.identity.Subject,
+				Audience:  jwt.ClaimStrings{"test-client"},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+		}).SignedString([]byte("provider-key"))
+		if err != nil {
+			t.Error(err)
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "provider-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   60,
+			"id_token":     idToken,
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer provider-access-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(p.identity)
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+
+	t.Setenv("OAUTH_PROVIDER", "mock")
+	t.Setenv("OAUTH_CLIENT_ID", "test-client")
+	t.Setenv("OAUTH_AUTH_URL", p.URL+"/authorize")
+	t.Setenv("OAUTH_TOKEN_URL", p.URL+"/token")
+	t.Setenv("OAUTH_USERINFO_URL", p.URL+"/userinfo")
+	t.Setenv("OAUTH_ISSUER", p.URL)
+	return p
+}
+
+// login runs the authorization code flow for identity and returns the
+// callback response
+func (p *mockOAuthProvider) login(t *testing.T, s *testServer, identity oauthProfile) *httptest.ResponseRecorder {
+	t.Helper()
+	w := s.do(request{method: http.MethodGet, path: "/api/oauth/login"})
+	expectStatus(t, w, http.StatusFound)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.mu.Lock()
+	p.nonce = location.Query().Get("nonce")
+	p.identity = identity
+	p.mu.Unlock()
+
+	state := location.Query().Get("state")
+	return s.do(request{
+		method:  http.MethodGet,
+		path:    "/api/oauth/callback?code=good-code&state=" + url.QueryEscape(state),
+		cookies: []*http.Cookie{cookie(w, oauthStateCookie)},
+	})
+}
+
+func TestOAuthLogin(t *testing.T) {
+	provider := newMockOAuthProvider(t)
+
+	t.Run("new identity", func(t *testing.T) {
+		s := newTestServer(t)
+		w := provider.login(t, s, oauthProfile{Subject: "42", Email: "carol@example.com", EmailVerified: true, PreferredUsername: "carol"})
+		expectStatus(t, w, http.StatusOK)
+
+		user, err := s.stores.Users.FindByIdentity(context.Background(), "mock", "42")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Username != "carol" || !user.EmailVerified {
+			t.Errorf("created user = %+v", user)
+		}
+
+		session := cookie(w, "session_id")
+		expectStatus(t, s.do(request{method: http.MethodGet, path: "/api/oauth/protected", cookies: []*http.Cookie{session}}), http.StatusOK)
+
+		// The linked identity logs in to the same user
+		provider.login(t, s, oauthProfile{Subject: "42", Email: "carol@example.com", EmailVerified: true})
+		again, err := s.stores.Users.FindByIdentity(context.Background(), "mock", "42")
+		if err != nil || again.ID != user.ID {
+			t.Errorf("second login resolved to %+v, %v", again, err)
+		}
+	})
+
+	t.Run("state mismatch", func(t *testing.T) {
+		s := newTestServer(t)
+		w := s.do(request{method: http.MethodGet, path: "/api/oauth/login"})
+		w = s.do(request{
+			method:  http.MethodGet,
+			path:    "/api/oauth/callback?code=good-code&state=forged",
+			cookies: []*http.Cookie{cookie(w, oauthStateCookie)},
+		})
+		expectStatus(t, w, http.StatusBadRequest)
+	})
+}
+
+func TestOAuthLinksOnlyVerifiedEmails(t *testing.T) {
+	provider := newMockOAuthProvider(t)
+
+	tests := []struct {
+		name             string
+		localVerified    bool
+		providerVerified bool
+		wantStatus       int
+	}{
+		{"both verified", true, true, http.StatusOK},
+		{"local account unverified", false, true, http.StatusConflict},
+		{"provider email unverified", true, false, http.StatusConflict},
+		{"neither verified", false, false, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+			createUser := s.createUser
+			if !tt.localVerified {
+				createUser = s.createUnverifiedUser
+			}
+			local := createUser("dave", testPassword)
+
+			w := provider.login(t, s, oauthProfile{
+				Subject:       "7",
+				Email:         "Dave@Example.com",
+				EmailVerified: tt.providerVerified,
+			})
+			expectStatus(t, w, tt.wantStatus)
+
+			user, err := s.stores.Users.FindByIdentity(context.Background(), "mock", "7")
+			if tt.wantStatus == http.StatusOK {
+				if err != nil || user.ID != local.ID {
+					t.Errorf("identity linked to %+v, %v; want user %s", user, err, local.ID.Hex())
+				}
+				return
+			}
+			if err == nil {
+				t.Errorf("identity was linked to user %s", user.Username)
+			}
+			if cookie(w, "session_id") != nil {
+				t.Error("refused login set a session cookie")
+			}
+		})
+	}
+}
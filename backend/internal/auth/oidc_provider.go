@@ -0,0 +1,432 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/config"
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const oidcCodeKind = "oidc_code"
+const oidcCodeTTL = 5 * time.Minute
+const oidcTokenTTL = 15 * time.Minute
+
+// OIDCClient is a relying party registered with the embedded provider
+type OIDCClient struct {
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Name         string   `json:"name"`
+}
+
+// Public clients have no secret and must use PKCE
+func (cl *OIDCClient) isPublic() bool {
+	return cl.ClientSecret == ""
+}
+
+func (cl *OIDCClient) allowsRedirect(redirectURI string) bool {
+	for _, uri := range cl.RedirectURIs {
+		if uri == redirectURI {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcAuthorization is the state behind an issued authorization code
+type oidcAuthorization struct {
+	ClientID            string    `bson:"client_id"`
+	RedirectURI         string    `bson:"redirect_uri"`
+	UserID              string    `bson:"user_id"`
+	Scope               string    `bson:"scope"`
+	Nonce               string    `bson:"nonce"`
+	CodeChallenge       string    `bson:"code_challenge"`
+	CodeChallengeMethod string    `bson:"code_challenge_method"`
+	AuthTime            time.Time `bson:"auth_time"`
+}
+
+// OIDCIDTokenClaims are the claims of an ID token issued by the provider
+type OIDCIDTokenClaims struct {
+	Nonce             string `json:"nonce,omitempty"`
+	AuthTime          int64  `json:"auth_time,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Email             string `json:"email,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// OIDCAccessTokenClaims are the claims of an access token issued by the
+// provider (RFC 9068)
+type OIDCAccessTokenClaims struct {
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope"`
+	jwt.RegisteredClaims
+}
+
+// errOIDCSymmetricKey means the active JWT key is an HMAC secret, which
+// relying parties cannot verify
+var errOIDCSymmetricKey = errors.New("the OIDC provider needs an asymmetric JWT signing key (RS256, ES256 or EdDSA)")
+
+// OIDCProvider is an OpenID Connect authorization server that issues
+// identity for users in the users collection. Tokens are signed with the
+// JWT key ring, so relying parties find the keys at /.well-known/jwks.json
+// and rotation works as for the service's own tokens.
+type OIDCProvider struct {
+	issuer   string
+	loginURL string
+	clients  map[string]*OIDCClient
+}
+
+// NewOIDCProvider checks the signing key and loads the registered clients
+func NewOIDCProvider(cfg *config.Config) (*OIDCProvider, error) {
+	ring, err := currentKeyRing()
+	if err != nil {
+		return nil, err
+	}
+	if ring.active.symmetric() {
+		return nil, errOIDCSymmetricKey
+	}
+
+	clients := make(map[string]*OIDCClient)
+	if cfg.OIDCClientsFile != "" {
+		data, err := os.ReadFile(cfg.OIDCClientsFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading OIDC clients: %w", err)
+		}
+		var list []*OIDCClient
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("parsing OIDC clients: %w", err)
+		}
+		for _, client := range list {
+			if client.ClientID == "" || len(client.RedirectURIs) == 0 {
+				return nil, errors.New("OIDC clients need a client_id and at least one redirect_uri")
+			}
+			clients[client.ClientID] = client
+		}
+	}
+
+	return &OIDCProvider{
+		issuer:   cfg.OIDCIssuer,
+		loginURL: cfg.OIDCLoginURL,
+		clients:  clients,
+	}, nil
+}
+
+// Discovery serves /.well-known/openid-configuration
+func (p *OIDCProvider) Discovery(c *gin.Context) {
+	ring, err := currentKeyRing()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"userinfo_endpoint":                     p.issuer + "/userinfo",
+		"jwks_uri":                              p.issuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{ring.active.Method.Alg()},
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "preferred_username", "email"},
+	})
+}
+
+// Authorize handles the authorization endpoint. The end user must already
+// have a session with this service.
+func (p *OIDCProvider) Authorize(c *gin.Context) {
+	client, ok := p.clients[c.Query("client_id")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": "Unknown client"})
+		return
+	}
+	redirectURI := c.Query("redirect_uri")
+	if !client.allowsRedirect(redirectURI) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request", "error_description": "Unregistered redirect_uri"})
+		return
+	}
+
+	// From here on errors are reported to the client via redirect
+	state := c.Query("state")
+	if c.Query("response_type") != "code" {
+		p.redirectError(c, redirectURI, state, "unsupported_response_type")
+		return
+	}
+	scopes := strings.Fields(c.Query("scope"))
+	if !hasScope(scopes, "openid") {
+		p.redirectError(c, redirectURI, state, "invalid_scope")
+		return
+	}
+
+	challenge := c.Query("code_challenge")
+	method := c.Query("code_challenge_method")
+	if challenge != "" && method != "S256" {
+		p.redirectError(c, redirectURI, state, "invalid_request")
+		return
+	}
+	if challenge == "" && client.isPublic() {
+		p.redirectError(c, redirectURI, state, "invalid_request")
+		return
+	}
+
+	session, user, err := authenticateSession(c, "")
+	if err != nil {
+		if c.Query("prompt") == "none" {
+			p.redirectError(c, redirectURI, state, "login_required")
+			return
+		}
+		if p.loginURL != "" {
+			returnTo := p.issuer + c.Request.URL.RequestURI()
+			c.Redirect(http.StatusFound, p.loginURL+"?return_to="+url.QueryEscape(returnTo))
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "login_required", "error_description": "Sign in before authorizing"})
+		return
+	}
+
+	code, err := randomURLString(32)
+	if err != nil {
+		p.redirectError(c, redirectURI, state, "server_error")
+		return
+	}
+	err = saveUserState(c.Request.Context(), oidcCodeKind, code, user.ID.Hex(), oidcAuthorization{
+		ClientID:            client.ClientID,
+		RedirectURI:         redirectURI,
+		UserID:              user.ID.Hex(),
+		Scope:               strings.Join(scopes, " "),
+		Nonce:               c.Query("nonce"),
+		CodeChallenge:       challenge,
+		CodeChallengeMethod: method,
+		AuthTime:            session.CreatedAt,
+	}, oidcCodeTTL)
+	if err != nil {
+		log.Printf("[OIDCAuthorize] Error storing authorization code: %v", err)
+		p.redirectError(c, redirectURI, state, "server_error")
+		return
+	}
+
+	params := url.Values{}
+	params.Set("code", code)
+	if state != "" {
+		params.Set("state", state)
+	}
+	c.Redirect(http.StatusFound, appendQuery(redirectURI, params))
+}
+
+// Token handles the token endpoint for the authorization_code grant
+func (p *OIDCProvider) Token(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	client, ok := p.authenticateClient(c)
+	if !ok {
+		c.Header("WWW-Authenticate", `Basic realm="oidc"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_client"})
+		return
+	}
+
+	if c.PostForm("grant_type") != "authorization_code" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported_grant_type"})
+		return
+	}
+
+	var authz oidcAuthorization
+	if err := takeState(c.Request.Context(), oidcCodeKind, c.PostForm("code"), &authz); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
+		return
+	}
+	if authz.ClientID != client.ClientID || authz.RedirectURI != c.PostForm("redirect_uri") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
+		return
+	}
+	if authz.CodeChallenge != "" {
+		verifier := c.PostForm("code_verifier")
+		if verifier == "" || subtle.ConstantTimeCompare([]byte(pkceChallenge(verifier)), []byte(authz.CodeChallenge)) != 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+			return
+		}
+	}
+
+	user, err := p.findUser(c, authz.UserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	scopes := strings.Fields(authz.Scope)
+	idClaims := OIDCIDTokenClaims{
+		Nonce:    authz.Nonce,
+		AuthTime: authz.AuthTime.Unix(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    p.issuer,
+			Subject:   user.ID.Hex(),
+			Audience:  jwt.ClaimStrings{client.ClientID},
+			ExpiresAt: jwt.NewNumericDate(now.Add(oidcTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	if hasScope(scopes, "profile") {
+		idClaims.PreferredUsername = user.Username
+	}
+	if hasScope(scopes, "email") {
+		idClaims.Email = user.Email
+	}
+
+	idToken, err := p.sign(idClaims, "JWT")
+	if err != nil {
+		log.Printf("[OIDCToken] Error signing ID token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	jti, err := randomURLString(16)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+	accessToken, err := p.sign(OIDCAccessTokenClaims{
+		ClientID: client.ClientID,
+		Scope:    authz.Scope,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    p.issuer,
+			Subject:   user.ID.Hex(),
+			Audience:  jwt.ClaimStrings{p.issuer},
+			ExpiresAt: jwt.NewNumericDate(now.Add(oidcTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        jti,
+		},
+	}, "at+jwt")
+	if err != nil {
+		log.Printf("[OIDCToken] Error signing access token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(oidcTokenTTL.Seconds()),
+		"id_token":     idToken,
+		"scope":        authz.Scope,
+	})
+}
+
+// UserInfo returns claims about the user the access token was issued for
+func (p *OIDCProvider) UserInfo(c *gin.Context) {
+	auth := c.GetHeader("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		c.Header("WWW-Authenticate", `Bearer realm="oidc"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
+		return
+	}
+
+	ring, err := currentKeyRing()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+	claims := &OIDCAccessTokenClaims{}
+	token, err := jwt.ParseWithClaims(strings.TrimPrefix(auth, "Bearer "), claims, ring.keyFunc,
+		jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}),
+		jwt.WithIssuer(p.issuer),
+		jwt.WithAudience(p.issuer),
+	)
+	if err == nil && token.Header["typ"] != "at+jwt" {
+		err = errors.New("not an access token")
+	}
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer realm="oidc", error="invalid_token"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
+		return
+	}
+
+	user, err := p.findUser(c, claims.Subject)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer realm="oidc", error="invalid_token"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
+		return
+	}
+
+	scopes := strings.Fields(claims.Scope)
+	info := gin.H{"sub": user.ID.Hex()}
+	if hasScope(scopes, "profile") {
+		info["preferred_username"] = user.Username
+	}
+	if hasScope(scopes, "email") {
+		info["email"] = user.Email
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// authenticateClient accepts client_secret_basic, client_secret_post and,
+// for public clients, a bare client_id
+func (p *OIDCProvider) authenticateClient(c *gin.Context) (*OIDCClient, bool) {
+	clientID, secret, hasBasic := c.Request.BasicAuth()
+	if hasBasic {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = c.PostForm("client_id")
+		secret = c.PostForm("client_secret")
+	}
+
+	client, ok := p.clients[clientID]
+	if !ok {
+		return nil, false
+	}
+	if client.isPublic() {
+		return client, secret == ""
+	}
+	return client, subtle.ConstantTimeCompare([]byte(secret), []byte(client.ClientSecret)) == 1
+}
+
+// sign signs claims with the active key of the JWT key ring
+func (p *OIDCProvider) sign(claims jwt.Claims, typ string) (string, error) {
+	ring, err := currentKeyRing()
+	if err != nil {
+		return "", err
+	}
+	// A reload may have made an HMAC key active since startup
+	if ring.active.symmetric() {
+		return "", errOIDCSymmetricKey
+	}
+	token := jwt.NewWithClaims(ring.active.Method, claims)
+	token.Header["kid"] = ring.active.ID
+	token.Header["typ"] = typ
+	return token.SignedString(ring.active.Private)
+}
+
+func (p *OIDCProvider) findUser(c *gin.Context, userID string) (models.User, error) {
+	return stores.Users.FindByID(c.Request.Context(), userID)
+}
+
+func (p *OIDCProvider) redirectError(c *gin.Context, redirectURI, state, code string) {
+	params := url.Values{}
+	params.Set("error", code)
+	if state != "" {
+		params.Set("state", state)
+	}
+	c.Redirect(http.StatusFound, appendQuery(redirectURI, params))
+}
+
+func appendQuery(rawURL string, params url.Values) string {
+	if strings.Contains(rawURL, "?") {
+		return rawURL + "&" + params.Encode()
+	}
+	return rawURL + "?" + params.Encode()
+}
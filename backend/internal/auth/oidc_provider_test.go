@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testOIDCRedirect       = "https://wiki.example/callback"
+	testOIDCPublicRedirect = "http://127.0.0.1:9000/callback"
+)
+
+// useES256Keys makes a fresh ES256 key the active JWT key for the test
+func useES256Keys(t *testing.T) {
+	t.Helper()
+	keepJWTKeys(t)
+	t.Setenv("JWT_SIGNING_ALG", "ES256")
+	t.Setenv("JWT_PRIVATE_KEY_FILE", writePrivateKey(t, newECKey(t)))
+	if err := ReloadJWTKeys(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mountOIDCProvider serves the provider with a confidential and a public
+// client
+func (s *testServer) mountOIDCProvider() {
+	s.t.Helper()
+	clients, err := json.Marshal([]OIDCClient{
+		{ClientID: "wiki", ClientSecret: "wiki-secret", RedirectURIs: []string{testOIDCRedirect}},
+		{ClientID: "cli", RedirectURIs: []string{testOIDCPublicRedirect}},
+	})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	path := filepath.Join(s.t.TempDir(), "clients.json")
+	if err := os.WriteFile(path, clients, 0o600); err != nil {
+		s.t.Fatal(err)
+	}
+	s.t.Setenv("OIDC_CLIENTS_FILE", path)
+
+	provider, err := NewOIDCProvider(config.Load())
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.router.GET("/.well-known/openid-configuration", provider.Discovery)
+	s.router.GET("/authorize", provider.Authorize)
+	s.router.POST("/token", provider.Token)
+	s.router.GET("/userinfo", provider.UserInfo)
+}
+
+// sessionCookie logs username in with the password and returns the session
+// cookie
+func (s *testServer) sessionCookie(username string) *http.Cookie {
+	s.t.Helper()
+	w := s.do(request{method: http.MethodPost, path: "/api/session-auth/login", body: map[string]string{
+		"username": username,
+		"password": testPassword,
+	}})
+	expectStatus(s.t, w, http.StatusOK)
+	return cookie(w, "session_id")
+}
+
+// authorizationCode runs the authorization endpoint and returns the code
+func (s *testServer) authorizationCode(session *http.Cookie, params url.Values) string {
+	s.t.Helper()
+	w := s.do(request{method: http.MethodGet, path: "/authorize?" + params.Encode(), cookies: []*http.Cookie{session}})
+	expectStatus(s.t, w, http.StatusFound)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	code := location.Query().Get("code")
+	if code == "" {
+		s.t.Fatalf("authorization redirected to %s", location)
+	}
+	return code
+}
+
+// verifyWithJWKS checks token against the published keys, as a relying
+// party would
+func (s *testServer) verifyWithJWKS(token string, claims jwt.Claims) *jwt.Token {
+	s.t.Helper()
+	var set JWKSet
+	if err := json.Unmarshal(s.do(request{method: http.MethodGet, path: "/.well-known/jwks.json"}).Body.Bytes(), &set); err != nil {
+		s.t.Fatal(err)
+	}
+
+	parsed, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		for _, jwk := range set.Keys {
+			if jwk.Kid != token.Header["kid"] {
+				continue
+			}
+			x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+			return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+		}
+		return nil, jwt.ErrTokenUnverifiable
+	}, jwt.WithValidMethods([]string{"ES256"}))
+	if err != nil {
+		s.t.Fatalf("token does not verify against the JWKS: %v", err)
+	}
+	return parsed
+}
+
+func TestOIDCProviderCodeFlow(t *testing.T) {
+	useES256Keys(t)
+	s := newTestServer(t)
+	s.createUser("peggy", testPassword)
+	s.mountOIDCProvider()
+
+	discovery := decode(t, s.do(request{method: http.MethodGet, path: "/.well-known/openid-configuration"}))
+	if discovery["jwks_uri"] != "http://localhost:8080/.well-known/jwks.json" {
+		t.Errorf("jwks_uri = %v", discovery["jwks_uri"])
+	}
+	if algs, _ := discovery["id_token_signing_alg_values_supported"].([]any); len(algs) != 1 || algs[0] != "ES256" {
+		t.Errorf("signing algorithms = %v, want [ES256]", algs)
+	}
+
+	code := s.authorizationCode(s.sessionCookie("peggy"), url.Values{
+		"response_type": {"code"},
+		"client_id":     {"wiki"},
+		"redirect_uri":  {testOIDCRedirect},
+		"scope":         {"openid profile"},
+		"nonce":         {"n-0S6_WzA2Mj"},
+	})
+	exchange := request{
+		method: http.MethodPost,
+		path:   "/token",
+		form:   url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {testOIDCRedirect}},
+		header: http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("wiki:wiki-secret"))}},
+	}
+	w := s.do(exchange)
+	expectStatus(t, w, http.StatusOK)
+	tokens := decode(t, w)
+	idToken, _ := tokens["id_token"].(string)
+	accessToken, _ := tokens["access_token"].(string)
+
+	idClaims := &OIDCIDTokenClaims{}
+	parsed := s.verifyWithJWKS(idToken, idClaims)
+	if idClaims.Nonce != "n-0S6_WzA2Mj" || idClaims.PreferredUsername != "peggy" || len(idClaims.Audience) != 1 || idClaims.Audience[0] != "wiki" {
+		t.Errorf("ID token claims = %+v", idClaims)
+	}
+	if parsed.Header["typ"] != "JWT" {
+		t.Errorf("ID token typ = %v", parsed.Header["typ"])
+	}
+	if parsed = s.verifyWithJWKS(accessToken, &OIDCAccessTokenClaims{}); parsed.Header["typ"] != "at+jwt" {
+		t.Errorf("access token typ = %v", parsed.Header["typ"])
+	}
+
+	// Codes are single-use
+	expectStatus(t, s.do(exchange), http.StatusBadRequest)
+
+	w = s.do(request{method: http.MethodGet, path: "/userinfo", bearer: accessToken})
+	expectStatus(t, w, http.StatusOK)
+	if info := decode(t, w); info["preferred_username"] != "peggy" {
+		t.Errorf("userinfo = %v", info)
+	}
+
+	// Each token is only good where it was meant to be used
+	expectStatus(t, s.do(request{method: http.MethodGet, path: "/userinfo", bearer: idToken}), http.StatusUnauthorized)
+	expectStatus(t, s.do(request{method: http.MethodGet, path: "/api/jwt-auth/protected", bearer: accessToken}), http.StatusUnauthorized)
+	expectStatus(t, s.do(request{method: http.MethodGet, path: "/userinfo", bearer: s.accessToken("peggy")}), http.StatusUnauthorized)
+}
+
+func TestOIDCProviderPKCE(t *testing.T) {
+	useES256Keys(t)
+	s := newTestServer(t)
+	s.createUser("quinn", testPassword)
+	s.mountOIDCProvider()
+	session := s.sessionCookie("quinn")
+
+	verifier := "dBjftJeZ4CVP-mJ92K8cfk6zTYvlqDkPjF7LBnsPr9g"
+	sum := sha256.Sum256([]byte(verifier))
+	authorize := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"cli"},
+		"redirect_uri":          {testOIDCPublicRedirect},
+		"scope":                 {"openid"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+	exchange := func(code, verifier string) int {
+		return s.do(request{method: http.MethodPost, path: "/token", form: url.Values{
+			"grant_type":    {"authorization_code"},
+			"client_id":     {"cli"},
+			"code":          {code},
+			"redirect_uri":  {testOIDCPublicRedirect},
+			"code_verifier": {verifier},
+		}}).Code
+	}
+
+	if status := exchange(s.authorizationCode(session, authorize), strings.Repeat("x", 43)); status != http.StatusBadRequest {
+		t.Fatalf("wrong verifier: status %d, want 400", status)
+	}
+	if status := exchange(s.authorizationCode(session, authorize), verifier); status != http.StatusOK {
+		t.Fatalf("right verifier: status %d, want 200", status)
+	}
+}
+
+func TestOIDCProviderNeedsAsymmetricKey(t *testing.T) {
+	if _, err := NewOIDCProvider(config.Load()); err != errOIDCSymmetricKey {
+		t.Fatalf("NewOIDCProvider with an HS256 key: %v, want errOIDCSymmetricKey", err)
+	}
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// commonPasswords rejects the most common passwords that are long enough to
+// pass the length check
+var commonPasswords = map[string]bool{
+	"123456789012":     true,
+	"1234567890123":    true,
+	"12345678901234":   true,
+	"password1234":     true,
+	"password12345":    true,
+	"password123456":   true,
+	"passwordpassword": true,
+	"qwertyuiopasdf":   true,
+	"qwertyuiop123":    true,
+	"iloveyou1234":     true,
+	"adminadmin123":    true,
+	"letmeinletmein":   true,
+	"welcome12345":     true,
+	"changeme1234":     true,
+}
+
+// validatePassword enforces the password policy. The returned error message
+// is safe to show to the client.
+func validatePassword(password, username, email string, minLength int) error {
+	if utf8.RuneCountInString(password) < minLength {
+		return fmt.Errorf("Password must be at least %d characters", minLength)
+	}
+	if max := passwordHasher().MaxPasswordBytes(); len(password) > max {
+		return fmt.Errorf("Password must be at most %d bytes", max)
+	}
+
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return errors.New("Password is too common")
+	}
+	if username != "" && strings.Contains(lower, strings.ToLower(username)) {
+		return errors.New("Password must not contain the username")
+	}
+	if local := strings.SplitN(email, "@", 2)[0]; len(local) >= 3 && strings.Contains(lower, strings.ToLower(local)) {
+		return errors.New("Password must not contain the email address")
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/audit"
+	"github.com/NoorBnHossam/Authentication_Types/internal/config"
+	"github.com/NoorBnHossam/Authentication_Types/internal/mailer"
+	"github.com/NoorBnHossam/Authentication_Types/internal/middleware"
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"github.com/NoorBnHossam/Authentication_Types/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+const passwordResetKind = "password_reset"
+const passwordResetTTL = 30 * time.Minute
+
+// passwordReset is the state behind a reset token
+type passwordReset struct {
+	UserID string `bson:"user_id"`
+}
+
+// passwordResetThrottler limits reset token guesses to 10 per 15 minutes per
+// client address, then bans the address for an hour
+var passwordResetThrottler = middleware.NewThrottler(10, 15*time.Minute, time.Hour)
+
+const forgotPasswordMessage = "If the account exists, a password reset link has been sent"
+
+// ForgotPassword emails a reset link. The response is the same, and takes the
+// same time, whether or not the account exists.
+func ForgotPassword(c *gin.Context) {
+	var req models.ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	var user models.User
+	var err error
+	switch {
+	case strings.TrimSpace(req.Email) != "":
+		user, err = stores.Users.FindByEmail(c.Request.Context(), strings.ToLower(strings.TrimSpace(req.Email)))
+	case strings.TrimSpace(req.Username) != "":
+		user, err = stores.Users.FindByUsername(c.Request.Context(), strings.TrimSpace(req.Username))
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Username or email required"})
+		return
+	}
+
+	switch {
+	case err == nil && user.Email != "":
+		cfg := config.Load()
+		mailInBackground(c.Request.Context(), func(ctx context.Context) {
+			if err := sendPasswordResetEmail(ctx, cfg, user); err != nil {
+				log.Printf("[ForgotPassword] Error sending reset email to user %s: %v", user.Username, err)
+			}
+		})
+	case err != nil && err != store.ErrNotFound:
+		log.Printf("[ForgotPassword] Database error: %v", err)
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": forgotPasswordMessage})
+}
+
+// ResetPassword sets a new password using a reset token and signs the user
+// out everywhere
+func ResetPassword(c *gin.Context) {
+	if !passwordResetThrottler.AllowKey(c, c.ClientIP()) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts. Please try again later."})
+		return
+	}
+
+	var req models.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	// Look the token up without consuming it so a password that fails the
+	// policy does not burn the link
+	var reset passwordReset
+	if err := peekState(ctx, passwordResetKind, req.Token, &reset); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+
+	user, err := stores.Users.FindByID(ctx, reset.UserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+
+	if err := validatePassword(req.Password, user.Username, user.Email, config.Load().PasswordMinLength); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := takeState(ctx, passwordResetKind, req.Token, &reset); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+
+	hashedPassword, err := passwordHasher().Hash(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not reset password"})
+		return
+	}
+
+	err = stores.Users.SetPassword(ctx, reset.UserID, hashedPassword)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+	if err != nil {
+		log.Printf("[ResetPassword] Error updating password for user %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not reset password"})
+		return
+	}
+
+	if err := revokeUserCredentials(ctx, reset.UserID, "password_reset"); err != nil {
+		log.Printf("[ResetPassword] Error revoking credentials for user %s: %v", user.Username, err)
+	} else {
+		recordAudit(c, audit.Event{
+			Type:    audit.TokenRevoked,
+			Outcome: audit.Success,
+			Actor:   user.Username,
+			UserID:  reset.UserID,
+			Reason:  "password_reset",
+		})
+	}
+	// Any other outstanding links, MFA tickets and authorization codes for
+	// the account stop working
+	for _, kind := range []string{passwordResetKind, magicLinkKind, mfaTicketKind, oidcCodeKind} {
+		if err := dropUserStates(ctx, kind, reset.UserID); err != nil {
+			log.Printf("[ResetPassword] Error removing %s states for user %s: %v", kind, user.Username, err)
+		}
+	}
+
+	log.Printf("[ResetPassword] Password reset for user %s", user.Username)
+	c.JSON(http.StatusOK, gin.H{"message": "Password has been reset"})
+}
+
+// revokeUserCredentials ends every session, opaque token, refresh token
+// family and access token belonging to the user
+func revokeUserCredentials(ctx context.Context, userID, reason string) error {
+	if err := stores.Sessions.InvalidateUser(ctx, userID); err != nil {
+		return err
+	}
+	if err := stores.Tokens.DeleteUser(ctx, userID); err != nil {
+		return err
+	}
+	if err := stores.RefreshFamilies.RevokeUser(ctx, userID, reason); err != nil {
+		return err
+	}
+	return revokeUserTokens(ctx, userID)
+}
+
+func sendPasswordResetEmail(ctx context.Context, cfg *config.Config, user models.User) error {
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	err = saveUserState(ctx, passwordResetKind, token, user.ID.Hex(), passwordReset{UserID: user.ID.Hex()}, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	link := cfg.PasswordResetURL + "?token=" + url.QueryEscape(token)
+	return outbox().Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nReset your password by opening this link within %s:\n\n%s\n\nIf you did not ask for a password reset, ignore this email.",
+			user.Username, passwordResetTTL, link),
+	})
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPasswordReset(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.createUser("alice", testPassword)
+	access := s.accessToken("alice")
+	secret := s.enableMFA(alice)
+	ticket := s.mfaTicketFor("alice")
+
+	w := s.do(request{method: http.MethodPost, path: "/api/magic-link", body: map[string]string{"email": "alice@example.com"}})
+	expectStatus(t, w, http.StatusAccepted)
+	browser := []*http.Cookie{cookie(w, magicLinkCookie)}
+	magicLink := "/api/magic-link/verify?token=" + url.QueryEscape(testMail.lastToken(t, "alice@example.com"))
+
+	unknown := s.do(request{method: http.MethodPost, path: "/api/password/forgot", body: map[string]string{"email": "nobody@example.com"}})
+	expectStatus(t, unknown, http.StatusAccepted)
+	w = s.do(request{method: http.MethodPost, path: "/api/password/forgot", body: map[string]string{"email": "alice@example.com"}})
+	expectStatus(t, w, http.StatusAccepted)
+	if w.Body.String() != unknown.Body.String() {
+		t.Errorf("known address answered %s, unknown %s", w.Body, unknown.Body)
+	}
+	reset := request{method: http.MethodPost, path: "/api/password/reset", body: map[string]string{
+		"token":    testMail.lastToken(t, "alice@example.com"),
+		"password": "quince-harbour-thistle-7",
+	}}
+	expectStatus(t, s.do(reset), http.StatusOK)
+	expectStatus(t, s.do(reset), http.StatusBadRequest)
+
+	// Everything issued before the reset is dead
+	expectStatus(t, s.do(request{method: http.MethodGet, path: "/api/jwt-auth/protected", bearer: access}), http.StatusUnauthorized)
+	expectStatus(t, s.verifyMFA(ticket, totpCode(t, secret)), http.StatusUnauthorized)
+	expectStatus(t, s.do(request{method: http.MethodGet, path: magicLink, cookies: browser}), http.StatusBadRequest)
+
+	// Tokens issued in the same second as the reset count as older, so log
+	// in again from the next one
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	w = s.do(request{method: http.MethodPost, path: "/api/jwt-auth/login", body: map[string]string{
+		"username": "alice",
+		"password": "quince-harbour-thistle-7",
+	}})
+	expectStatus(t, w, http.StatusOK)
+	ticket, _ = decode(t, w)["mfa_ticket"].(string)
+	w = s.verifyMFA(ticket, totpCode(t, secret))
+	expectStatus(t, w, http.StatusOK)
+	access, _ = decode(t, w)["access_token"].(string)
+	expectStatus(t, s.do(request{method: http.MethodGet, path: "/api/jwt-auth/protected", bearer: access}), http.StatusOK)
+}
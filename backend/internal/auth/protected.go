@@ -21,10 +21,12 @@ func ProtectedRoute(c *gin.Context) {
 	}
 
 	session, _ := c.Get("session")
+	principal, _ := CurrentPrincipal(c)
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Access granted",
-		"user":    userModel.ToResponse(),
-		"session": session,
+		"message":     "Access granted",
+		"user":        userModel.ToResponse(),
+		"session":     session,
+		"auth_method": principal.Method,
 	})
 }
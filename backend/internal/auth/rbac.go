@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PermissionManageKeys guards the JWT key ring admin endpoints
+const PermissionManageKeys = "keys:manage"
+
+// PermissionManageUsers guards the account admin endpoints, such as unlocking
+// accounts locked by failed logins
+const PermissionManageUsers = "users:manage"
+
+// defaultRolePermissions applies until LoadRolePermissions is called. A
+// permission ending in "*" grants everything with that prefix.
+var defaultRolePermissions = map[string][]string{
+	"admin": {"*"},
+	"user":  {},
+}
+
+var (
+	rolePermissionsMu sync.RWMutex
+	rolePermissions   = defaultRolePermissions
+)
+
+// LoadRolePermissions replaces the role to permission mapping with the JSON
+// object in path, e.g. {"admin": ["*"], "support": ["users:read"]}
+func LoadRolePermissions(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var mapping map[string][]string
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	rolePermissionsMu.Lock()
+	rolePermissions = mapping
+	rolePermissionsMu.Unlock()
+	return nil
+}
+
+// roleHasPermission reports whether role grants permission
+func roleHasPermission(role, permission string) bool {
+	rolePermissionsMu.RLock()
+	defer rolePermissionsMu.RUnlock()
+
+	for _, granted := range rolePermissions[role] {
+		if granted == permission {
+			return true
+		}
+		if strings.HasSuffix(granted, "*") && strings.HasPrefix(permission, strings.TrimSuffix(granted, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireRole allows users whose role is one of roles. It must run after one
+// of the authentication middlewares.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := contextUser(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			c.Abort()
+			return
+		}
+
+		for _, role := range roles {
+			if user.Role == role {
+				c.Next()
+				return
+			}
+		}
+		forbidden(c)
+	}
+}
+
+// RequirePermission allows users whose role grants all of permissions. It
+// must run after one of the authentication middlewares.
+func RequirePermission(permissions ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := contextUser(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			c.Abort()
+			return
+		}
+
+		for _, permission := range permissions {
+			if !roleHasPermission(user.Role, permission) {
+				forbidden(c)
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// forbidden is the response for every authorization failure. It does not say
+// which role or permission was missing.
+func forbidden(c *gin.Context) {
+	c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+	c.Abort()
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+// useRoleFile loads roles as the role to permission mapping for the test
+func useRoleFile(t *testing.T, roles string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "roles.json")
+	if err := os.WriteFile(path, []byte(roles), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		rolePermissionsMu.Lock()
+		rolePermissions = defaultRolePermissions
+		rolePermissionsMu.Unlock()
+	})
+	if err := LoadRolePermissions(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// guarded serves guard behind a fake authentication middleware that signs
+// in a user with role, or nobody if role is nil
+func guarded(guard gin.HandlerFunc, role *string) *httptest.ResponseRecorder {
+	router := gin.New()
+	router.GET("/", func(c *gin.Context) {
+		if role != nil {
+			c.Set("user", models.User{Username: "alice", Role: *role})
+		}
+	}, guard, func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	return w
+}
+
+func TestRequirePermission(t *testing.T) {
+	useRoleFile(t, `{
+		"admin":   ["*"],
+		"support": ["users:*"],
+		"auditor": ["users:read", "keys:read"],
+		"nobody":  []
+	}`)
+
+	role := func(name string) *string { return &name }
+	cases := []struct {
+		name        string
+		role        *string
+		permissions []string
+		want        int
+	}{
+		{"wildcard grants everything", role("admin"), []string{PermissionManageKeys, PermissionManageUsers}, http.StatusNoContent},
+		{"prefix wildcard", role("support"), []string{"users:read", PermissionManageUsers}, http.StatusNoContent},
+		{"prefix wildcard stops at the prefix", role("support"), []string{PermissionManageKeys}, http.StatusForbidden},
+		{"prefix wildcard matches whole segments", role("support"), []string{"usersettings:write"}, http.StatusForbidden},
+		{"exact permission", role("auditor"), []string{"users:read"}, http.StatusNoContent},
+		{"missing permission", role("auditor"), []string{PermissionManageUsers}, http.StatusForbidden},
+		{"every permission is required", role("auditor"), []string{"users:read", PermissionManageKeys}, http.StatusForbidden},
+		{"role without permissions", role("nobody"), []string{"users:read"}, http.StatusForbidden},
+		{"unknown role", role("ghost"), []string{"users:read"}, http.StatusForbidden},
+		{"no role", role(""), []string{"users:read"}, http.StatusForbidden},
+		{"not signed in", nil, []string{"users:read"}, http.StatusUnauthorized},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := guarded(RequirePermission(tt.permissions...), tt.role)
+			expectStatus(t, w, tt.want)
+			if tt.want == http.StatusForbidden {
+				// The response does not say which permission was missing
+				if body := w.Body.String(); body != `{"error":"Insufficient permissions"}` {
+					t.Errorf("403 body = %s", body)
+				}
+			}
+		})
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	role := func(name string) *string { return &name }
+	cases := []struct {
+		name string
+		role *string
+		want int
+	}{
+		{"listed role", role("support"), http.StatusNoContent},
+		{"other role", role("user"), http.StatusForbidden},
+		{"not signed in", nil, http.StatusUnauthorized},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			expectStatus(t, guarded(RequireRole("admin", "support"), tt.role), tt.want)
+		})
+	}
+}
+
+func TestLoadRolePermissions(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		if !roleHasPermission("admin", PermissionManageKeys) || roleHasPermission("user", PermissionManageKeys) {
+			t.Fatal("default mapping should grant admin everything and user nothing")
+		}
+	})
+
+	t.Run("replaces the mapping", func(t *testing.T) {
+		useRoleFile(t, `{"operator": ["keys:*"]}`)
+		if !roleHasPermission("operator", PermissionManageKeys) {
+			t.Error("loaded role lacks its permission")
+		}
+		if roleHasPermission("admin", PermissionManageKeys) {
+			t.Error("default roles survived loading a file without them")
+		}
+	})
+
+	t.Run("bad files keep the mapping", func(t *testing.T) {
+		useRoleFile(t, `{"operator": ["keys:*"]}`)
+		invalid := filepath.Join(t.TempDir(), "invalid.json")
+		if err := os.WriteFile(invalid, []byte(`{"operator": "keys:*"}`), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range []string{invalid, filepath.Join(t.TempDir(), "missing.json")} {
+			if err := LoadRolePermissions(path); err == nil {
+				t.Errorf("LoadRolePermissions(%s) succeeded", filepath.Base(path))
+			}
+		}
+		if !roleHasPermission("operator", PermissionManageKeys) {
+			t.Error("a failed load replaced the mapping")
+		}
+	})
+}
@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/config"
+	"github.com/NoorBnHossam/Authentication_Types/internal/mailer"
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"github.com/NoorBnHossam/Authentication_Types/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+const emailVerificationKind = "email_verification"
+const emailVerificationTTL = 24 * time.Hour
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// errEmailNotVerified is returned for logins to unverified accounts when
+// REQUIRE_EMAIL_VERIFICATION is set
+var errEmailNotVerified = errors.New("Email address not verified")
+
+// emailVerification is the state behind a verification link
+type emailVerification struct {
+	UserID string `bson:"user_id"`
+	Email  string `bson:"email"`
+}
+
+var (
+	mailerOnce sync.Once
+	appMailer  mailer.Mailer
+)
+
+// outbox returns the configured mailer
+func outbox() mailer.Mailer {
+	mailerOnce.Do(func() {
+		appMailer = mailer.New(config.Load())
+	})
+	return appMailer
+}
+
+// mailTimeout bounds a mail sent after the response has gone out
+const mailTimeout = 30 * time.Second
+
+// pendingMail tracks the mails sent in the background
+var pendingMail sync.WaitGroup
+
+// mailInBackground runs send after the handler has answered, so handlers that
+// must not reveal whether an account exists take the same time either way.
+// send gets the request's context values but not its cancellation.
+func mailInBackground(ctx context.Context, send func(ctx context.Context)) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), mailTimeout)
+	pendingMail.Add(1)
+	go func() {
+		defer pendingMail.Done()
+		defer cancel()
+		send(ctx)
+	}()
+}
+
+// checkLoginAllowed applies account checks that run after the credentials
+// have been verified
+func checkLoginAllowed(user models.User) error {
+	if !user.EmailVerified && config.Load().RequireEmailVerification {
+		return errEmailNotVerified
+	}
+	return nil
+}
+
+// RegisterUser creates an unverified user and emails a verification link
+func RegisterUser(c *gin.Context) {
+	var req models.RegisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	req.Username = strings.TrimSpace(req.Username)
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	if !usernamePattern.MatchString(req.Username) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Username may only contain letters, digits, '.', '_' and '-'"})
+		return
+	}
+
+	cfg := config.Load()
+	if err := validatePassword(req.Password, req.Username, req.Email, cfg.PasswordMinLength); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err := stores.Users.FindByUsername(c.Request.Context(), req.Username)
+	if err == store.ErrNotFound {
+		_, err = stores.Users.FindByEmail(c.Request.Context(), req.Email)
+	}
+	if err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username or email already registered"})
+		return
+	}
+	if err != store.ErrNotFound {
+		log.Printf("[RegisterUser] Database error checking for existing user %s: %v", req.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create user"})
+		return
+	}
+
+	hashedPassword, err := passwordHasher().Hash(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create user"})
+		return
+	}
+
+	now := time.Now()
+	user := models.User{
+		Username:      req.Username,
+		Password:      hashedPassword,
+		Email:         req.Email,
+		Role:          "user",
+		EmailVerified: false,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := stores.Users.Create(c.Request.Context(), &user); err != nil {
+		// The unique username index catches registrations racing each other
+		if err == store.ErrDuplicate {
+			c.JSON(http.StatusConflict, gin.H{"error": "Username or email already registered"})
+			return
+		}
+		log.Printf("[RegisterUser] Error inserting user %s: %v", req.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create user"})
+		return
+	}
+
+	if err := sendVerificationEmail(c.Request.Context(), cfg, user); err != nil {
+		// The account exists; the user can ask for a new link
+		log.Printf("[RegisterUser] Error sending verification email to user %s: %v", user.Username, err)
+	}
+
+	log.Printf("[RegisterUser] Registered user %s", user.Username)
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Registration successful. Check your email to verify your account.",
+		"user":    user.ToResponse(),
+	})
+}
+
+// VerifyEmail redeems a verification link. Tokens are single-use.
+func VerifyEmail(c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Verification token required"})
+		return
+	}
+
+	var verification emailVerification
+	if err := takeState(c.Request.Context(), emailVerificationKind, token, &verification); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification token"})
+		return
+	}
+
+	// Only verify the address the link was sent to
+	err := stores.Users.SetEmailVerified(c.Request.Context(), verification.UserID, verification.Email)
+	if err == store.ErrNotFound {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification token"})
+		return
+	}
+	if err != nil {
+		log.Printf("[VerifyEmail] Error verifying user %s: %v", verification.UserID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not verify email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified"})
+}
+
+// ResendVerification sends a new verification link. The response is the same
+// whether or not the address belongs to an unverified account.
+func ResendVerification(c *gin.Context) {
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	user, err := stores.Users.FindByEmail(c.Request.Context(), strings.ToLower(strings.TrimSpace(req.Email)))
+	if err == nil && !user.EmailVerified {
+		if err := sendVerificationEmail(c.Request.Context(), config.Load(), user); err != nil {
+			log.Printf("[ResendVerification] Error sending verification email to user %s: %v", user.Username, err)
+		}
+	} else if err != nil && err != store.ErrNotFound {
+		log.Printf("[ResendVerification] Database error: %v", err)
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "If the address needs verification, a new link has been sent"})
+}
+
+func sendVerificationEmail(ctx context.Context, cfg *config.Config, user models.User) error {
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	err = saveState(ctx, emailVerificationKind, token, emailVerification{
+		UserID: user.ID.Hex(),
+		Email:  user.Email,
+	}, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	link := cfg.BaseURL + "/api/users/verify?token=" + url.QueryEscape(token)
+	return outbox().Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nConfirm your email address by opening this link within %s:\n\n%s\n\nIf you did not create an account, ignore this email.",
+			user.Username, emailVerificationTTL, link),
+	})
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	registryMu sync.RWMutex
+	registry   []Authenticator
+)
+
+// Register makes an authenticator available to Authenticate and, if it is a
+// RouteProvider, to MountRoutes. It panics if the name is already taken, so
+// call it from an init function or before building the router.
+func Register(authenticator Authenticator) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if authenticator == nil {
+		panic("auth: Register authenticator is nil")
+	}
+	for _, existing := range registry {
+		if existing.Name() == authenticator.Name() {
+			panic(fmt.Sprintf("auth: Register called twice for authenticator %q", authenticator.Name()))
+		}
+	}
+	registry = append(registry, authenticator)
+}
+
+// Lookup returns the registered authenticator with the given name
+func Lookup(name string) (Authenticator, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	for _, authenticator := range registry {
+		if authenticator.Name() == name {
+			return authenticator, true
+		}
+	}
+	return nil, false
+}
+
+// Authenticators returns the registered authenticators in registration order
+func Authenticators() []Authenticator {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	return append([]Authenticator(nil), registry...)
+}
+
+// MountRoutes registers the routes of every registered RouteProvider
+func MountRoutes(r gin.IRouter) {
+	for _, authenticator := range Authenticators() {
+		if provider, ok := authenticator.(RouteProvider); ok {
+			provider.RegisterRoutes(r)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"context"
+	"time"
+)
+
+// revokeClaims revokes the token the claims belong to. Tokens issued before
+// JWT IDs were introduced have no jti and simply run out.
+func revokeClaims(ctx context.Context, claims *JWTClaims) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+	return stores.Revocations.Revoke(ctx, claims.ID, claims.ExpiresAt.Time)
+}
+
+// revokeUserTokens revokes every JWT issued to the user so far. The cutoff is
+// kept for as long as the longest lived token could still be valid.
+func revokeUserTokens(ctx context.Context, userID string) error {
+	now := time.Now()
+	return stores.Revocations.RevokeUser(ctx, userID, now, now.Add(refreshTokenTTL))
+}
+
+// isClaimsRevoked reports whether the token the claims belong to was revoked,
+// on its own or along with every other token issued to the user before a
+// cutoff
+func isClaimsRevoked(ctx context.Context, claims *JWTClaims) (bool, error) {
+	if claims.ID != "" {
+		revoked, err := stores.Revocations.IsRevoked(ctx, claims.ID)
+		if err != nil || revoked {
+			return revoked, err
+		}
+	}
+
+	before, err := stores.Revocations.RevokedBefore(ctx, claims.UserID)
+	if err != nil || before.IsZero() {
+		return false, err
+	}
+	// iat has whole seconds, so a token issued in the same second as the
+	// cutoff counts as issued before it
+	if claims.IssuedAt == nil {
+		return true, nil
+	}
+	return !claims.IssuedAt.Time.After(before.Truncate(time.Second)), nil
+}
@@ -0,0 +1,363 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/config"
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"github.com/NoorBnHossam/Authentication_Types/internal/store"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/gin-gonic/gin"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const samlRequestKind = "saml_request"
+const samlRequestTTL = 10 * time.Minute
+
+// samlRelayCookie holds a hash of the relay state, binding the login to the
+// browser that started it
+const samlRelayCookie = "saml_relay"
+
+// samlRequest tracks an AuthnRequest until its Response arrives
+type samlRequest struct {
+	RequestID string    `bson:"request_id"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+// Attribute names commonly used by IdPs for email
+var samlEmailAttributes = []string{
+	"email",
+	"mail",
+	"urn:oid:0.9.2342.19200300.100.1.3",
+	"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+}
+
+var (
+	samlSPOnce sync.Once
+	samlSP     *saml.ServiceProvider
+	samlSPErr  error
+)
+
+// serviceProvider builds the SAML service provider from configuration on
+// first use
+func serviceProvider(cfg *config.Config) (*saml.ServiceProvider, error) {
+	samlSPOnce.Do(func() {
+		samlSP, samlSPErr = newServiceProvider(cfg)
+		if samlSPErr != nil {
+			log.Printf("[SSO] SAML service provider is unavailable: %v", samlSPErr)
+		}
+	})
+	return samlSP, samlSPErr
+}
+
+func newServiceProvider(cfg *config.Config) (*saml.ServiceProvider, error) {
+	if cfg.SAMLIdPMetadataFile == "" {
+		return nil, errors.New("SAML_IDP_METADATA_FILE is not set")
+	}
+
+	data, err := os.ReadFile(cfg.SAMLIdPMetadataFile)
+	if err != nil {
+		return nil, err
+	}
+	idpMetadata, err := samlsp.ParseMetadata(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing IdP metadata: %w", err)
+	}
+
+	metadataURL, err := url.Parse(cfg.SAMLMetadataURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SAML_SP_METADATA_URL: %w", err)
+	}
+	acsURL, err := url.Parse(cfg.SAMLACSURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SAML_SP_ACS_URL: %w", err)
+	}
+
+	sp := &saml.ServiceProvider{
+		EntityID:          cfg.SAMLEntityID,
+		MetadataURL:       *metadataURL,
+		AcsURL:            *acsURL,
+		IDPMetadata:       idpMetadata,
+		AuthnNameIDFormat: saml.UnspecifiedNameIDFormat,
+	}
+
+	// AuthnRequests are signed when the SP has its own key pair
+	if cfg.SAMLKeyFile != "" && cfg.SAMLCertFile != "" {
+		sp.Key, err = loadRSAPrivateKey(cfg.SAMLKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		sp.Certificate, err = loadCertificate(cfg.SAMLCertFile)
+		if err != nil {
+			return nil, err
+		}
+		sp.SignatureMethod = dsig.RSASHA256SignatureMethod
+	}
+
+	return sp, nil
+}
+
+func loadCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// SSOLogin starts SP-initiated SAML login, sending an AuthnRequest to the IdP
+// with the HTTP-Redirect or HTTP-POST binding.
+func SSOLogin(c *gin.Context) {
+	cfg := config.Load()
+	sp, err := serviceProvider(cfg)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "SSO is not configured"})
+		return
+	}
+
+	binding := saml.HTTPRedirectBinding
+	if cfg.SAMLBinding == "post" {
+		binding = saml.HTTPPostBinding
+	}
+	idpURL := sp.GetSSOBindingLocation(binding)
+	if idpURL == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "IdP does not support the configured SAML binding"})
+		return
+	}
+
+	req, err := sp.MakeAuthenticationRequest(idpURL, binding, saml.HTTPPostBinding)
+	if err != nil {
+		log.Printf("[SSOLogin] Error creating AuthnRequest: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start SSO"})
+		return
+	}
+
+	relayState, err := randomURLString(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start SSO"})
+		return
+	}
+	err = saveState(c.Request.Context(), samlRequestKind, relayState, samlRequest{
+		RequestID: req.ID,
+		CreatedAt: time.Now(),
+	}, samlRequestTTL)
+	if err != nil {
+		log.Printf("[SSOLogin] Error storing request: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start SSO"})
+		return
+	}
+
+	// Bind the relay state to this browser so a response for another
+	// account cannot be posted from the victim's browser (login CSRF). The
+	// IdP posts back cross-site, so the cookie must be SameSite=None.
+	c.SetSameSite(http.SameSiteNoneMode)
+	c.SetCookie(samlRelayCookie, hashNonce(relayState), int(samlRequestTTL.Seconds()), "/api/sso", "", true, true)
+
+	if binding == saml.HTTPPostBinding {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", req.Post(relayState))
+		return
+	}
+
+	redirectURL, err := req.Redirect(relayState, sp)
+	if err != nil {
+		log.Printf("[SSOLogin] Error encoding AuthnRequest: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start SSO"})
+		return
+	}
+	c.Redirect(http.StatusFound, redirectURL.String())
+}
+
+// SSOCallback is the assertion consumer service. It validates the IdP
+// Response (signature, audience, time window, InResponseTo) and opens a
+// session for the matching user.
+func SSOCallback(c *gin.Context) {
+	cfg := config.Load()
+	sp, err := serviceProvider(cfg)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "SSO is not configured"})
+		return
+	}
+
+	relayState := c.PostForm("RelayState")
+	encodedResponse := c.PostForm("SAMLResponse")
+	if relayState == "" || encodedResponse == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing SAMLResponse or RelayState"})
+		return
+	}
+
+	relayCookie, err := c.Cookie(samlRelayCookie)
+	c.SetSameSite(http.SameSiteNoneMode)
+	c.SetCookie(samlRelayCookie, "", -1, "/api/sso", "", true, true)
+	if err != nil || subtle.ConstantTimeCompare([]byte(relayCookie), []byte(hashNonce(relayState))) != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown or expired SSO request"})
+		return
+	}
+
+	// IdP-initiated logins are not accepted: the response must answer a
+	// request this service made
+	var request samlRequest
+	if err := takeState(c.Request.Context(), samlRequestKind, relayState, &request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown or expired SSO request"})
+		return
+	}
+
+	rawResponse, err := base64.StdEncoding.DecodeString(encodedResponse)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SAMLResponse encoding"})
+		return
+	}
+
+	assertion, err := sp.ParseXMLResponse(rawResponse, []string{request.RequestID})
+	if err != nil {
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) {
+			log.Printf("[SSOCallback] Rejected SAML response: %v", invalid.PrivateErr)
+		} else {
+			log.Printf("[SSOCallback] Rejected SAML response: %v", err)
+		}
+		auditLoginFailure(c, "", "saml", "invalid_response")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid SAML response"})
+		return
+	}
+
+	user, err := findSAMLUser(c.Request.Context(), assertion)
+	if err != nil {
+		log.Printf("[SSOCallback] No user for SAML subject: %v", err)
+		auditLoginFailure(c, samlNameID(assertion), "saml", "no_matching_user")
+		c.JSON(http.StatusForbidden, gin.H{"error": "No account matches this identity"})
+		return
+	}
+
+	if _, err := createSession(c, user, "saml"); err != nil {
+		log.Printf("[SSOCallback] Error creating session for user %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create session"})
+		return
+	}
+
+	log.Printf("[SSOCallback] Successful login for user %s", user.Username)
+	auditLoginSuccess(c, user, "saml")
+	if cfg.SAMLPostLoginRedirect != "" {
+		c.Redirect(http.StatusFound, cfg.SAMLPostLoginRedirect)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Login successful",
+		"user":    user.ToResponse(),
+	})
+}
+
+// SSOMetadata serves the service provider metadata for registration with
+// the IdP
+func SSOMetadata(c *gin.Context) {
+	sp, err := serviceProvider(config.Load())
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "SSO is not configured"})
+		return
+	}
+
+	metadata, err := xml.MarshalIndent(sp.Metadata(), "", "  ")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not render metadata"})
+		return
+	}
+	c.Data(http.StatusOK, "application/samlmetadata+xml", metadata)
+}
+
+// SSOMiddleware accepts sessions that were created by SSOCallback
+func SSOMiddleware() gin.HandlerFunc {
+	return Authenticate("saml")
+}
+
+// samlNameID returns the asserted NameID, or "" if there is none
+func samlNameID(assertion *saml.Assertion) string {
+	if assertion.Subject == nil || assertion.Subject.NameID == nil {
+		return ""
+	}
+	return strings.TrimSpace(assertion.Subject.NameID.Value)
+}
+
+// findSAMLUser resolves the asserted subject to a user. A subject that was
+// linked to a user before logs in to that user. Otherwise the IdP asserted
+// email must belong to a user who has verified it, so an account registered
+// with someone else's address never receives their SSO logins; a persistent
+// NameID is then linked to that user.
+func findSAMLUser(ctx context.Context, assertion *saml.Assertion) (models.User, error) {
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || strings.TrimSpace(assertion.Subject.NameID.Value) == "" {
+		return models.User{}, errors.New("assertion has no NameID")
+	}
+	nameID := assertion.Subject.NameID
+	identity := models.Identity{
+		Provider: "saml:" + assertion.Issuer.Value,
+		Subject:  strings.TrimSpace(nameID.Value),
+	}
+	// Transient NameIDs change with every login, so there is nothing to link
+	linkable := nameID.Format != string(saml.TransientNameIDFormat)
+
+	if linkable {
+		user, err := stores.Users.FindByIdentity(ctx, identity.Provider, identity.Subject)
+		if err == nil {
+			return user, nil
+		}
+		if err != store.ErrNotFound {
+			return models.User{}, err
+		}
+	}
+
+	email := samlAttribute(assertion, samlEmailAttributes)
+	if email == "" && strings.Contains(identity.Subject, "@") {
+		email = identity.Subject
+	}
+	email = strings.ToLower(email)
+	if email == "" {
+		return models.User{}, fmt.Errorf("subject %q is not linked and has no email", identity.Subject)
+	}
+
+	user, err := stores.Users.FindByEmail(ctx, email)
+	if err != nil {
+		return models.User{}, fmt.Errorf("no user with email %q: %w", email, err)
+	}
+	if !user.EmailVerified {
+		return models.User{}, fmt.Errorf("user %s has not verified email %q", user.Username, email)
+	}
+
+	if linkable {
+		if err := stores.Users.AddIdentity(ctx, user.ID.Hex(), identity); err != nil {
+			return models.User{}, err
+		}
+		user.Identities = append(user.Identities, identity)
+		log.Printf("[SSOCallback] Linked %s/%s to user %s by verified email", identity.Provider, identity.Subject, user.Username)
+	}
+	return user, nil
+}
+
+func samlAttribute(assertion *saml.Assertion, names []string) string {
+	for _, statement := range assertion.AttributeStatements {
+		for _, attr := range statement.Attributes {
+			for _, name := range names {
+				if (attr.Name == name || attr.FriendlyName == name) && len(attr.Values) > 0 {
+					return strings.TrimSpace(attr.Values[0].Value)
+				}
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+)
+
+// newTestIdP returns an identity provider with a freshly generated key and
+// self-signed certificate
+func newTestIdP(t *testing.T, entityID string) *saml.IdentityProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test idp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadataURL, _ := url.Parse(entityID)
+	ssoURL, _ := url.Parse(entityID + "/sso")
+	return &saml.IdentityProvider{
+		Key:         key,
+		Certificate: cert,
+		MetadataURL: *metadataURL,
+		SSOURL:      *ssoURL,
+	}
+}
+
+var (
+	testIdPOnce sync.Once
+	testIdP     *saml.IdentityProvider
+)
+
+// useTestIdP configures the service provider to trust a test IdP, once for
+// all tests as the service provider is built only once
+func useTestIdP(t *testing.T) *saml.IdentityProvider {
+	testIdPOnce.Do(func() {
+		testIdP = newTestIdP(t, "https://idp.test")
+		metadataURL, _ := url.Parse("https://sp.test/api/sso/metadata")
+		acsURL, _ := url.Parse("https://sp.test/api/sso/callback")
+		samlSPOnce.Do(func() {
+			samlSP = &saml.ServiceProvider{
+				EntityID:          "https://sp.test",
+				MetadataURL:       *metadataURL,
+				AcsURL:            *acsURL,
+				IDPMetadata:       testIdP.Metadata(),
+				AuthnNameIDFormat: saml.UnspecifiedNameIDFormat,
+			}
+		})
+	})
+	return testIdP
+}
+
+// samlLogin starts an SSO login, has idp answer it for session and posts the
+// signed response to the assertion consumer service
+func samlLogin(t *testing.T, s *testServer, idp *saml.IdentityProvider, session *saml.Session) *httptest.ResponseRecorder {
+	t.Helper()
+	form, browser := samlResponse(t, s, idp, session)
+	return s.do(request{method: http.MethodPost, path: "/api/sso/callback", form: form, cookies: []*http.Cookie{browser}})
+}
+
+// samlResponse starts an SSO login and has idp answer it for session. It
+// returns the form the IdP would post and the cookie binding the login to
+// the browser that started it.
+func samlResponse(t *testing.T, s *testServer, idp *saml.IdentityProvider, session *saml.Session) (url.Values, *http.Cookie) {
+	t.Helper()
+	w := s.do(request{method: http.MethodGet, path: "/api/sso/login"})
+	expectStatus(t, w, http.StatusFound)
+	browser := cookie(w, samlRelayCookie)
+	if browser == nil || !browser.HttpOnly || !browser.Secure || browser.SameSite != http.SameSiteNoneMode {
+		t.Fatalf("relay state cookie = %+v, want HttpOnly, Secure and SameSite=None", browser)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authnRequest := decodeAuthnRequest(t, location.Query().Get("SAMLRequest"))
+
+	spMetadata := samlSP.Metadata()
+	req := &saml.IdpAuthnRequest{
+		IDP:                     idp,
+		HTTPRequest:             httptest.NewRequest(http.MethodGet, location.String(), nil),
+		Request:                 authnRequest,
+		ServiceProviderMetadata: spMetadata,
+		SPSSODescriptor:         &spMetadata.SPSSODescriptors[0],
+		ACSEndpoint:             &saml.IndexedEndpoint{Binding: saml.HTTPPostBinding, Location: samlSP.AcsURL.String()},
+		Now:                     time.Now(),
+	}
+	if err := (saml.DefaultAssertionMaker{}).MakeAssertion(req, session); err != nil {
+		t.Fatal(err)
+	}
+	if err := req.MakeResponse(); err != nil {
+		t.Fatal(err)
+	}
+	doc := etree.NewDocument()
+	doc.SetRoot(req.ResponseEl)
+	response, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return url.Values{
+		"SAMLResponse": {base64.StdEncoding.EncodeToString(response)},
+		"RelayState":   {location.Query().Get("RelayState")},
+	}, browser
+}
+
+// decodeAuthnRequest reads an AuthnRequest sent with the HTTP-Redirect binding
+func decodeAuthnRequest(t *testing.T, encoded string) saml.AuthnRequest {
+	t.Helper()
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var request saml.AuthnRequest
+	if err := xml.Unmarshal(data, &request); err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+// samlSession is an IdP session asserting email
+func samlSession(nameID, format, email string) *saml.Session {
+	return &saml.Session{
+		ID:           "idp-session",
+		CreateTime:   time.Now(),
+		NameID:       nameID,
+		NameIDFormat: format,
+		CustomAttributes: []saml.Attribute{{
+			Name:   "email",
+			Values: []saml.AttributeValue{{Type: "xs:string", Value: email}},
+		}},
+	}
+}
+
+func TestSAMLLogin(t *testing.T) {
+	idp := useTestIdP(t)
+	persistent := string(saml.PersistentNameIDFormat)
+	identityProvider := "saml:" + idp.Metadata().EntityID
+
+	t.Run("verified email links the NameID", func(t *testing.T) {
+		s := newTestServer(t)
+		erin := s.createUser("erin", testPassword)
+
+		w := samlLogin(t, s, idp, samlSession("erin-id", persistent, "Erin@example.com"))
+		expectStatus(t, w, http.StatusOK)
+		session := cookie(w, "session_id")
+		expectStatus(t, s.do(request{method: http.MethodGet, path: "/api/sso/protected", cookies: []*http.Cookie{session}}), http.StatusOK)
+
+		linked, err := s.stores.Users.FindByIdentity(context.Background(), identityProvider, "erin-id")
+		if err != nil || linked.ID != erin.ID {
+			t.Fatalf("NameID linked to %+v, %v; want erin", linked, err)
+		}
+
+		// Later logins follow the link, not the email
+		w = samlLogin(t, s, idp, samlSession("erin-id", persistent, "erin@new-domain.example"))
+		expectStatus(t, w, http.StatusOK)
+	})
+
+	t.Run("unverified email", func(t *testing.T) {
+		s := newTestServer(t)
+		s.createUnverifiedUser("frank", testPassword)
+
+		w := samlLogin(t, s, idp, samlSession("frank-id", persistent, "frank@example.com"))
+		expectStatus(t, w, http.StatusForbidden)
+		if _, err := s.stores.Users.FindByIdentity(context.Background(), identityProvider, "frank-id"); err == nil {
+			t.Error("NameID was linked to an unverified account")
+		}
+	})
+
+	t.Run("no username fallback", func(t *testing.T) {
+		s := newTestServer(t)
+		s.createUser("grace", testPassword)
+
+		session := samlSession("grace", persistent, "someone-else@example.com")
+		session.UserName = "grace"
+		expectStatus(t, samlLogin(t, s, idp, session), http.StatusForbidden)
+	})
+
+	t.Run("transient NameID", func(t *testing.T) {
+		s := newTestServer(t)
+		s.createUser("heidi", testPassword)
+
+		w := samlLogin(t, s, idp, samlSession("random-1", string(saml.TransientNameIDFormat), "heidi@example.com"))
+		expectStatus(t, w, http.StatusOK)
+		if _, err := s.stores.Users.FindByIdentity(context.Background(), identityProvider, "random-1"); err == nil {
+			t.Error("transient NameID was linked")
+		}
+	})
+
+	t.Run("untrusted signer", func(t *testing.T) {
+		s := newTestServer(t)
+		s.createUser("ivan", testPassword)
+
+		// Same entity ID, different key
+		impostor := newTestIdP(t, idp.MetadataURL.String())
+		w := samlLogin(t, s, impostor, samlSession("ivan-id", persistent, "ivan@example.com"))
+		expectStatus(t, w, http.StatusUnauthorized)
+	})
+
+	t.Run("relay state is single use", func(t *testing.T) {
+		s := newTestServer(t)
+		w := s.do(request{method: http.MethodGet, path: "/api/sso/login"})
+		location, _ := url.Parse(w.Header().Get("Location"))
+		form := url.Values{
+			"SAMLResponse": {base64.StdEncoding.EncodeToString([]byte("<Response/>"))},
+			"RelayState":   {location.Query().Get("RelayState")},
+		}
+		browser := []*http.Cookie{cookie(w, samlRelayCookie)}
+		expectStatus(t, s.do(request{method: http.MethodPost, path: "/api/sso/callback", form: form, cookies: browser}), http.StatusUnauthorized)
+		expectStatus(t, s.do(request{method: http.MethodPost, path: "/api/sso/callback", form: form, cookies: browser}), http.StatusBadRequest)
+	})
+
+	t.Run("response posted from another browser", func(t *testing.T) {
+		s := newTestServer(t)
+		s.createUser("judy", testPassword)
+
+		// The attacker's own valid response, posted from a victim who has no
+		// login in progress or one of their own
+		form, _ := samlResponse(t, s, idp, samlSession("judy-id", persistent, "judy@example.com"))
+		_, victim := samlResponse(t, s, idp, samlSession("judy-id", persistent, "judy@example.com"))
+		expectStatus(t, s.do(request{method: http.MethodPost, path: "/api/sso/callback", form: form}), http.StatusBadRequest)
+		expectStatus(t, s.do(request{method: http.MethodPost, path: "/api/sso/callback", form: form, cookies: []*http.Cookie{victim}}), http.StatusBadRequest)
+	})
+}
@@ -4,32 +4,18 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"time"
 
-	"github.com/NoorBnHossam/Authentication_Types/internal/db"
+	"github.com/NoorBnHossam/Authentication_Types/internal/audit"
 	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"github.com/NoorBnHossam/Authentication_Types/internal/store"
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"golang.org/x/crypto/bcrypt"
 )
 
-type Session struct {
-	ID           string    `bson:"_id"`
-	UserID       string    `bson:"user_id"`
-	UserAgent    string    `bson:"user_agent"`
-	IPAddress    string    `bson:"ip_address"`
-	LastActivity time.Time `bson:"last_activity"`
-	CreatedAt    time.Time `bson:"created_at"`
-	ExpiresAt    time.Time `bson:"expires_at"`
-	IsValid      bool      `bson:"is_valid"`
-}
-
 // SessionConfig holds session configuration
 type SessionConfig struct {
 	SessionDuration time.Duration
@@ -44,139 +30,71 @@ var defaultSessionConfig = SessionConfig{
 }
 
 func generateSessionID() (string, error) {
-	for i := 0; i < 3; i++ { // Try up to 3 times to generate a unique session ID
-		b := make([]byte, 32)
-		if _, err := rand.Read(b); err != nil {
-			return "", fmt.Errorf("failed to generate random bytes: %w", err)
-		}
-		sessionID := base64.URLEncoding.EncodeToString(b)
-
-		// Check if session ID already exists
-		count, err := db.Database.Collection("sessions").CountDocuments(context.Background(), bson.M{"_id": sessionID})
-		if err != nil {
-			return "", fmt.Errorf("failed to check session ID uniqueness: %w", err)
-		}
-		if count == 0 {
-			return sessionID, nil
-		}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %w", err)
 	}
-	return "", fmt.Errorf("failed to generate unique session ID after 3 attempts")
+	return base64.URLEncoding.EncodeToString(b), nil
 }
 
 func enforceMaxSessions(ctx context.Context, userID string) error {
-	sessionsCollection := db.Database.Collection("sessions")
-
-	// Count active sessions
-	count, err := sessionsCollection.CountDocuments(ctx, bson.M{
-		"user_id":  userID,
-		"is_valid": true,
-	})
+	sessions, err := stores.Sessions.ListValid(ctx, userID)
 	if err != nil {
-		return fmt.Errorf("failed to count active sessions: %w", err)
+		return fmt.Errorf("failed to find active sessions: %w", err)
 	}
 
-	// If we're at or over the limit, delete oldest sessions
-	if int(count) >= defaultSessionConfig.MaxSessions {
-		// Find and delete oldest sessions
-		opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
-		cursor, err := sessionsCollection.Find(ctx, bson.M{
-			"user_id":  userID,
-			"is_valid": true,
-		}, opts)
-		if err != nil {
-			return fmt.Errorf("failed to find old sessions: %w", err)
-		}
-		defer cursor.Close(ctx)
-
-		var sessions []Session
-		if err = cursor.All(ctx, &sessions); err != nil {
-			return fmt.Errorf("failed to decode old sessions: %w", err)
-		}
-
-		// Delete oldest sessions that exceed the limit
-		sessionsToDelete := int(count) - defaultSessionConfig.MaxSessions + 1
-		for i := 0; i < sessionsToDelete; i++ {
-			_, err = sessionsCollection.UpdateOne(
-				ctx,
-				bson.M{"_id": sessions[i].ID},
-				bson.M{"$set": bson.M{"is_valid": false}},
-			)
-			if err != nil {
-				return fmt.Errorf("failed to invalidate old session: %w", err)
-			}
+	// If we're at or over the limit, invalidate the oldest sessions
+	sessionsToDelete := len(sessions) - defaultSessionConfig.MaxSessions + 1
+	for i := 0; i < sessionsToDelete; i++ {
+		if err := stores.Sessions.Invalidate(ctx, sessions[i].ID); err != nil {
+			return fmt.Errorf("failed to invalidate old session: %w", err)
 		}
 	}
 	return nil
 }
 
-func SessionAuthLogin(c *gin.Context) {
-	var loginReq models.LoginRequest
-	if err := c.ShouldBindJSON(&loginReq); err != nil {
-		log.Printf("[SessionAuthLogin] Invalid request payload for user %s: %v", loginReq.Username, err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
-		return
-	}
-
-	var user models.User
-	err := db.Collection.FindOne(context.Background(), bson.M{"username": loginReq.Username}).Decode(&user)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			log.Printf("[SessionAuthLogin] Failed login attempt for non-existent user: %s", loginReq.Username)
-		} else {
-			log.Printf("[SessionAuthLogin] Database error while looking up user %s: %v", loginReq.Username, err)
-		}
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-		return
-	}
-
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(loginReq.Password))
-	if err != nil {
-		log.Printf("[SessionAuthLogin] Failed password attempt for user %s", loginReq.Username)
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-		return
-	}
-
+// createSession stores a new session for user and sets the session cookie.
+// method records which login flow produced the session.
+func createSession(c *gin.Context, user models.User, method string) (models.Session, error) {
 	// Enforce maximum sessions limit
 	if err := enforceMaxSessions(c.Request.Context(), user.ID.Hex()); err != nil {
-		log.Printf("[SessionAuthLogin] Error enforcing max sessions for user %s: %v", loginReq.Username, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create session"})
-		return
+		return models.Session{}, err
 	}
 
-	// Generate new session ID
-	sessionID, err := generateSessionID()
-	if err != nil {
-		log.Printf("[SessionAuthLogin] Error generating session ID for user %s: %v", loginReq.Username, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create session"})
-		return
-	}
+	// Create new session, retrying on the unlikely ID collision
+	var session models.Session
+	for i := 0; ; i++ {
+		sessionID, err := generateSessionID()
+		if err != nil {
+			return models.Session{}, err
+		}
 
-	// Create new session
-	now := time.Now()
-	session := Session{
-		ID:           sessionID,
-		UserID:       user.ID.Hex(),
-		UserAgent:    c.GetHeader("User-Agent"),
-		IPAddress:    c.ClientIP(),
-		LastActivity: now,
-		CreatedAt:    now,
-		ExpiresAt:    now.Add(defaultSessionConfig.SessionDuration),
-		IsValid:      true,
-	}
+		now := time.Now()
+		session = models.Session{
+			ID:           sessionID,
+			UserID:       user.ID.Hex(),
+			AuthMethod:   method,
+			UserAgent:    c.GetHeader("User-Agent"),
+			IPAddress:    c.ClientIP(),
+			LastActivity: now,
+			CreatedAt:    now,
+			ExpiresAt:    now.Add(defaultSessionConfig.SessionDuration),
+			IsValid:      true,
+		}
 
-	// Store session in database
-	sessionsCollection := db.Database.Collection("sessions")
-	_, err = sessionsCollection.InsertOne(context.Background(), session)
-	if err != nil {
-		log.Printf("[SessionAuthLogin] Error storing session for user %s: %v", loginReq.Username, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create session"})
-		return
+		err = stores.Sessions.Create(c.Request.Context(), session)
+		if err == nil {
+			break
+		}
+		if err != store.ErrDuplicate || i == 2 {
+			return models.Session{}, fmt.Errorf("failed to store session: %w", err)
+		}
 	}
 
 	// Set session cookie
 	c.SetCookie(
 		"session_id",
-		sessionID,
+		session.ID,
 		int(defaultSessionConfig.SessionDuration.Seconds()),
 		"/",
 		"",
@@ -184,7 +102,21 @@ func SessionAuthLogin(c *gin.Context) {
 		true, // HttpOnly
 	)
 
-	log.Printf("[SessionAuthLogin] Successful login for user %s", loginReq.Username)
+	return session, nil
+}
+
+func SessionAuthLogin(c *gin.Context) {
+	passwordLogin(c, "session")
+}
+
+func completeSessionLogin(c *gin.Context, user models.User) {
+	if _, err := createSession(c, user, "session"); err != nil {
+		log.Printf("[SessionAuthLogin] Error creating session for user %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create session"})
+		return
+	}
+
+	log.Printf("[SessionAuthLogin] Successful login for user %s", user.Username)
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Login successful",
 		"user":    user.ToResponse(),
@@ -192,92 +124,66 @@ func SessionAuthLogin(c *gin.Context) {
 }
 
 func SessionAuthMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		sessionID, err := c.Cookie("session_id")
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session required"})
-			c.Abort()
-			return
-		}
+	return Authenticate("session")
+}
 
-		sessionsCollection := db.Database.Collection("sessions")
-		var session Session
-		err = sessionsCollection.FindOne(context.Background(), bson.M{
-			"_id":      sessionID,
-			"is_valid": true,
-			"expires_at": bson.M{
-				"$gt": time.Now(),
-			},
-		}).Decode(&session)
-		if err != nil {
-			c.SetCookie("session_id", "", -1, "/", "", true, true)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired session"})
-			c.Abort()
-			return
-		}
+// authenticateSession resolves the session cookie to a live session and its
+// user, applying the hijacking and idle checks. It returns ErrNoCredentials
+// without a session cookie; other error messages are safe to show to the
+// client.
+func authenticateSession(c *gin.Context, method string) (models.Session, models.User, error) {
+	sessionID, err := c.Cookie("session_id")
+	if err != nil {
+		return models.Session{}, models.User{}, ErrNoCredentials
+	}
 
-		// Check for session hijacking
-		if session.UserAgent != c.GetHeader("User-Agent") || session.IPAddress != c.ClientIP() {
-			// Invalidate session
-			_, err = sessionsCollection.UpdateOne(
-				context.Background(),
-				bson.M{"_id": sessionID},
-				bson.M{"$set": bson.M{"is_valid": false}},
-			)
-			if err != nil {
-				log.Println("[SessionAuthMiddleware] Error invalidating session:", err)
-			}
-			c.SetCookie("session_id", "", -1, "/", "", true, true)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session security violation"})
-			c.Abort()
-			return
-		}
+	ctx := c.Request.Context()
+	session, err := stores.Sessions.FindValid(ctx, sessionID)
+	if err != nil {
+		c.SetCookie("session_id", "", -1, "/", "", true, true)
+		return models.Session{}, models.User{}, errors.New("Invalid or expired session")
+	}
 
-		// Check for idle timeout
-		if time.Since(session.LastActivity) > defaultSessionConfig.IdleTimeout {
-			_, err = sessionsCollection.UpdateOne(
-				context.Background(),
-				bson.M{"_id": sessionID},
-				bson.M{"$set": bson.M{"is_valid": false}},
-			)
-			if err != nil {
-				log.Println("[SessionAuthMiddleware] Error invalidating idle session:", err)
-			}
-			c.SetCookie("session_id", "", -1, "/", "", true, true)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session expired due to inactivity"})
-			c.Abort()
-			return
-		}
+	if method != "" && session.AuthMethod != method {
+		return models.Session{}, models.User{}, errors.New("Invalid or expired session")
+	}
 
-		// Update last activity
-		_, err = sessionsCollection.UpdateOne(
-			context.Background(),
-			bson.M{"_id": sessionID},
-			bson.M{"$set": bson.M{"last_activity": time.Now()}},
-		)
-		if err != nil {
-			log.Println("[SessionAuthMiddleware] Error updating session activity:", err)
+	// Check for session hijacking
+	if session.UserAgent != c.GetHeader("User-Agent") || session.IPAddress != c.ClientIP() {
+		// Invalidate session
+		if err := stores.Sessions.Invalidate(ctx, sessionID); err != nil {
+			log.Println("[SessionAuthMiddleware] Error invalidating session:", err)
 		}
-
-		var user models.User
-		objectID, err := primitive.ObjectIDFromHex(session.UserID)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID"})
-			c.Abort()
-			return
+		reason := "user_agent_changed"
+		if session.IPAddress != c.ClientIP() {
+			reason = "ip_changed"
 		}
+		auditSession(c, session, audit.SessionHijack, audit.Failure, reason)
+		c.SetCookie("session_id", "", -1, "/", "", true, true)
+		return models.Session{}, models.User{}, errors.New("Session security violation")
+	}
 
-		err = db.Collection.FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&user)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
-			c.Abort()
-			return
+	// Check for idle timeout
+	if time.Since(session.LastActivity) > defaultSessionConfig.IdleTimeout {
+		if err := stores.Sessions.Invalidate(ctx, sessionID); err != nil {
+			log.Println("[SessionAuthMiddleware] Error invalidating idle session:", err)
 		}
+		auditSession(c, session, audit.SessionIdleExpired, audit.Success, "idle_timeout")
+		c.SetCookie("session_id", "", -1, "/", "", true, true)
+		return models.Session{}, models.User{}, errors.New("Session expired due to inactivity")
+	}
+
+	// Update last activity
+	if err := stores.Sessions.Touch(ctx, sessionID); err != nil {
+		log.Println("[SessionAuthMiddleware] Error updating session activity:", err)
+	}
 
-		c.Set("user", user)
-		c.Set("session", session)
-		c.Next()
+	user, err := stores.Users.FindByID(ctx, session.UserID)
+	if err != nil {
+		return models.Session{}, models.User{}, errors.New("User not found")
 	}
+
+	return session, user, nil
 }
 
 func SessionAuthLogout(c *gin.Context) {
@@ -287,16 +193,34 @@ func SessionAuthLogout(c *gin.Context) {
 		return
 	}
 
-	sessionsCollection := db.Database.Collection("sessions")
-	_, err = sessionsCollection.UpdateOne(
-		context.Background(),
-		bson.M{"_id": sessionID},
-		bson.M{"$set": bson.M{"is_valid": false}},
-	)
-	if err != nil {
+	ctx := c.Request.Context()
+	if session, err := stores.Sessions.FindValid(ctx, sessionID); err == nil {
+		auditSession(c, session, audit.Logout, audit.Success, "")
+	}
+	if err := stores.Sessions.Invalidate(ctx, sessionID); err != nil {
 		log.Println("[SessionAuthLogout] Error invalidating session:", err)
 	}
 
 	c.SetCookie("session_id", "", -1, "/", "", true, true)
 	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
 }
+
+// auditSession records an event about session. The session only holds the
+// user ID, so the user is looked up for the actor; the event is recorded
+// without one if the lookup fails.
+func auditSession(c *gin.Context, session models.Session, eventType audit.Type, outcome audit.Outcome, reason string) {
+	var actor string
+	if user, err := stores.Users.FindByID(c.Request.Context(), session.UserID); err == nil {
+		actor = user.Username
+	} else {
+		log.Printf("[auditSession] Error looking up user %s for %s event: %v", session.UserID, eventType, err)
+	}
+	recordAudit(c, audit.Event{
+		Type:    eventType,
+		Outcome: outcome,
+		Actor:   actor,
+		UserID:  session.UserID,
+		Method:  session.AuthMethod,
+		Reason:  reason,
+	})
+}
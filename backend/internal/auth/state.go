@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/store"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// errStateNotFound is returned when a state record is unknown, expired or
+// has already been consumed.
+var errStateNotFound = errors.New("state not found or expired")
+
+// Short-lived, single-use records are kept server-side between two legs of a
+// flow (e.g. an OAuth redirect and its callback). The lookup key is stored
+// hashed so a database dump does not leak live values.
+func stateID(kind, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return kind + ":" + hex.EncodeToString(sum[:])
+}
+
+// saveState stores data under kind/key for ttl.
+func saveState(ctx context.Context, kind, key string, data interface{}, ttl time.Duration) error {
+	return saveUserState(ctx, kind, key, "", data, ttl)
+}
+
+// saveUserState is saveState for records that dropUserStates should be able
+// to cancel
+func saveUserState(ctx context.Context, kind, key, userID string, data interface{}, ttl time.Duration) error {
+	raw, err := bson.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return stores.States.Create(ctx, store.State{
+		ID:        stateID(kind, key),
+		Kind:      kind,
+		UserID:    userID,
+		Data:      raw,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+}
+
+// takeState atomically removes the record stored under kind/key and decodes
+// it into out. Expired records are treated as missing.
+func takeState(ctx context.Context, kind, key string, out interface{}) error {
+	state, err := stores.States.Take(ctx, stateID(kind, key))
+	if err != nil {
+		return stateError(err)
+	}
+	return bson.Unmarshal(state.Data, out)
+}
+
+// peekState decodes the record stored under kind/key into out without
+// consuming it. Use takeState to redeem the record.
+func peekState(ctx context.Context, kind, key string, out interface{}) error {
+	state, err := stores.States.Find(ctx, stateID(kind, key))
+	if err != nil {
+		return stateError(err)
+	}
+	return bson.Unmarshal(state.Data, out)
+}
+
+// countStateAttempt records a failed attempt against the record stored under
+// kind/key and returns how many there have been
+func countStateAttempt(ctx context.Context, kind, key string) (int, error) {
+	attempts, err := stores.States.CountAttempt(ctx, stateID(kind, key))
+	return attempts, stateError(err)
+}
+
+// dropUserStates removes the records of kind saved for userID
+func dropUserStates(ctx context.Context, kind, userID string) error {
+	return stores.States.DeleteUser(ctx, kind, userID)
+}
+
+func stateError(err error) error {
+	if err == store.ErrNotFound {
+		return errStateNotFound
+	}
+	return err
+}
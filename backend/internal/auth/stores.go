@@ -0,0 +1,12 @@
+package auth
+
+import "github.com/NoorBnHossam/Authentication_Types/internal/store"
+
+// stores is where the handlers keep users, sessions and opaque tokens
+var stores store.Stores
+
+// UseStores sets the stores the handlers use. Call it before the router
+// serves requests.
+func UseStores(s store.Stores) {
+	stores = s
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The built-in authenticators. Session based logins that only accept their
+// own sessions (OAuth, SAML, magic link) share sessionAuthenticator.
+func init() {
+	Register(basicAuthenticator{})
+	Register(tokenAuthenticator{})
+	Register(jwtAuthenticator{})
+	Register(sessionAuthenticator{name: "session"})
+	Register(sessionAuthenticator{name: "oauth", method: "oauth", routes: oauthRoutes})
+	Register(sessionAuthenticator{name: "saml", method: "saml", routes: samlRoutes})
+	Register(sessionAuthenticator{name: "magic_link", method: "magic_link", routes: magicLinkRoutes})
+}
+
+type basicAuthenticator struct{}
+
+func (basicAuthenticator) Name() string { return "basic" }
+
+func (basicAuthenticator) Challenge() string {
+	return fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, authRealm)
+}
+
+func (basicAuthenticator) Authenticate(c *gin.Context) (Principal, error) {
+	return authenticateBasic(c)
+}
+
+func (basicAuthenticator) RegisterRoutes(r gin.IRouter) {
+	r.POST("/api/basic-auth/login", BasicAuthLogin)
+	r.GET("/api/basic-auth/protected", BasicAuthMiddleware(), ProtectedRoute)
+}
+
+type tokenAuthenticator struct{}
+
+func (tokenAuthenticator) Name() string      { return "token" }
+func (tokenAuthenticator) Challenge() string { return fmt.Sprintf(`Bearer realm="%s"`, authRealm) }
+
+func (tokenAuthenticator) Authenticate(c *gin.Context) (Principal, error) {
+	return authenticateToken(c)
+}
+
+func (tokenAuthenticator) RegisterRoutes(r gin.IRouter) {
+	r.POST("/api/token-auth/login", TokenAuthLogin)
+	r.GET("/api/token-auth/protected", TokenAuthMiddleware(), ProtectedRoute)
+}
+
+type jwtAuthenticator struct{}
+
+func (jwtAuthenticator) Name() string      { return "jwt" }
+func (jwtAuthenticator) Challenge() string { return fmt.Sprintf(`Bearer realm="%s"`, authRealm) }
+
+func (jwtAuthenticator) Authenticate(c *gin.Context) (Principal, error) {
+	return authenticateJWT(c)
+}
+
+func (jwtAuthenticator) RegisterRoutes(r gin.IRouter) {
+	r.POST("/api/jwt-auth/login", JWTAuthLogin)
+	r.GET("/api/jwt-auth/protected", JWTAuthMiddleware(), ProtectedRoute)
+	r.POST("/api/jwt-auth/refresh", RefreshToken)
+	r.POST("/api/jwt-auth/logout", Logout)
+	r.GET("/.well-known/jwks.json", JWKSHandler)
+}
+
+// sessionAuthenticator accepts the session cookie. With method set, only
+// sessions created by that login flow are accepted.
+type sessionAuthenticator struct {
+	name   string
+	method string
+	routes func(r gin.IRouter)
+}
+
+func (a sessionAuthenticator) Name() string    { return a.name }
+func (sessionAuthenticator) Challenge() string { return "" }
+
+func (a sessionAuthenticator) Authenticate(c *gin.Context) (Principal, error) {
+	session, user, err := authenticateSession(c, a.method)
+	if err != nil {
+		return Principal{}, err
+	}
+	return Principal{User: user, Method: a.name, Session: &session}, nil
+}
+
+func (a sessionAuthenticator) RegisterRoutes(r gin.IRouter) {
+	if a.routes != nil {
+		a.routes(r)
+		return
+	}
+	r.POST("/api/session-auth/login", SessionAuthLogin)
+	r.GET("/api/session-auth/protected", SessionAuthMiddleware(), ProtectedRoute)
+	r.POST("/api/session-auth/logout", SessionAuthLogout)
+}
+
+func oauthRoutes(r gin.IRouter) {
+	r.GET("/api/oauth/login", OAuthLogin)
+	r.GET("/api/oauth/callback", OAuthCallback)
+	r.GET("/api/oauth/protected", OAuthMiddleware(), ProtectedRoute)
+}
+
+func samlRoutes(r gin.IRouter) {
+	r.GET("/api/sso/login", SSOLogin)
+	r.POST("/api/sso/callback", SSOCallback)
+	r.GET("/api/sso/metadata", SSOMetadata)
+	r.GET("/api/sso/protected", SSOMiddleware(), ProtectedRoute)
+}
+
+func magicLinkRoutes(r gin.IRouter) {
+	r.POST("/api/magic-link", RequestMagicLink)
+	r.GET("/api/magic-link/verify", MagicLinkLogin)
+	r.GET("/api/magic-link/protected", MagicLinkMiddleware(), ProtectedRoute)
+}
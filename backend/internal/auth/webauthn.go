@@ -0,0 +1,434 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/config"
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"github.com/NoorBnHossam/Authentication_Types/internal/store"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	webauthnRegistrationKind = "webauthn_registration"
+	webauthnLoginKind        = "webauthn_login"
+	webauthnCeremonyTTL      = 5 * time.Minute
+	// webauthnCeremonyCookie binds a ceremony to the browser that started it
+	webauthnCeremonyCookie = "webauthn_ceremony"
+)
+
+// webauthnCeremony is the server-side state between the begin and finish
+// calls of a registration or login
+type webauthnCeremony struct {
+	Session webauthn.SessionData `bson:"session"`
+	UserID  string               `bson:"user_id,omitempty"`
+	// Method is the login outcome: "session" or "jwt"
+	Method string `bson:"method,omitempty"`
+}
+
+// webauthnUser adapts models.User to the library's User interface
+type webauthnUser struct {
+	user models.User
+}
+
+func (u webauthnUser) WebAuthnID() []byte          { return u.user.WebAuthnID }
+func (u webauthnUser) WebAuthnName() string        { return u.user.Username }
+func (u webauthnUser) WebAuthnDisplayName() string { return u.user.Username }
+func (u webauthnUser) WebAuthnIcon() string        { return "" }
+
+func (u webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.user.WebAuthnCredentials))
+	for _, stored := range u.user.WebAuthnCredentials {
+		transports := make([]protocol.AuthenticatorTransport, len(stored.Transports))
+		for i, t := range stored.Transports {
+			transports[i] = protocol.AuthenticatorTransport(t)
+		}
+		credentials = append(credentials, webauthn.Credential{
+			ID:              stored.ID,
+			PublicKey:       stored.PublicKey,
+			AttestationType: stored.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				UserVerified:   stored.UserVerified,
+				BackupEligible: stored.BackupEligible,
+				BackupState:    stored.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    stored.AAGUID,
+				SignCount: stored.SignCount,
+			},
+		})
+	}
+	return credentials
+}
+
+var (
+	relyingPartyOnce sync.Once
+	relyingPartyInst *webauthn.WebAuthn
+	relyingPartyErr  error
+)
+
+// relyingParty returns the WebAuthn relying party built from config
+func relyingParty() (*webauthn.WebAuthn, error) {
+	relyingPartyOnce.Do(func() {
+		cfg := config.Load()
+		relyingPartyInst, relyingPartyErr = webauthn.New(&webauthn.Config{
+			RPID:          cfg.WebAuthnRPID,
+			RPDisplayName: cfg.WebAuthnRPName,
+			RPOrigins:     cfg.WebAuthnRPOrigins,
+			Timeouts: webauthn.TimeoutsConfig{
+				Login:        webauthn.TimeoutConfig{Enforce: true, Timeout: webauthnCeremonyTTL, TimeoutUVD: webauthnCeremonyTTL},
+				Registration: webauthn.TimeoutConfig{Enforce: true, Timeout: webauthnCeremonyTTL, TimeoutUVD: webauthnCeremonyTTL},
+			},
+		})
+	})
+	return relyingPartyInst, relyingPartyErr
+}
+
+// BeginWebAuthnRegistration returns creation options for a new credential for
+// the authenticated user
+func BeginWebAuthnRegistration(c *gin.Context) {
+	rp, err := relyingParty()
+	if err != nil {
+		log.Println("[WebAuthn] Invalid relying party configuration:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "WebAuthn is not configured"})
+		return
+	}
+
+	user, ok := contextUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	if len(user.WebAuthnID) == 0 {
+		if user.WebAuthnID, err = assignWebAuthnID(c.Request.Context(), user); err != nil {
+			log.Printf("[BeginWebAuthnRegistration] Error assigning user handle to user %s: %v", user.Username, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start registration"})
+			return
+		}
+	}
+
+	wu := webauthnUser{user}
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(user.WebAuthnCredentials))
+	for _, credential := range wu.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	options, session, err := rp.BeginRegistration(wu,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+		webauthn.WithCredentialParameters([]protocol.CredentialParameter{
+			{Type: protocol.PublicKeyCredentialType, Algorithm: webauthncose.AlgES256},
+			{Type: protocol.PublicKeyCredentialType, Algorithm: webauthncose.AlgRS256},
+		}),
+	)
+	if err != nil {
+		log.Printf("[BeginWebAuthnRegistration] Error creating options for user %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start registration"})
+		return
+	}
+
+	if err := startCeremony(c, webauthnRegistrationKind, webauthnCeremony{
+		Session: *session,
+		UserID:  user.ID.Hex(),
+	}); err != nil {
+		log.Printf("[BeginWebAuthnRegistration] Error storing ceremony for user %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start registration"})
+		return
+	}
+
+	c.JSON(http.StatusOK, options)
+}
+
+// FinishWebAuthnRegistration verifies the attestation and stores the new
+// credential on the user
+func FinishWebAuthnRegistration(c *gin.Context) {
+	rp, err := relyingParty()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "WebAuthn is not configured"})
+		return
+	}
+
+	user, ok := contextUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	var ceremony webauthnCeremony
+	if err := finishCeremony(c, webauthnRegistrationKind, &ceremony); err != nil || ceremony.UserID != user.ID.Hex() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired registration"})
+		return
+	}
+
+	// The context user may predate the user handle assigned at begin
+	user, err = stores.Users.FindByID(c.Request.Context(), ceremony.UserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired registration"})
+		return
+	}
+
+	credential, err := rp.FinishRegistration(webauthnUser{user}, ceremony.Session, c.Request)
+	if err != nil {
+		log.Printf("[FinishWebAuthnRegistration] Attestation rejected for user %s: %v", user.Username, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Credential verification failed"})
+		return
+	}
+
+	transports := make([]string, len(credential.Transport))
+	for i, t := range credential.Transport {
+		transports[i] = string(t)
+	}
+	stored := models.WebAuthnCredential{
+		ID:              credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      transports,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		UserVerified:    credential.Flags.UserVerified,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+		CreatedAt:       time.Now(),
+	}
+	err = stores.Users.AddWebAuthnCredential(c.Request.Context(), user.ID.Hex(), stored)
+	if err == store.ErrDuplicate {
+		c.JSON(http.StatusConflict, gin.H{"error": "Credential already registered"})
+		return
+	}
+	if err != nil {
+		log.Printf("[FinishWebAuthnRegistration] Error storing credential for user %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not store credential"})
+		return
+	}
+
+	log.Printf("[FinishWebAuthnRegistration] Registered credential for user %s", user.Username)
+	c.JSON(http.StatusCreated, gin.H{"message": "Credential registered", "credential": stored})
+}
+
+// BeginWebAuthnLogin returns assertion options. With the username of a user
+// who has credentials the options list them; otherwise they ask for a
+// discoverable credential (passkey). The difference shows which usernames
+// have credentials, much as registration shows which are taken; clients that
+// must not disclose this should leave the username out. User verification is
+// required either way.
+func BeginWebAuthnLogin(c *gin.Context) {
+	rp, err := relyingParty()
+	if err != nil {
+		log.Println("[WebAuthn] Invalid relying party configuration:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "WebAuthn is not configured"})
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		// Mode selects the outcome: "session" (default) or "jwt"
+		Mode string `json:"mode"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = "session"
+	}
+	if req.Mode != "session" && req.Mode != "jwt" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Mode must be session or jwt"})
+		return
+	}
+
+	var options *protocol.CredentialAssertion
+	var session *webauthn.SessionData
+
+	var user models.User
+	if req.Username != "" {
+		user, err = stores.Users.FindByUsername(c.Request.Context(), req.Username)
+		if err != nil && err != store.ErrNotFound {
+			log.Printf("[BeginWebAuthnLogin] Database error looking up user %s: %v", req.Username, err)
+		}
+	}
+	verify := webauthn.WithUserVerification(protocol.VerificationRequired)
+	if len(user.WebAuthnCredentials) > 0 {
+		options, session, err = rp.BeginLogin(webauthnUser{user}, verify)
+	} else {
+		options, session, err = rp.BeginDiscoverableLogin(verify)
+	}
+	if err != nil {
+		log.Println("[BeginWebAuthnLogin] Error creating options:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start login"})
+		return
+	}
+
+	if err := startCeremony(c, webauthnLoginKind, webauthnCeremony{
+		Session: *session,
+		Method:  req.Mode,
+	}); err != nil {
+		log.Println("[BeginWebAuthnLogin] Error storing ceremony:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not start login"})
+		return
+	}
+
+	c.JSON(http.StatusOK, options)
+}
+
+// FinishWebAuthnLogin verifies the assertion and completes the login the same
+// way a password login would. The ceremony requires user verification, so the
+// authenticator proves possession and a PIN or biometric, and no MFA ticket is
+// involved.
+func FinishWebAuthnLogin(c *gin.Context) {
+	rp, err := relyingParty()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "WebAuthn is not configured"})
+		return
+	}
+
+	var ceremony webauthnCeremony
+	if err := finishCeremony(c, webauthnLoginKind, &ceremony); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired login"})
+		return
+	}
+	complete, known := loginCompleters[ceremony.Method]
+	if !known {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired login"})
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponse(c.Request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid assertion"})
+		return
+	}
+
+	var user models.User
+	var credential *webauthn.Credential
+	if ceremony.Session.UserID != nil {
+		if user, err = stores.Users.FindByWebAuthnID(c.Request.Context(), ceremony.Session.UserID); err == nil {
+			credential, err = rp.ValidateLogin(webauthnUser{user}, ceremony.Session, parsed)
+		}
+	} else {
+		credential, err = rp.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			found, err := stores.Users.FindByWebAuthnID(c.Request.Context(), userHandle)
+			user = found
+			return webauthnUser{found}, err
+		}, ceremony.Session, parsed)
+	}
+	if err != nil {
+		log.Printf("[FinishWebAuthnLogin] Assertion rejected: %v", err)
+		auditLoginFailure(c, user.Username, "webauthn", "invalid_assertion")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+	// ValidateLogin enforces the UV flag from the stored session; check it
+	// here too so a ceremony started without the requirement cannot skip MFA
+	if !credential.Flags.UserVerified {
+		log.Printf("[FinishWebAuthnLogin] Assertion without user verification for user %s", user.Username)
+		auditLoginFailure(c, user.Username, "webauthn", "user_not_verified")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User verification required"})
+		return
+	}
+
+	// A sign count that did not increase means the credential may have been
+	// cloned; refuse it rather than just flagging it
+	if credential.Authenticator.CloneWarning {
+		log.Printf("[SECURITY] WebAuthn sign count did not increase for user %s; possible cloned authenticator", user.Username)
+		auditLoginFailure(c, user.Username, "webauthn", "cloned_authenticator")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+
+	if err := recordCredentialUse(c.Request.Context(), user, credential); err != nil {
+		log.Printf("[FinishWebAuthnLogin] Error updating sign count for user %s: %v", user.Username, err)
+		if errors.Is(err, errSignCountUsed) {
+			auditLoginFailure(c, user.Username, "webauthn", "replayed_assertion")
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+
+	if err := checkLoginAllowed(user); err != nil {
+		auditLoginFailure(c, user.Username, "webauthn", "email_not_verified")
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("[FinishWebAuthnLogin] Successful login for user %s", user.Username)
+	complete(c, user)
+	if c.Writer.Status() < http.StatusBadRequest {
+		auditLoginSuccess(c, user, "webauthn")
+	}
+}
+
+// recordCredentialUse stores the new sign count. The update only applies if
+// the stored count is still lower, so two replays of one assertion racing
+// each other cannot both succeed.
+func recordCredentialUse(ctx context.Context, user models.User, credential *webauthn.Credential) error {
+	err := stores.Users.UpdateWebAuthnCredential(ctx, user.ID.Hex(), models.WebAuthnCredential{
+		ID:           credential.ID,
+		SignCount:    credential.Authenticator.SignCount,
+		BackupState:  credential.Flags.BackupState,
+		UserVerified: credential.Flags.UserVerified,
+		LastUsedAt:   time.Now(),
+	})
+	if err == store.ErrNotFound {
+		return errSignCountUsed
+	}
+	return err
+}
+
+// errSignCountUsed is returned by recordCredentialUse when another login
+// already stored the assertion's sign count
+var errSignCountUsed = errors.New("sign count already used")
+
+// assignWebAuthnID gives the user a random 64-byte user handle. Handles are
+// never derived from the user ID so authenticators cannot correlate accounts.
+func assignWebAuthnID(ctx context.Context, user models.User) ([]byte, error) {
+	handle := make([]byte, 64)
+	if _, err := rand.Read(handle); err != nil {
+		return nil, err
+	}
+
+	// Only set it if no concurrent request got there first
+	if err := stores.Users.SetWebAuthnID(ctx, user.ID.Hex(), handle); err != nil {
+		return nil, err
+	}
+
+	stored, err := stores.Users.FindByID(ctx, user.ID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	return stored.WebAuthnID, nil
+}
+
+// startCeremony saves the ceremony state and binds it to the browser with a
+// cookie
+func startCeremony(c *gin.Context, kind string, ceremony webauthnCeremony) error {
+	key, err := randomURLString(32)
+	if err != nil {
+		return err
+	}
+	if err := saveState(c.Request.Context(), kind, key, ceremony, webauthnCeremonyTTL); err != nil {
+		return err
+	}
+	c.SetCookie(webauthnCeremonyCookie, key, int(webauthnCeremonyTTL.Seconds()), "/api/webauthn", "", true, true)
+	return nil
+}
+
+// finishCeremony consumes the ceremony state named by the cookie
+func finishCeremony(c *gin.Context, kind string, out *webauthnCeremony) error {
+	key, err := c.Cookie(webauthnCeremonyCookie)
+	c.SetCookie(webauthnCeremonyCookie, "", -1, "/api/webauthn", "", true, true)
+	if err != nil {
+		return err
+	}
+	return takeState(c.Request.Context(), kind, key, out)
+}
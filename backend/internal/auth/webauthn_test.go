@@ -0,0 +1,317 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+// Relying party defaults from config
+const (
+	testRPID     = "localhost"
+	testRPOrigin = "http://localhost:3000"
+)
+
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+var b64 = base64.RawURLEncoding
+
+// softAuthenticator is an ES256 authenticator with "none" attestation
+type softAuthenticator struct {
+	t            *testing.T
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+	// skipVerification leaves the UV flag unset, as a security key without a
+	// PIN would
+	skipVerification bool
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	return &softAuthenticator{t: t, key: key, credentialID: id}
+}
+
+func (a *softAuthenticator) clientData(kind string, challenge protocol.URLEncodedBase64) []byte {
+	data, err := json.Marshal(map[string]string{
+		"type":      kind,
+		"challenge": b64.EncodeToString(challenge),
+		"origin":    testRPOrigin,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return data
+}
+
+// authenticatorData builds the fixed part of the authenticator data, with
+// attested credential data appended when attested is set
+func (a *softAuthenticator) authenticatorData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	flags := byte(flagUserPresent)
+	if !a.skipVerification {
+		flags |= flagUserVerified
+	}
+	if attested {
+		flags |= flagAttestedData
+	}
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if !attested {
+		return data
+	}
+
+	point, err := a.key.PublicKey.ECDH()
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	uncompressed := point.Bytes()
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: uncompressed[1:33],
+		YCoord: uncompressed[33:],
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	data = append(data, make([]byte, 16)...) // zero AAGUID
+	data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+	data = append(data, a.credentialID...)
+	return append(data, publicKey...)
+}
+
+// create answers creation options the way navigator.credentials.create would
+func (a *softAuthenticator) create(options protocol.CredentialCreation) map[string]any {
+	a.userHandle = options.Response.User.ID.([]byte)
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authenticatorData(true),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return map[string]any{
+		"id":    b64.EncodeToString(a.credentialID),
+		"rawId": b64.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(a.clientData("webauthn.create", options.Response.Challenge)),
+			"attestationObject": b64.EncodeToString(attestation),
+		},
+	}
+}
+
+// get answers assertion options the way navigator.credentials.get would
+func (a *softAuthenticator) get(options protocol.CredentialAssertion) map[string]any {
+	a.signCount++
+	clientData := a.clientData("webauthn.get", options.Response.Challenge)
+	authData := a.authenticatorData(false)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return map[string]any{
+		"id":    b64.EncodeToString(a.credentialID),
+		"rawId": b64.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64.EncodeToString(clientData),
+			"authenticatorData": b64.EncodeToString(authData),
+			"signature":         b64.EncodeToString(signature),
+			"userHandle":        b64.EncodeToString(a.userHandle),
+		},
+	}
+}
+
+// mountWebAuthn adds the WebAuthn routes, which the router package mounts
+func (s *testServer) mountWebAuthn() {
+	s.router.POST("/api/webauthn/login/begin", BeginWebAuthnLogin)
+	s.router.POST("/api/webauthn/login/finish", FinishWebAuthnLogin)
+	passkeys := s.router.Group("/api/webauthn/register", Authenticate())
+	passkeys.POST("/begin", BeginWebAuthnRegistration)
+	passkeys.POST("/finish", FinishWebAuthnRegistration)
+}
+
+// accessToken logs username in with the password and returns a JWT
+func (s *testServer) accessToken(username string) string {
+	s.t.Helper()
+	w := s.do(request{method: http.MethodPost, path: "/api/jwt-auth/login", body: map[string]string{
+		"username": username,
+		"password": testPassword,
+	}})
+	expectStatus(s.t, w, http.StatusOK)
+	token, _ := decode(s.t, w)["access_token"].(string)
+	return token
+}
+
+// registerPasskey registers authenticator for the user holding token
+func (s *testServer) registerPasskey(token string, authenticator *softAuthenticator) {
+	s.t.Helper()
+	w := s.do(request{method: http.MethodPost, path: "/api/webauthn/register/begin", bearer: token})
+	expectStatus(s.t, w, http.StatusOK)
+	var options protocol.CredentialCreation
+	if err := json.Unmarshal(w.Body.Bytes(), &options); err != nil {
+		s.t.Fatal(err)
+	}
+	// The user handle arrives base64url encoded
+	handle, err := b64.DecodeString(options.Response.User.ID.(string))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	options.Response.User.ID = handle
+
+	w = s.do(request{
+		method:  http.MethodPost,
+		path:    "/api/webauthn/register/finish",
+		body:    authenticator.create(options),
+		bearer:  token,
+		cookies: []*http.Cookie{cookie(w, webauthnCeremonyCookie)},
+	})
+	expectStatus(s.t, w, http.StatusCreated)
+}
+
+// beginLogin starts a login and returns the options and ceremony cookie
+func (s *testServer) beginLogin(username, mode string) (protocol.CredentialAssertion, *http.Cookie) {
+	s.t.Helper()
+	w := s.do(request{method: http.MethodPost, path: "/api/webauthn/login/begin", body: map[string]string{
+		"username": username,
+		"mode":     mode,
+	}})
+	expectStatus(s.t, w, http.StatusOK)
+	var options protocol.CredentialAssertion
+	if err := json.Unmarshal(w.Body.Bytes(), &options); err != nil {
+		s.t.Fatal(err)
+	}
+	return options, cookie(w, webauthnCeremonyCookie)
+}
+
+func (s *testServer) finishLogin(assertion map[string]any, ceremony *http.Cookie) *httptest.ResponseRecorder {
+	s.t.Helper()
+	var cookies []*http.Cookie
+	if ceremony != nil {
+		cookies = append(cookies, ceremony)
+	}
+	return s.do(request{method: http.MethodPost, path: "/api/webauthn/login/finish", body: assertion, cookies: cookies})
+}
+
+func TestWebAuthnLogin(t *testing.T) {
+	s := newTestServer(t)
+	s.mountWebAuthn()
+	s.createUser("mallory", testPassword)
+	authenticator := newSoftAuthenticator(t)
+	s.registerPasskey(s.accessToken("mallory"), authenticator)
+
+	t.Run("passkey", func(t *testing.T) {
+		options, ceremony := s.beginLogin("", "jwt")
+		if len(options.Response.AllowedCredentials) != 0 {
+			t.Fatal("discoverable options list credentials")
+		}
+		if options.Response.UserVerification != protocol.VerificationRequired {
+			t.Fatalf("user verification = %q, want required", options.Response.UserVerification)
+		}
+		w := s.finishLogin(authenticator.get(options), ceremony)
+		expectStatus(t, w, http.StatusOK)
+		token, _ := decode(t, w)["access_token"].(string)
+		expectStatus(t, s.do(request{method: http.MethodGet, path: "/api/jwt-auth/protected", bearer: token}), http.StatusOK)
+	})
+
+	t.Run("username", func(t *testing.T) {
+		options, ceremony := s.beginLogin("mallory", "session")
+		if len(options.Response.AllowedCredentials) != 1 {
+			t.Fatalf("options list %d credentials, want 1", len(options.Response.AllowedCredentials))
+		}
+		if options.Response.UserVerification != protocol.VerificationRequired {
+			t.Fatalf("user verification = %q, want required", options.Response.UserVerification)
+		}
+		w := s.finishLogin(authenticator.get(options), ceremony)
+		expectStatus(t, w, http.StatusOK)
+		if cookie(w, "session_id") == nil {
+			t.Fatal("login opened no session")
+		}
+	})
+
+	t.Run("unknown username", func(t *testing.T) {
+		options, _ := s.beginLogin("nobody", "session")
+		if len(options.Response.AllowedCredentials) != 0 {
+			t.Fatal("options for an unknown user list credentials")
+		}
+	})
+
+	t.Run("ceremony from another browser", func(t *testing.T) {
+		options, _ := s.beginLogin("", "jwt")
+		expectStatus(t, s.finishLogin(authenticator.get(options), nil), http.StatusBadRequest)
+	})
+
+	t.Run("replayed assertion", func(t *testing.T) {
+		options, ceremony := s.beginLogin("", "jwt")
+		assertion := authenticator.get(options)
+		expectStatus(t, s.finishLogin(assertion, ceremony), http.StatusOK)
+
+		// A new ceremony with an old sign count looks like a cloned key
+		options, ceremony = s.beginLogin("", "jwt")
+		authenticator.signCount--
+		expectStatus(t, s.finishLogin(authenticator.get(options), ceremony), http.StatusUnauthorized)
+	})
+}
+
+func TestWebAuthnLoginRequiresUserVerification(t *testing.T) {
+	s := newTestServer(t)
+	s.mountWebAuthn()
+	s.createUser("niaj", testPassword)
+	authenticator := newSoftAuthenticator(t)
+	s.registerPasskey(s.accessToken("niaj"), authenticator)
+
+	authenticator.skipVerification = true
+	for _, username := range []string{"", "niaj"} {
+		options, ceremony := s.beginLogin(username, "jwt")
+		expectStatus(t, s.finishLogin(authenticator.get(options), ceremony), http.StatusUnauthorized)
+	}
+}
+
+func TestWebAuthnLoginSkipsMFA(t *testing.T) {
+	s := newTestServer(t)
+	s.mountWebAuthn()
+	user := s.createUser("olivia", testPassword)
+	authenticator := newSoftAuthenticator(t)
+	s.registerPasskey(s.accessToken("olivia"), authenticator)
+	s.enableMFA(user)
+
+	// A user-verified passkey is two factors on its own
+	options, ceremony := s.beginLogin("", "jwt")
+	w := s.finishLogin(authenticator.get(options), ceremony)
+	expectStatus(t, w, http.StatusOK)
+	if _, ok := decode(t, w)["access_token"].(string); !ok {
+		t.Fatal("passkey login with MFA enabled issued no token")
+	}
+}
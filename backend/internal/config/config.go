@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -13,10 +14,79 @@ type Config struct {
 	MongoDBDatabase   string
 	MongoDBCollection string
 	JWTSecret         string
+	JWTSigningAlg     string
+	JWTPrivateKeyFile string
+	JWTKeyID          string
+	JWTKeyRingFile    string
 	JWTExpiration     time.Duration
+	RevocationStore   string
+	StorageDriver     string
+	DatabaseURL       string
+	RateLimitStore    string
+	RedisURL          string
+	RBACRolesFile     string
 	Port              string
 	Env               string
 	AllowedOrigins    []string
+	BaseURL           string
+
+	// Password hashing
+	PasswordHash       string
+	PasswordHashParams string
+	PasswordPepper     string
+
+	// Security audit log
+	AuditSinks      []string
+	AuditFile       string
+	AuditWebhookURL string
+
+	// Failed login lockout
+	LockoutThreshold  int
+	LockoutBaseDelay  time.Duration
+	LockoutMaxDelay   time.Duration
+	LockoutResetAfter time.Duration
+
+	// Registration and email
+	RequireEmailVerification bool
+	PasswordMinLength        int
+	PasswordResetURL         string
+	Mailer                   string
+	MFAIssuer                string
+	MagicLinkRedirect        string
+	MailerFile               string
+
+	// WebAuthn relying party
+	WebAuthnRPID      string
+	WebAuthnRPName    string
+	WebAuthnRPOrigins []string
+
+	// OAuth 2.0 client (authorization code + PKCE)
+	OAuthProvider          string
+	OAuthClientID          string
+	OAuthClientSecret      string
+	OAuthAuthURL           string
+	OAuthTokenURL          string
+	OAuthUserInfoURL       string
+	OAuthIssuer            string
+	OAuthRedirectURL       string
+	OAuthScopes            []string
+	OAuthPostLoginRedirect string
+
+	// Embedded OpenID Connect provider
+	OIDCProviderEnabled bool
+	OIDCIssuer          string
+	OIDCClientsFile     string
+	OIDCLoginURL        string
+
+	// SAML 2.0 service provider
+	SAMLIdPMetadataFile   string
+	SAMLEntityID          string
+	SAMLMetadataURL       string
+	SAMLACSURL            string
+	SAMLKeyFile           string
+	SAMLCertFile          string
+	SAMLBinding           string
+	SAMLPostLoginRedirect string
 }
 
 func Load() *Config {
@@ -24,11 +94,72 @@ func Load() *Config {
 		MongoDBURI:        getEnv("MONGODB_URI", "mongodb://localhost:27017"),
 		MongoDBDatabase:   getEnv("MONGODB_DATABASE", "auth_demo"),
 		MongoDBCollection: getEnv("MONGODB_COLLECTION", "users"),
-		JWTSecret:         getRequiredEnv("JWT_SECRET_KEY"),
+		JWTSecret:         getEnv("JWT_SECRET_KEY", ""),
+		JWTSigningAlg:     getEnv("JWT_SIGNING_ALG", "HS256"),
+		JWTPrivateKeyFile: getEnv("JWT_PRIVATE_KEY_FILE", ""),
+		JWTKeyID:          getEnv("JWT_KEY_ID", ""),
+		JWTKeyRingFile:    getEnv("JWT_KEYRING_FILE", ""),
 		JWTExpiration:     parseDuration(getEnv("JWT_EXPIRATION", "24h")),
+		RevocationStore:   getEnv("REVOCATION_STORE", "database"),
+		StorageDriver:     getEnv("STORAGE_DRIVER", "mongo"),
+		DatabaseURL:       getEnv("DATABASE_URL", ""),
+		RateLimitStore:    getEnv("RATE_LIMIT_STORE", "memory"),
+		RedisURL:          getEnv("REDIS_URL", "redis://localhost:6379/0"),
+		RBACRolesFile:     getEnv("RBAC_ROLES_FILE", ""),
 		Port:              getEnv("PORT", "8080"),
 		Env:               getEnv("ENV", "development"),
 		AllowedOrigins:    []string{"http://localhost:3000"},
+		BaseURL:           strings.TrimSuffix(getEnv("APP_BASE_URL", "http://localhost:8080"), "/"),
+
+		PasswordHash:       getEnv("PASSWORD_HASH", "argon2id"),
+		PasswordHashParams: getEnv("PASSWORD_HASH_PARAMS", ""),
+		PasswordPepper:     getEnv("PASSWORD_PEPPER", ""),
+
+		AuditSinks:      strings.Split(getEnv("AUDIT_SINKS", "stdout"), ","),
+		AuditFile:       getEnv("AUDIT_FILE", "audit.log"),
+		AuditWebhookURL: getEnv("AUDIT_WEBHOOK_URL", ""),
+
+		LockoutThreshold:  parseInt(getEnv("LOCKOUT_THRESHOLD", "5"), 5),
+		LockoutBaseDelay:  parseDuration(getEnv("LOCKOUT_BASE_DELAY", "1s")),
+		LockoutMaxDelay:   parseDuration(getEnv("LOCKOUT_MAX_DELAY", "15m")),
+		LockoutResetAfter: parseDuration(getEnv("LOCKOUT_RESET_AFTER", "24h")),
+
+		RequireEmailVerification: getEnv("REQUIRE_EMAIL_VERIFICATION", "false") == "true",
+		PasswordMinLength:        parseInt(getEnv("PASSWORD_MIN_LENGTH", "12"), 12),
+		PasswordResetURL:         getEnv("PASSWORD_RESET_URL", "http://localhost:3000/reset-password"),
+		Mailer:                   getEnv("MAILER", "log"),
+		MFAIssuer:                getEnv("MFA_ISSUER", "Authentication Types"),
+		MagicLinkRedirect:        getEnv("MAGIC_LINK_REDIRECT", ""),
+		MailerFile:               getEnv("MAILER_FILE", "mail.log"),
+
+		WebAuthnRPID:      getEnv("WEBAUTHN_RP_ID", "localhost"),
+		WebAuthnRPName:    getEnv("WEBAUTHN_RP_NAME", "Authentication Types"),
+		WebAuthnRPOrigins: strings.Split(getEnv("WEBAUTHN_RP_ORIGINS", "http://localhost:3000"), ","),
+
+		OAuthProvider:          getEnv("OAUTH_PROVIDER", "oauth"),
+		OAuthClientID:          getEnv("OAUTH_CLIENT_ID", ""),
+		OAuthClientSecret:      getEnv("OAUTH_CLIENT_SECRET", ""),
+		OAuthAuthURL:           getEnv("OAUTH_AUTH_URL", ""),
+		OAuthTokenURL:          getEnv("OAUTH_TOKEN_URL", ""),
+		OAuthUserInfoURL:       getEnv("OAUTH_USERINFO_URL", ""),
+		OAuthIssuer:            getEnv("OAUTH_ISSUER", ""),
+		OAuthRedirectURL:       getEnv("OAUTH_REDIRECT_URL", "http://localhost:8080/api/oauth/callback"),
+		OAuthScopes:            strings.Fields(getEnv("OAUTH_SCOPES", "openid profile email")),
+		OAuthPostLoginRedirect: getEnv("OAUTH_POST_LOGIN_REDIRECT", ""),
+
+		OIDCProviderEnabled: getEnv("OIDC_PROVIDER_ENABLED", "false") == "true",
+		OIDCIssuer:          strings.TrimSuffix(getEnv("OIDC_ISSUER", "http://localhost:8080"), "/"),
+		OIDCClientsFile:     getEnv("OIDC_CLIENTS_FILE", ""),
+		OIDCLoginURL:        getEnv("OIDC_LOGIN_URL", ""),
+
+		SAMLIdPMetadataFile:   getEnv("SAML_IDP_METADATA_FILE", ""),
+		SAMLEntityID:          getEnv("SAML_SP_ENTITY_ID", ""),
+		SAMLMetadataURL:       getEnv("SAML_SP_METADATA_URL", "http://localhost:8080/api/sso/metadata"),
+		SAMLACSURL:            getEnv("SAML_SP_ACS_URL", "http://localhost:8080/api/sso/callback"),
+		SAMLKeyFile:           getEnv("SAML_SP_KEY_FILE", ""),
+		SAMLCertFile:          getEnv("SAML_SP_CERT_FILE", ""),
+		SAMLBinding:           getEnv("SAML_BINDING", "redirect"),
+		SAMLPostLoginRedirect: getEnv("SAML_POST_LOGIN_REDIRECT", ""),
 	}
 
 	if config.Env == "production" {
@@ -49,8 +180,60 @@ func (c *Config) validate() error {
 	if c.MongoDBURI == "" {
 		return fmt.Errorf("MongoDB URI is required")
 	}
-	if c.JWTSecret == "" {
-		return fmt.Errorf("JWT_SECRET_KEY environment variable is required")
+	switch {
+	case c.JWTKeyRingFile != "":
+		// Keys and algorithms come from the key ring file
+	case c.JWTSigningAlg == "HS256":
+		if c.JWTSecret == "" {
+			return fmt.Errorf("JWT_SECRET_KEY environment variable is required")
+		}
+	case c.JWTSigningAlg == "RS256", c.JWTSigningAlg == "ES256", c.JWTSigningAlg == "EdDSA":
+		if c.JWTPrivateKeyFile == "" {
+			return fmt.Errorf("JWT_PRIVATE_KEY_FILE is required for %s", c.JWTSigningAlg)
+		}
+	default:
+		return fmt.Errorf("unsupported JWT_SIGNING_ALG %q", c.JWTSigningAlg)
+	}
+	switch c.RevocationStore {
+	// mongo predates the SQL drivers and means the same as database
+	case "database", "mongo", "memory":
+	default:
+		return fmt.Errorf("REVOCATION_STORE must be database or memory")
+	}
+	switch c.StorageDriver {
+	case "mongo", "sqlite", "memory":
+	case "postgres":
+		if c.DatabaseURL == "" {
+			return fmt.Errorf("DATABASE_URL is required when STORAGE_DRIVER is postgres")
+		}
+	default:
+		return fmt.Errorf("STORAGE_DRIVER must be mongo, postgres, sqlite or memory")
+	}
+	if c.RateLimitStore != "memory" && c.RateLimitStore != "redis" {
+		return fmt.Errorf("RATE_LIMIT_STORE must be memory or redis")
+	}
+	switch c.PasswordHash {
+	case "argon2id", "scrypt", "bcrypt":
+	default:
+		return fmt.Errorf("PASSWORD_HASH must be argon2id, scrypt or bcrypt")
+	}
+	for _, sink := range c.AuditSinks {
+		switch sink {
+		case "stdout", "file", "none":
+		case "mongo":
+			if c.StorageDriver != "mongo" {
+				return fmt.Errorf("the mongo audit sink needs STORAGE_DRIVER=mongo")
+			}
+		case "webhook":
+			if c.AuditWebhookURL == "" {
+				return fmt.Errorf("AUDIT_WEBHOOK_URL is required for the webhook audit sink")
+			}
+		default:
+			return fmt.Errorf("AUDIT_SINKS may only list stdout, file, mongo, webhook or none")
+		}
+	}
+	if c.LockoutThreshold < 1 || c.LockoutBaseDelay <= 0 || c.LockoutMaxDelay < c.LockoutBaseDelay {
+		return fmt.Errorf("LOCKOUT_THRESHOLD must be at least 1 and LOCKOUT_MAX_DELAY at least LOCKOUT_BASE_DELAY")
 	}
 	if c.Port == "" {
 		return fmt.Errorf("Port is required")
@@ -66,12 +249,12 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
-func getRequiredEnv(key string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		panic(fmt.Sprintf("Required environment variable %s is not set", key))
+func parseInt(value string, defaultValue int) int {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return defaultValue
 	}
-	return value
+	return n
 }
 
 func parseDuration(value string) time.Duration {
@@ -82,6 +265,12 @@ func parseDuration(value string) time.Duration {
 	return duration
 }
 
+// OAuthEnabled reports whether enough of the OAuth client is configured to
+// run the authorization code flow.
+func (c *Config) OAuthEnabled() bool {
+	return c.OAuthClientID != "" && c.OAuthAuthURL != "" && c.OAuthTokenURL != ""
+}
+
 func (c *Config) IsDevelopment() bool {
 	return c.Env == "development"
 }
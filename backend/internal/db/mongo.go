@@ -2,33 +2,50 @@ package db
 
 import (
 	"context"
+	"fmt"
 	"log"
-	"os"
 	"time"
 
+	"github.com/NoorBnHossam/Authentication_Types/internal/config"
+	"github.com/NoorBnHossam/Authentication_Types/internal/store"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// SessionsCollection holds login sessions
+const SessionsCollection = "sessions"
+
+// TokensCollection holds opaque bearer tokens
+const TokensCollection = "tokens"
+
+// StatesCollection holds short-lived server-side state for multi-step flows
+const StatesCollection = "auth_states"
+
+// RevokedTokensCollection holds the IDs of revoked JWTs until they expire
+const RevokedTokensCollection = "revoked_tokens"
+
+// RefreshFamiliesCollection holds refresh token families for reuse detection
+const RefreshFamiliesCollection = "refresh_families"
+
+// LoginFailuresCollection holds failed login counts for account lockout
+const LoginFailuresCollection = "login_failures"
+
+// AuditEventsCollection holds security audit events
+const AuditEventsCollection = "audit_events"
+
 var (
 	Client     *mongo.Client
 	Database   *mongo.Database
 	Collection *mongo.Collection
 )
 
-// Connect establishes a connection to MongoDB
-func Connect() error {
+// Connect establishes a connection to the MongoDB server in cfg
+func Connect(cfg *config.Config) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// Get MongoDB URI from environment variable
-	uri := os.Getenv("MONGODB_URI")
-	if uri == "" {
-		uri = "mongodb://localhost:27017" // fallback to local MongoDB
-	}
-
 	// Connect to MongoDB
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.MongoDBURI))
 	if err != nil {
 		return err
 	}
@@ -39,31 +56,80 @@ func Connect() error {
 		return err
 	}
 
-	// Get database and collection names from environment variables
-	dbName := os.Getenv("MONGODB_DATABASE")
-	if dbName == "" {
-		dbName = "auth_demo" // fallback to default
-	}
-
-	collectionName := os.Getenv("MONGODB_COLLECTION")
-	if collectionName == "" {
-		collectionName = "users" // fallback to default
-	}
-
 	// Set global variables
 	Client = client
-	Database = client.Database(dbName)
-	Collection = Database.Collection(collectionName)
+	Database = client.Database(cfg.MongoDBDatabase)
+	Collection = Database.Collection(cfg.MongoDBCollection)
+
+	if err := store.EnsureMongoIndexes(ctx, collections()); err != nil {
+		return err
+	}
 
 	log.Println("Connected to MongoDB!")
 	return nil
 }
 
-// Disconnect closes the MongoDB connection
+// collections returns the collections of the connected database
+func collections() store.MongoCollections {
+	return store.MongoCollections{
+		Users:           Collection,
+		Sessions:        Database.Collection(SessionsCollection),
+		Tokens:          Database.Collection(TokensCollection),
+		States:          Database.Collection(StatesCollection),
+		RevokedTokens:   Database.Collection(RevokedTokensCollection),
+		RefreshFamilies: Database.Collection(RefreshFamiliesCollection),
+		LoginFailures:   Database.Collection(LoginFailuresCollection),
+	}
+}
+
+// Stores returns the stores for cfg.StorageDriver: mongo (the default),
+// postgres, sqlite or memory, connecting to the database first if need be.
+// With REVOCATION_STORE=memory, JWT revocations, refresh token families and
+// failed login counts are kept in process memory whatever the driver.
+func Stores(cfg *config.Config) (store.Stores, error) {
+	stores, err := driverStores(cfg)
+	if err != nil {
+		return store.Stores{}, err
+	}
+	if cfg.RevocationStore == "memory" {
+		memory := store.NewMemory()
+		stores.Revocations = memory.Revocations
+		stores.RefreshFamilies = memory.RefreshFamilies
+		stores.Lockouts = memory.Lockouts
+	}
+	return stores, nil
+}
+
+func driverStores(cfg *config.Config) (store.Stores, error) {
+	switch driver := cfg.StorageDriver; driver {
+	case "", "mongo":
+		if Client == nil {
+			if err := Connect(cfg); err != nil {
+				return store.Stores{}, err
+			}
+		}
+		return store.NewMongo(collections()), nil
+	case "postgres", "sqlite":
+		if SQL == nil {
+			if err := ConnectSQL(cfg, driver); err != nil {
+				return store.Stores{}, err
+			}
+		}
+		return store.NewSQL(SQL, driver), nil
+	case "memory":
+		return store.NewMemory(), nil
+	}
+	return store.Stores{}, fmt.Errorf("unsupported STORAGE_DRIVER %q", cfg.StorageDriver)
+}
+
+// Disconnect closes the database connections
 func Disconnect() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	if SQL != nil {
+		SQL.Close()
+	}
 	if Client != nil {
 		return Client.Disconnect(ctx)
 	}
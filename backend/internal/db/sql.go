@@ -0,0 +1,54 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/config"
+	"github.com/NoorBnHossam/Authentication_Types/internal/store"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// SQL is the database holding users, sessions and tokens when STORAGE_DRIVER
+// is postgres or sqlite
+var SQL *sql.DB
+
+// ConnectSQL opens the database at cfg.DatabaseURL with the given driver,
+// "postgres" or "sqlite", and applies pending migrations
+func ConnectSQL(cfg *config.Config, driver string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dsn := cfg.DatabaseURL
+	if dsn == "" {
+		if driver != "sqlite" {
+			return fmt.Errorf("DATABASE_URL is required for %s", driver)
+		}
+		dsn = "auth.db" // fallback to a local file
+	}
+
+	database, err := sql.Open(driver, dsn)
+	if err != nil {
+		return err
+	}
+	if driver == "sqlite" {
+		// SQLite allows one writer at a time; a single connection avoids
+		// "database is locked" errors and keeps :memory: databases shared
+		database.SetMaxOpenConns(1)
+	}
+
+	if err := database.PingContext(ctx); err != nil {
+		database.Close()
+		return err
+	}
+	if err := store.Migrate(ctx, database, driver); err != nil {
+		database.Close()
+		return err
+	}
+
+	SQL = database
+	return nil
+}
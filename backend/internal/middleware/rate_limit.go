@@ -1,59 +1,315 @@
 package middleware
 
 import (
+	"context"
+	"fmt"
+	"log"
 	"net/http"
+	"path"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/NoorBnHossam/Authentication_Types/internal/config"
 	"github.com/gin-gonic/gin"
 )
 
-// RateLimiter implements a basic in-memory rate limiting mechanism
-//  Note ⚠️ in production it's recommended to use Redis or another centralized
-// store to support horizontal scaling and better memory management
+// Policy allows Limit requests per Period for each identity Key returns,
+// using the generic cell rate algorithm (GCRA). Only the next allowed arrival
+// time is stored per identity, so memory does not grow with traffic.
+type Policy struct {
+	// Name scopes the policy's counters in the store, e.g. "login_ip"
+	Name   string
+	Limit  int
+	Period time.Duration
+	// Burst is how many requests may arrive at once after a quiet period.
+	// It defaults to Limit.
+	Burst int
+	// Key returns the identity the limit applies to. Requests it returns ""
+	// for are not limited by the policy. It defaults to ByIP.
+	Key KeyFunc
+	// Routes restricts the policy to routes whose pattern, as in
+	// c.FullPath(), matches one of these path.Match patterns. An empty list
+	// applies the policy to every route.
+	Routes []string
+}
+
+// Result is the outcome of one request against a policy
+type Result struct {
+	Allowed bool
+	// Remaining is how many more requests would be allowed right now
+	Remaining int
+	// ResetAfter is the time until the full burst is available again
+	ResetAfter time.Duration
+	// RetryAfter is the time until the next request would be allowed. It is
+	// zero for allowed requests.
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps GCRA state for rate limiters. Implementations must be
+// safe for concurrent use.
+type RateLimitStore interface {
+	// Take spends one request from key's allowance, where a request is
+	// earned every interval and up to burst can be saved up
+	Take(ctx context.Context, key string, interval time.Duration, burst int) (Result, error)
+	// Peek reports what Take would return without spending anything
+	Peek(ctx context.Context, key string, interval time.Duration, burst int) (Result, error)
+}
 
+// RateLimiter applies a set of policies. Every matching policy must allow a
+// request for it to go through.
 type RateLimiter struct {
-	requests map[string][]time.Time
-	mu       sync.Mutex
-	limit    int
-	window   time.Duration
+	policies []Policy
+	// store is nil for limiters using the configured default
+	store RateLimitStore
 }
 
-func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
-	return &RateLimiter{
-		requests: make(map[string][]time.Time),
-		limit:    limit,
-		window:   window,
+// NewRateLimiter returns a limiter backed by the store set with
+// UseRateLimitStore. It panics on a policy without a name, limit or period,
+// or on a name used twice.
+func NewRateLimiter(policies ...Policy) *RateLimiter {
+	return NewRateLimiterWithStore(nil, policies...)
+}
+
+// NewRateLimiterWithStore returns a limiter backed by store
+func NewRateLimiterWithStore(store RateLimitStore, policies ...Policy) *RateLimiter {
+	seen := make(map[string]bool)
+	for i := range policies {
+		p := &policies[i]
+		if p.Name == "" || p.Limit <= 0 || p.Period <= 0 {
+			panic(fmt.Sprintf("middleware: invalid rate limit policy %+v", *p))
+		}
+		if seen[p.Name] {
+			panic(fmt.Sprintf("middleware: rate limit policy %q defined twice", p.Name))
+		}
+		seen[p.Name] = true
+		if p.Burst <= 0 {
+			p.Burst = p.Limit
+		}
+		if p.Key == nil {
+			p.Key = ByIP
+		}
 	}
+	return &RateLimiter{policies: policies, store: store}
 }
 
 func (rl *RateLimiter) RateLimit() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		ip := c.ClientIP()
-
-		rl.mu.Lock()
-		defer rl.mu.Unlock()
-
-		now := time.Now()
-		windowStart := now.Add(-rl.window)
-
-		var validRequests []time.Time
-		for _, t := range rl.requests[ip] {
-			if t.After(windowStart) {
-				validRequests = append(validRequests, t)
+		allowed := rl.check(c, func(p Policy) string {
+			if !p.matches(c.FullPath()) {
+				return ""
 			}
-		}
-		rl.requests[ip] = validRequests
-
-		if len(validRequests) >= rl.limit {
+			return p.Key(c)
+		})
+		if !allowed {
 			c.JSON(http.StatusTooManyRequests, gin.H{
 				"error": "Rate limit exceeded. Please try again later.",
 			})
 			c.Abort()
 			return
 		}
-
-		rl.requests[ip] = append(rl.requests[ip], now)
 		c.Next()
 	}
 }
+
+// AllowKey records a request for key under every policy, ignoring their Key
+// and Routes, for handlers that limit on something only they can extract,
+// such as a submitted email address. It sets the rate limit headers and
+// reports whether all policies allow the request.
+func (rl *RateLimiter) AllowKey(c *gin.Context, key string) bool {
+	return rl.check(c, func(Policy) string { return key })
+}
+
+// check applies each policy to the key keyOf returns for it, skipping
+// policies with no key. Every policy is checked before any is charged, so a
+// request one policy refuses does not use up the allowance of the others.
+// The headers describe the refusing policy, or else the one closest to its
+// limit.
+func (rl *RateLimiter) check(c *gin.Context, keyOf func(Policy) string) bool {
+	ctx := c.Request.Context()
+	var applicable []Policy
+	var keys []string
+	for _, p := range rl.policies {
+		if key := keyOf(p); key != "" {
+			applicable = append(applicable, p)
+			keys = append(keys, key)
+		}
+	}
+	if len(applicable) == 0 {
+		return true
+	}
+
+	for i, p := range applicable {
+		if r := rl.apply(ctx, p, keys[i], false); !r.Allowed {
+			SetRateLimitHeaders(c, p.Burst, r)
+			return false
+		}
+	}
+
+	// A concurrent request can still spend the last of an allowance between
+	// the check and the charge; the charge then refuses this one
+	var reported Policy
+	var result Result
+	for i, p := range applicable {
+		r := rl.apply(ctx, p, keys[i], true)
+		if i == 0 || !r.Allowed || r.Remaining < result.Remaining {
+			reported, result = p, r
+		}
+		if !r.Allowed {
+			break
+		}
+	}
+	SetRateLimitHeaders(c, reported.Burst, result)
+	return result.Allowed
+}
+
+// apply checks the policy for key and, if charge is set, spends a request.
+// If the store cannot be reached the request is allowed, so an outage of the
+// store does not take the service down with it.
+func (rl *RateLimiter) apply(ctx context.Context, p Policy, key string, charge bool) Result {
+	store := rl.store
+	if store == nil {
+		store = defaultRateLimitStore()
+	}
+
+	op := store.Peek
+	if charge {
+		op = store.Take
+	}
+	result, err := op(ctx, p.Name+":"+key, p.Period/time.Duration(p.Limit), p.Burst)
+	if err != nil {
+		log.Printf("[RateLimit] Error checking policy %s: %v", p.Name, err)
+		return Result{Allowed: true, Remaining: p.Burst}
+	}
+	return result
+}
+
+// SetRateLimitHeaders describes a limit to the client with the IETF
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers, plus
+// Retry-After when the request was refused. Times are in whole seconds,
+// rounded up so clients never retry early.
+func SetRateLimitHeaders(c *gin.Context, limit int, result Result) {
+	c.Header("RateLimit-Limit", strconv.Itoa(limit))
+	c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.ResetAfter)))
+	if !result.Allowed {
+		retryAfter := ceilSeconds(result.RetryAfter)
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+func (p Policy) matches(route string) bool {
+	if len(p.Routes) == 0 {
+		return true
+	}
+	for _, pattern := range p.Routes {
+		if ok, _ := path.Match(pattern, route); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// gcra applies one request to the theoretical arrival time tat and returns
+// the new one. The Redis store runs the same steps in Lua.
+func gcra(tat, now time.Time, interval time.Duration, burst int) (time.Time, Result) {
+	if tat.Before(now) {
+		tat = now
+	}
+	newTAT := tat.Add(interval)
+	allowAt := newTAT.Add(-interval * time.Duration(burst))
+
+	if now.Before(allowAt) {
+		return tat, Result{
+			ResetAfter: tat.Sub(now),
+			RetryAfter: allowAt.Sub(now),
+		}
+	}
+	return newTAT, Result{
+		Allowed:    true,
+		Remaining:  int(now.Sub(allowAt) / interval),
+		ResetAfter: newTAT.Sub(now),
+	}
+}
+
+// MemoryRateLimitStore keeps GCRA state in process memory. It is only
+// suitable for a single instance.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	tats      map[string]time.Time
+	lastSweep time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{tats: make(map[string]time.Time), lastSweep: time.Now()}
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, interval time.Duration, burst int) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	// Identities whose allowance has fully recovered need no state
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, tat := range s.tats {
+			if !tat.After(now) {
+				delete(s.tats, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	tat, result := gcra(s.tats[key], now, interval, burst)
+	s.tats[key] = tat
+	return result, nil
+}
+
+func (s *MemoryRateLimitStore) Peek(ctx context.Context, key string, interval time.Duration, burst int) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, result := gcra(s.tats[key], time.Now(), interval, burst)
+	return result, nil
+}
+
+var (
+	rateLimitStoreMu sync.RWMutex
+	rateLimitStore   RateLimitStore = NewMemoryRateLimitStore()
+)
+
+// OpenRateLimitStore returns the store selected with RATE_LIMIT_STORE. The
+// Redis store is pinged, so an unreachable server is reported here rather
+// than on the first request.
+func OpenRateLimitStore(cfg *config.Config) (RateLimitStore, error) {
+	if cfg.RateLimitStore != "redis" {
+		return NewMemoryRateLimitStore(), nil
+	}
+	store, err := NewRedisRateLimitStoreFromURL(cfg.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to Redis: %w", err)
+	}
+	return store, nil
+}
+
+// UseRateLimitStore sets the store shared by every limiter created with
+// NewRateLimiter. Until it is called they share an in-memory store. Call it
+// before the router serves requests.
+func UseRateLimitStore(store RateLimitStore) {
+	rateLimitStoreMu.Lock()
+	defer rateLimitStoreMu.Unlock()
+	rateLimitStore = store
+}
+
+func defaultRateLimitStore() RateLimitStore {
+	rateLimitStoreMu.RLock()
+	defer rateLimitStoreMu.RUnlock()
+	return rateLimitStore
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+// KeyFunc returns the identity a rate limit policy applies to, or "" to
+// leave the request alone
+type KeyFunc func(c *gin.Context) string
+
+// ByIP limits each client IP address
+func ByIP(c *gin.Context) string {
+	return c.ClientIP()
+}
+
+// ByUser limits each authenticated user. The policy has to run after an
+// authentication middleware.
+func ByUser(c *gin.Context) string {
+	value, exists := c.Get("user")
+	if !exists {
+		return ""
+	}
+	user, ok := value.(models.User)
+	if !ok {
+		return ""
+	}
+	return user.ID.Hex()
+}
+
+// ByUsername limits each username a login is attempted for, whatever the
+// client's address. The username comes from HTTP Basic credentials or the
+// "username" field of a JSON body.
+func ByUsername(c *gin.Context) string {
+	if username, _, ok := c.Request.BasicAuth(); ok {
+		return normalizeUsername(username)
+	}
+	if c.Request.Body == nil || !strings.HasPrefix(c.ContentType(), "application/json") {
+		return ""
+	}
+
+	// Peek at the body and put it back for the handler
+	original := c.Request.Body
+	peeked, err := io.ReadAll(io.LimitReader(original, 64<<10))
+	c.Request.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(peeked), original), original}
+	if err != nil {
+		return ""
+	}
+
+	var body struct {
+		Username string `json:"username"`
+	}
+	if json.Unmarshal(peeked, &body) != nil {
+		return ""
+	}
+	return normalizeUsername(body.Username)
+}
+
+// ByAPIKey limits each credential sent in the named header, or in the
+// Authorization header when header is "". Keys are hashed so credentials
+// are not written to the rate limit store.
+func ByAPIKey(header string) KeyFunc {
+	return func(c *gin.Context) string {
+		var value string
+		if header == "" {
+			value = c.GetHeader("Authorization")
+		} else {
+			value = c.GetHeader(header)
+		}
+		if value == "" {
+			return ""
+		}
+		sum := sha256.Sum256([]byte(value))
+		return hex.EncodeToString(sum[:16])
+	}
+}
+
+// normalizeUsername folds case so "Alice" and "alice" share one allowance
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
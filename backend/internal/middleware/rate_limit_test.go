@@ -0,0 +1,190 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/config"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func newMiniredisStore(t *testing.T) (*RedisRateLimitStore, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewRedisRateLimitStore(client), server
+}
+
+func TestRateLimitStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) RateLimitStore{
+		"memory": func(t *testing.T) RateLimitStore { return NewMemoryRateLimitStore() },
+		"redis": func(t *testing.T) RateLimitStore {
+			store, _ := newMiniredisStore(t)
+			return store
+		},
+	}
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := open(t)
+			const interval = 200 * time.Millisecond
+
+			// Peeking spends nothing
+			for i := 0; i < 5; i++ {
+				result, err := store.Peek(ctx, "k", interval, 3)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !result.Allowed || result.Remaining != 2 {
+					t.Fatalf("Peek = %+v, want allowed with 2 remaining", result)
+				}
+			}
+
+			for want := 2; want >= 0; want-- {
+				result, err := store.Take(ctx, "k", interval, 3)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !result.Allowed || result.Remaining != want {
+					t.Fatalf("Take = %+v, want allowed with %d remaining", result, want)
+				}
+			}
+
+			result, err := store.Take(ctx, "k", interval, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Allowed || result.RetryAfter <= 0 || result.RetryAfter > interval {
+				t.Fatalf("Take over the burst = %+v, want refused within %s", result, interval)
+			}
+			if peeked, _ := store.Peek(ctx, "k", interval, 3); peeked.Allowed {
+				t.Fatalf("Peek over the burst = %+v, want refused", peeked)
+			}
+
+			// Other keys have their own allowance
+			if result, _ := store.Take(ctx, "other", interval, 3); !result.Allowed {
+				t.Fatalf("Take on another key = %+v, want allowed", result)
+			}
+
+			// One request is earned back every interval
+			time.Sleep(interval + 20*time.Millisecond)
+			result, err = store.Take(ctx, "k", interval, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Allowed || result.Remaining != 0 {
+				t.Fatalf("Take after an interval = %+v, want allowed with 0 remaining", result)
+			}
+		})
+	}
+}
+
+func TestRateLimiterRefusalChargesNoPolicy(t *testing.T) {
+	stores := map[string]func(t *testing.T) RateLimitStore{
+		"memory": func(t *testing.T) RateLimitStore { return NewMemoryRateLimitStore() },
+		"redis": func(t *testing.T) RateLimitStore {
+			store, _ := newMiniredisStore(t)
+			return store
+		},
+	}
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			limiter := NewRateLimiterWithStore(store,
+				Policy{Name: "wide", Limit: 5, Period: time.Minute},
+				Policy{Name: "narrow", Limit: 1, Period: time.Minute},
+			)
+
+			for i := 0; i < 3; i++ {
+				c, _ := gin.CreateTestContext(httptest.NewRecorder())
+				c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+				if allowed := limiter.AllowKey(c, "k"); allowed != (i == 0) {
+					t.Fatalf("request %d: allowed = %t", i+1, allowed)
+				}
+			}
+
+			// Only the request both policies allowed was charged to wide
+			result, err := store.Peek(context.Background(), "wide:k", time.Minute/5, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Remaining != 3 {
+				t.Fatalf("wide has %d remaining, want 3 after one allowed request", result.Remaining)
+			}
+		})
+	}
+}
+
+func TestRedisRateLimitStoreExpiresKeys(t *testing.T) {
+	store, server := newMiniredisStore(t)
+	if _, err := store.Take(context.Background(), "k", time.Second, 5); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("ratelimit:k"); ttl <= 0 || ttl > time.Second {
+		t.Fatalf("TTL = %s, want until the allowance recovers", ttl)
+	}
+}
+
+func TestOpenRateLimitStore(t *testing.T) {
+	store, err := OpenRateLimitStore(&config.Config{RateLimitStore: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.(*MemoryRateLimitStore); !ok {
+		t.Fatalf("memory store = %T", store)
+	}
+
+	server := miniredis.RunT(t)
+	url := "redis://" + server.Addr() + "/0"
+	store, err = OpenRateLimitStore(&config.Config{RateLimitStore: "redis", RedisURL: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.(*RedisRateLimitStore); !ok {
+		t.Fatalf("redis store = %T", store)
+	}
+
+	server.Close()
+	if _, err := OpenRateLimitStore(&config.Config{RateLimitStore: "redis", RedisURL: url}); err == nil {
+		t.Fatal("OpenRateLimitStore succeeded with Redis down")
+	}
+}
+
+func TestRateLimiterWithRedis(t *testing.T) {
+	store, server := newMiniredisStore(t)
+	limiter := NewRateLimiterWithStore(store, Policy{Name: "test", Limit: 2, Period: time.Minute})
+	router := gin.New()
+	router.GET("/", limiter.RateLimit(), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := get(); w.Code != http.StatusNoContent {
+			t.Fatalf("request %d: status %d", i+1, w.Code)
+		}
+	}
+	w := get()
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("request over the limit: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// An unreachable store lets requests through
+	server.Close()
+	if w := get(); w.Code != http.StatusNoContent {
+		t.Fatalf("request with Redis down: status %d", w.Code)
+	}
+}
@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Throttler limits attempts at something sensitive, such as redeeming a
+// token or guessing a code. Each key gets Threshold attempts per Window,
+// counted from its first attempt. The attempt that exceeds the threshold is
+// refused and bans the key for Ban, after which it starts a fresh window.
+//
+// State is kept in process memory behind a mutex, so a Throttler is safe for
+// concurrent use but each instance of the service counts separately.
+type Throttler struct {
+	threshold int
+	window    time.Duration
+	ban       time.Duration
+
+	mu        sync.Mutex
+	attempts  map[string]*throttleEntry
+	lastSweep time.Time
+}
+
+type throttleEntry struct {
+	count       int
+	windowStart time.Time
+	bannedUntil time.Time
+}
+
+// NewThrottler returns a throttler allowing threshold attempts per window
+// and banning keys that exceed it for ban. It panics on non-positive values.
+func NewThrottler(threshold int, window, ban time.Duration) *Throttler {
+	if threshold <= 0 || window <= 0 || ban <= 0 {
+		panic(fmt.Sprintf("middleware: invalid throttler %d per %s, ban %s", threshold, window, ban))
+	}
+	return &Throttler{
+		threshold: threshold,
+		window:    window,
+		ban:       ban,
+		attempts:  make(map[string]*throttleEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// Attempt records an attempt for key and reports whether it is allowed
+func (t *Throttler) Attempt(key string) Result {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.sweep(now)
+
+	entry, ok := t.attempts[key]
+	if !ok {
+		entry = &throttleEntry{windowStart: now}
+		t.attempts[key] = entry
+	}
+
+	if now.Before(entry.bannedUntil) {
+		wait := entry.bannedUntil.Sub(now)
+		return Result{ResetAfter: wait, RetryAfter: wait}
+	}
+	// A served ban starts a fresh window, or the first attempt after it would
+	// be banned again
+	if !entry.bannedUntil.IsZero() || now.Sub(entry.windowStart) >= t.window {
+		entry.count = 0
+		entry.windowStart = now
+		entry.bannedUntil = time.Time{}
+	}
+
+	entry.count++
+	if entry.count > t.threshold {
+		entry.bannedUntil = now.Add(t.ban)
+		return Result{ResetAfter: t.ban, RetryAfter: t.ban}
+	}
+	return Result{
+		Allowed:    true,
+		Remaining:  t.threshold - entry.count,
+		ResetAfter: entry.windowStart.Add(t.window).Sub(now),
+	}
+}
+
+// Reset forgets the attempts for key, e.g. after one succeeded. It does not
+// lift a ban.
+func (t *Throttler) Reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if entry, ok := t.attempts[key]; ok && !time.Now().Before(entry.bannedUntil) {
+		delete(t.attempts, key)
+	}
+}
+
+// AllowKey records an attempt for key, sets the rate limit headers and
+// reports whether the attempt is allowed
+func (t *Throttler) AllowKey(c *gin.Context, key string) bool {
+	result := t.Attempt(key)
+	SetRateLimitHeaders(c, t.threshold, result)
+	return result.Allowed
+}
+
+// Throttle is middleware that throttles requests by the key function, e.g.
+// ByIP. Requests the function returns "" for are not counted.
+func (t *Throttler) Throttle(key KeyFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		k := key(c)
+		if k != "" && !t.AllowKey(c, k) {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts. Please try again later."})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// sweep drops keys whose window has passed and that are not banned, at most
+// once a window. The caller holds t.mu.
+func (t *Throttler) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.window {
+		return
+	}
+	for key, entry := range t.attempts {
+		if now.Sub(entry.windowStart) >= t.window && !now.Before(entry.bannedUntil) {
+			delete(t.attempts, key)
+		}
+	}
+	t.lastSweep = now
+}
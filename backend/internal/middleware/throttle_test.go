@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// attemptConcurrently makes attempts for each key from workers goroutines
+// and returns how many were allowed per key
+func attemptConcurrently(th *Throttler, keys []string, workers, attempts int) map[string]int {
+	var (
+		mu      sync.Mutex
+		allowed = make(map[string]int)
+		wg      sync.WaitGroup
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < attempts; i++ {
+				for _, key := range keys {
+					if th.Attempt(key).Allowed {
+						mu.Lock()
+						allowed[key]++
+						mu.Unlock()
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return allowed
+}
+
+func (t *Throttler) size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.attempts)
+}
+
+func TestThrottlerLimitUnderConcurrency(t *testing.T) {
+	th := NewThrottler(25, time.Minute, time.Minute)
+	keys := []string{"a", "b", "c"}
+
+	allowed := attemptConcurrently(th, keys, 16, 20)
+	for _, key := range keys {
+		if allowed[key] != 25 {
+			t.Errorf("key %s: %d attempts allowed, want 25", key, allowed[key])
+		}
+	}
+
+	result := th.Attempt("a")
+	if result.Allowed || result.RetryAfter <= 0 || result.RetryAfter > time.Minute {
+		t.Fatalf("attempt while banned = %+v", result)
+	}
+}
+
+func TestThrottlerWindowReset(t *testing.T) {
+	const window = 100 * time.Millisecond
+	th := NewThrottler(4, window, time.Hour)
+
+	if allowed := attemptConcurrently(th, []string{"k"}, 4, 1)["k"]; allowed != 4 {
+		t.Fatalf("%d attempts allowed in the first window, want 4", allowed)
+	}
+
+	// Staying within the threshold never bans, so the next window starts
+	// with a full allowance
+	time.Sleep(window + 20*time.Millisecond)
+	if allowed := attemptConcurrently(th, []string{"k"}, 8, 1)["k"]; allowed != 4 {
+		t.Fatalf("%d attempts allowed in the second window, want 4", allowed)
+	}
+
+	// The fifth attempt was refused and banned the key past later windows
+	time.Sleep(window + 20*time.Millisecond)
+	if th.Attempt("k").Allowed {
+		t.Fatal("banned key allowed after the window")
+	}
+}
+
+func TestThrottlerBanExpires(t *testing.T) {
+	const ban = 100 * time.Millisecond
+	th := NewThrottler(1, time.Hour, ban)
+
+	th.Attempt("k")
+	if th.Attempt("k").Allowed {
+		t.Fatal("attempt over the threshold allowed")
+	}
+	th.Reset("k")
+	if th.Attempt("k").Allowed {
+		t.Fatal("Reset lifted a ban")
+	}
+
+	time.Sleep(ban + 20*time.Millisecond)
+	if result := th.Attempt("k"); !result.Allowed || result.Remaining != 0 {
+		t.Fatalf("attempt after the ban = %+v, want a fresh window", result)
+	}
+}
+
+func TestThrottlerReset(t *testing.T) {
+	th := NewThrottler(2, time.Hour, time.Hour)
+	th.Attempt("k")
+	th.Attempt("k")
+	th.Reset("k")
+	if result := th.Attempt("k"); !result.Allowed || result.Remaining != 1 {
+		t.Fatalf("attempt after Reset = %+v, want a fresh window", result)
+	}
+}
+
+func TestThrottlerSweep(t *testing.T) {
+	const window = 50 * time.Millisecond
+	th := NewThrottler(1, window, time.Hour)
+
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprint("key-", i)
+	}
+	attemptConcurrently(th, keys, 8, 1)
+	if n := th.size(); n != len(keys) {
+		t.Fatalf("%d keys tracked, want %d", n, len(keys))
+	}
+
+	// Once a window has passed the next attempt drops every key that is not
+	// banned. Each key saw 8 attempts, so all are banned and kept.
+	time.Sleep(window + 20*time.Millisecond)
+	th.Attempt("fresh")
+	if n := th.size(); n != len(keys)+1 {
+		t.Fatalf("%d keys tracked after sweeping banned keys, want %d", n, len(keys)+1)
+	}
+
+	quiet := NewThrottler(100, window, time.Hour)
+	attemptConcurrently(quiet, keys, 8, 1)
+	time.Sleep(window + 20*time.Millisecond)
+	quiet.Attempt("fresh")
+	if n := quiet.size(); n != 1 {
+		t.Fatalf("%d keys tracked after the sweep, want 1", n)
+	}
+}
+
+func TestThrottleMiddleware(t *testing.T) {
+	th := NewThrottler(10, time.Minute, time.Minute)
+	router := gin.New()
+	router.GET("/", th.Throttle(ByIP), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	var allowed, refused atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			switch w.Code {
+			case http.StatusNoContent:
+				allowed.Add(1)
+			case http.StatusTooManyRequests:
+				if w.Header().Get("Retry-After") == "" {
+					t.Error("refused request has no Retry-After")
+				}
+				refused.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed.Load() != 10 || refused.Load() != 20 {
+		t.Fatalf("%d allowed and %d refused, want 10 and 20", allowed.Load(), refused.Load())
+	}
+}
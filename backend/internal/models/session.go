@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// Session is a server-side login session, identified by the session cookie
+type Session struct {
+	ID     string `bson:"_id"`
+	UserID string `bson:"user_id"`
+	// AuthMethod records which login flow created the session
+	AuthMethod   string    `bson:"auth_method,omitempty"`
+	UserAgent    string    `bson:"user_agent"`
+	IPAddress    string    `bson:"ip_address"`
+	LastActivity time.Time `bson:"last_activity"`
+	CreatedAt    time.Time `bson:"created_at"`
+	ExpiresAt    time.Time `bson:"expires_at"`
+	IsValid      bool      `bson:"is_valid"`
+}
+
+// Token is an opaque bearer token
+type Token struct {
+	Value     string    `bson:"value"`
+	UserID    string    `bson:"user_id"`
+	CreatedAt time.Time `bson:"created_at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
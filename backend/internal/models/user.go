@@ -15,16 +15,55 @@ type User struct {
 	Role      string             `bson:"role" json:"role"`
 	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
 	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+
+	EmailVerified bool `bson:"email_verified" json:"email_verified"`
+
+	// TOTP multi-factor authentication. Recovery codes are stored hashed.
+	MFAEnabled        bool     `bson:"mfa_enabled" json:"mfa_enabled"`
+	TOTPSecret        string   `bson:"totp_secret,omitempty" json:"-"`
+	TOTPPendingSecret string   `bson:"totp_pending_secret,omitempty" json:"-"`
+	TOTPLastStep      int64    `bson:"totp_last_step,omitempty" json:"-"`
+	RecoveryCodes     []string `bson:"recovery_codes,omitempty" json:"-"`
+
+	// WebAuthnID is the random user handle given to authenticators
+	WebAuthnID          []byte               `bson:"webauthn_id,omitempty" json:"-"`
+	WebAuthnCredentials []WebAuthnCredential `bson:"webauthn_credentials,omitempty" json:"-"`
+
+	// Identities links the user to accounts at external identity providers
+	Identities []Identity `bson:"identities,omitempty" json:"-"`
+}
+
+// Identity is an account at an external identity provider
+type Identity struct {
+	Provider string `bson:"provider" json:"provider"`
+	Subject  string `bson:"subject" json:"subject"`
+}
+
+// WebAuthnCredential is a registered passkey or security key
+type WebAuthnCredential struct {
+	ID              []byte    `bson:"id" json:"id"`
+	PublicKey       []byte    `bson:"public_key" json:"-"`
+	AttestationType string    `bson:"attestation_type" json:"attestation_type"`
+	Transports      []string  `bson:"transports,omitempty" json:"transports,omitempty"`
+	AAGUID          []byte    `bson:"aaguid,omitempty" json:"aaguid,omitempty"`
+	SignCount       uint32    `bson:"sign_count" json:"sign_count"`
+	UserVerified    bool      `bson:"user_verified" json:"user_verified"`
+	BackupEligible  bool      `bson:"backup_eligible" json:"backup_eligible"`
+	BackupState     bool      `bson:"backup_state" json:"backup_state"`
+	CreatedAt       time.Time `bson:"created_at" json:"created_at"`
+	LastUsedAt      time.Time `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
 }
 
 // UserResponse represents the user data that will be sent to the client
 type UserResponse struct {
-	ID        string    `json:"id"`
-	Username  string    `json:"username"`
-	Email     string    `json:"email"`
-	Role      string    `json:"role"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID            string    `json:"id"`
+	Username      string    `json:"username"`
+	Email         string    `json:"email"`
+	EmailVerified bool      `json:"email_verified"`
+	MFAEnabled    bool      `json:"mfa_enabled"`
+	Role          string    `json:"role"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
 }
 
 // LoginRequest represents the login request body
@@ -33,14 +72,47 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required"`
 }
 
+// RegisterRequest represents the registration request body
+type RegisterRequest struct {
+	Username string `json:"username" binding:"required,min=3,max=32"`
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required"`
+}
+
+// ForgotPasswordRequest identifies the account to reset by username or email
+type ForgotPasswordRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// ResetPasswordRequest represents the password reset request body
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// MFAVerifyRequest completes a login that requires a second factor. Code is
+// either a TOTP code or a recovery code.
+type MFAVerifyRequest struct {
+	Ticket string `json:"mfa_ticket" binding:"required"`
+	Code   string `json:"code" binding:"required"`
+}
+
+// MFACodeRequest carries a TOTP code for enrollment changes
+type MFACodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
 // ToResponse converts a User to UserResponse
 func (u *User) ToResponse() UserResponse {
 	return UserResponse{
-		ID:        u.ID.Hex(),
-		Username:  u.Username,
-		Email:     u.Email,
-		Role:      u.Role,
-		CreatedAt: u.CreatedAt,
-		UpdatedAt: u.UpdatedAt,
+		ID:            u.ID.Hex(),
+		Username:      u.Username,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+		MFAEnabled:    u.MFAEnabled,
+		Role:          u.Role,
+		CreatedAt:     u.CreatedAt,
+		UpdatedAt:     u.UpdatedAt,
 	}
 }
@@ -0,0 +1,61 @@
+package password
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcryptAlgorithm hashes with bcrypt, encoded as $bcrypt$r=<cost>$salt$hash.
+// The salt and hash keep bcrypt's own base64 alphabet so they can be put
+// back into the $2a$ form the bcrypt package reads.
+type bcryptAlgorithm struct {
+	cost int
+}
+
+func newBcrypt(params []param) (*bcryptAlgorithm, error) {
+	cost, err := intParam(params, "r", 12)
+	if err != nil {
+		return nil, err
+	}
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, errInvalidParams("bcrypt", fmt.Sprintf("r must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost))
+	}
+	return &bcryptAlgorithm{cost: cost}, nil
+}
+
+func (b *bcryptAlgorithm) hash(password []byte, extra []param) (string, error) {
+	encoded, err := bcrypt.GenerateFromPassword(password, b.cost)
+	if err != nil {
+		return "", err
+	}
+	// $2a$12$ followed by 22 characters of salt and 31 of hash
+	fields := strings.Split(string(encoded), "$")
+	saltAndHash := fields[len(fields)-1]
+	return encodePHC("bcrypt", "", append([]param{{"r", strconv.Itoa(b.cost)}}, extra...),
+		saltAndHash[:22], saltAndHash[22:]), nil
+}
+
+func (b *bcryptAlgorithm) verify(password []byte, h phc) (bool, error) {
+	stored, err := newBcrypt(h.params)
+	if err != nil || len(h.salt) != 22 || len(h.hash) != 31 {
+		return false, ErrUnsupported
+	}
+
+	encoded := fmt.Sprintf("$2a$%02d$%s%s", stored.cost, h.salt, h.hash)
+	err = bcrypt.CompareHashAndPassword([]byte(encoded), password)
+	switch err {
+	case nil:
+		return true, nil
+	case bcrypt.ErrMismatchedHashAndPassword:
+		return false, nil
+	}
+	return false, err
+}
+
+func (b *bcryptAlgorithm) current(h phc) bool {
+	stored, err := newBcrypt(h.params)
+	return err == nil && stored.cost == b.cost
+}
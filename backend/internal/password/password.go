@@ -0,0 +1,338 @@
+// Package password hashes and verifies passwords. Hashes are PHC strings
+// (https://github.com/P-H-C/phc-string-format), so each one records the
+// algorithm and parameters it was made with and old hashes keep working
+// after the policy changes.
+package password
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrUnsupported means a hash is malformed or uses an unknown algorithm
+	ErrUnsupported = errors.New("password: unsupported hash format")
+	// ErrPepperMissing means a hash was made with a pepper that is not
+	// configured
+	ErrPepperMissing = errors.New("password: hash requires a pepper")
+)
+
+// Policy is how new passwords are hashed
+type Policy struct {
+	// Algorithm is argon2id, scrypt or bcrypt
+	Algorithm string
+	// Params overrides the algorithm's default parameters, written as in a
+	// PHC string, e.g. "m=65536,t=3,p=2" for argon2id, "ln=15,r=8,p=1" for
+	// scrypt or "r=12" for bcrypt
+	Params string
+	// Pepper is a server-side secret mixed into every new hash with
+	// HMAC-SHA256. Hashes made with it cannot be verified without it.
+	Pepper []byte
+}
+
+// algorithm is one hashing scheme. Verification uses the parameters stored
+// in the hash; the receiver's parameters are only used for new hashes.
+type algorithm interface {
+	// hash returns the PHC string for password, with extra appended to the
+	// parameters
+	hash(password []byte, extra []param) (string, error)
+	verify(password []byte, h phc) (bool, error)
+	// current reports whether h was made with the receiver's parameters
+	current(h phc) bool
+}
+
+// Hasher hashes passwords under a policy and verifies hashes made under any
+// earlier one. It is safe for concurrent use.
+type Hasher struct {
+	name    string
+	current algorithm
+	pepper  []byte
+
+	// dummy is a hash of a random secret under the current policy, for
+	// VerifyDummy
+	dummy string
+	// cost is a moving average of how long checking a hash under the
+	// current policy takes, in nanoseconds
+	cost atomic.Int64
+}
+
+// New returns a hasher for policy
+func New(policy Policy) (*Hasher, error) {
+	params, err := parseParams(policy.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	var current algorithm
+	switch policy.Algorithm {
+	case "argon2id":
+		current, err = newArgon2id(params)
+	case "scrypt":
+		current, err = newScrypt(params)
+	case "bcrypt":
+		current, err = newBcrypt(params)
+	default:
+		return nil, fmt.Errorf("password: unsupported algorithm %q", policy.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	h := &Hasher{name: policy.Algorithm, current: current, pepper: policy.Pepper}
+
+	// Hashing the dummy now keeps the first unknown-user login from paying
+	// for it, and checking it once gives a first estimate of the cost
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	h.dummy, err = h.Hash(base64.StdEncoding.EncodeToString(secret))
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	h.Verify("", h.dummy)
+	h.cost.Store(int64(time.Since(start)))
+	return h, nil
+}
+
+// Default returns an argon2id hasher with default parameters and no pepper
+func Default() *Hasher {
+	h, err := New(Policy{Algorithm: "argon2id"})
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// maxPasswordBytes bounds the passwords accepted for hashing, so a huge one
+// cannot tie up the server
+const maxPasswordBytes = 1024
+
+// bcryptMaxBytes is the length after which bcrypt ignores the input
+const bcryptMaxBytes = 72
+
+// MaxPasswordBytes returns the longest password, in bytes, that should be
+// hashed under the current policy. bcrypt ignores everything after 72 bytes
+// unless a pepper shortens the input first.
+func (h *Hasher) MaxPasswordBytes() int {
+	if h.name == "bcrypt" && len(h.pepper) == 0 {
+		return bcryptMaxBytes
+	}
+	return maxPasswordBytes
+}
+
+// Hash returns a PHC string for password under the current policy
+func (h *Hasher) Hash(password string) (string, error) {
+	if len(h.pepper) > 0 {
+		return h.current.hash(h.peppered(password), []param{{"pepper", "1"}})
+	}
+	return h.current.hash([]byte(password), nil)
+}
+
+// Verify checks password against encoded. When it matches, rehash reports
+// whether encoded falls short of the current policy and should be replaced
+// with a new Hash of the password.
+func (h *Hasher) Verify(password, encoded string) (ok, rehash bool, err error) {
+	parsed, err := parsePHC(encoded)
+	if err != nil {
+		return false, false, err
+	}
+
+	var alg algorithm
+	switch parsed.id {
+	case "argon2id":
+		alg = &argon2id{}
+	case "scrypt":
+		alg = &scryptAlgorithm{}
+	case "bcrypt":
+		alg = &bcryptAlgorithm{}
+	default:
+		return false, false, ErrUnsupported
+	}
+
+	input := []byte(password)
+	peppered := parsed.param("pepper") == "1"
+	if peppered {
+		if len(h.pepper) == 0 {
+			return false, false, ErrPepperMissing
+		}
+		input = h.peppered(password)
+	}
+
+	start := time.Now()
+	ok, err = alg.verify(input, parsed)
+	h.equalize(parsed, time.Since(start))
+	if err != nil || !ok {
+		return false, false, err
+	}
+
+	rehash = parsed.legacy ||
+		parsed.id != h.name ||
+		!h.current.current(parsed) ||
+		peppered != (len(h.pepper) > 0)
+	return true, rehash, nil
+}
+
+// equalize tracks how long checking a hash under the current policy takes,
+// and makes checks of cheaper hashes, such as legacy bcrypt ones, take as
+// long. Otherwise a known username with an old hash would answer faster
+// than an unknown one, which is checked against the dummy hash.
+func (h *Hasher) equalize(parsed phc, elapsed time.Duration) {
+	if parsed.id == h.name && !parsed.legacy && h.current.current(parsed) {
+		cost := h.cost.Load()
+		h.cost.Store(cost + (int64(elapsed)-cost)/8)
+		return
+	}
+	if wait := time.Duration(h.cost.Load()) - elapsed; wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// VerifyDummy spends as long as Verify on a hash under the current policy,
+// and always fails. Call it when there is no hash to check, such as a login
+// for an unknown username, so the response time does not tell the cases
+// apart.
+func (h *Hasher) VerifyDummy(password string) {
+	h.Verify(password, h.dummy)
+}
+
+// peppered mixes the pepper into password. The MAC is base64 encoded, which
+// also keeps it within bcrypt's 72 byte limit.
+func (h *Hasher) peppered(password string) []byte {
+	mac := hmac.New(sha256.New, h.pepper)
+	mac.Write([]byte(password))
+	return []byte(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// param is a PHC parameter. Parameters are kept in order so hashes are
+// encoded consistently.
+type param struct {
+	name  string
+	value string
+}
+
+// phc is a parsed $id[$v=version][$params][$salt[$hash]] string
+type phc struct {
+	id      string
+	version string
+	params  []param
+	salt    string
+	hash    string
+	// legacy is set for hashes in bcrypt's own $2a$ format
+	legacy bool
+}
+
+func (h phc) param(name string) string {
+	for _, p := range h.params {
+		if p.name == name {
+			return p.value
+		}
+	}
+	return ""
+}
+
+func parsePHC(encoded string) (phc, error) {
+	fields := strings.Split(encoded, "$")
+	if len(fields) < 2 || fields[0] != "" {
+		return phc{}, ErrUnsupported
+	}
+
+	// $2a$10$<salt><hash>, as stored before hashes were PHC strings
+	switch fields[1] {
+	case "2a", "2b", "2y":
+		if len(fields) != 4 || len(fields[3]) != 53 {
+			return phc{}, ErrUnsupported
+		}
+		return phc{
+			id:     "bcrypt",
+			params: []param{{"r", fields[2]}},
+			salt:   fields[3][:22],
+			hash:   fields[3][22:],
+			legacy: true,
+		}, nil
+	}
+
+	h := phc{id: fields[1]}
+	rest := fields[2:]
+	if len(rest) > 0 && strings.HasPrefix(rest[0], "v=") {
+		h.version = strings.TrimPrefix(rest[0], "v=")
+		rest = rest[1:]
+	}
+	if len(rest) > 0 && strings.Contains(rest[0], "=") {
+		params, err := parseParams(rest[0])
+		if err != nil {
+			return phc{}, ErrUnsupported
+		}
+		h.params = params
+		rest = rest[1:]
+	}
+	if len(rest) != 2 {
+		return phc{}, ErrUnsupported
+	}
+	h.salt, h.hash = rest[0], rest[1]
+	return h, nil
+}
+
+func parseParams(s string) ([]param, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var params []param
+	for _, field := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("password: invalid parameter %q", field)
+		}
+		params = append(params, param{name, value})
+	}
+	return params, nil
+}
+
+// encodePHC writes a PHC string. salt and hash are already encoded.
+func encodePHC(id, version string, params []param, salt, hash string) string {
+	var b strings.Builder
+	b.WriteString("$" + id)
+	if version != "" {
+		b.WriteString("$v=" + version)
+	}
+	if len(params) > 0 {
+		b.WriteString("$")
+		for i, p := range params {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString(p.name + "=" + p.value)
+		}
+	}
+	b.WriteString("$" + salt + "$" + hash)
+	return b.String()
+}
+
+// intParam reads a numeric parameter, falling back to def when it is absent
+func intParam(params []param, name string, def int) (int, error) {
+	for _, p := range params {
+		if p.name == name {
+			n, err := strconv.Atoi(p.value)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("password: invalid %s parameter %q", name, p.value)
+			}
+			return n, nil
+		}
+	}
+	return def, nil
+}
+
+// b64 is the PHC encoding for salts and hashes
+var b64 = base64.RawStdEncoding
+
+func errInvalidParams(algorithm, reason string) error {
+	return fmt.Errorf("password: invalid %s parameters: %s", algorithm, reason)
+}
@@ -0,0 +1,158 @@
+package password
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cheapPolicy is expensive enough to time reliably and cheap enough for tests
+var cheapPolicy = Policy{Algorithm: "argon2id", Params: "m=8192,t=2,p=1"}
+
+func newHasher(t *testing.T, policy Policy) *Hasher {
+	t.Helper()
+	h, err := New(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestHashAndVerify(t *testing.T) {
+	policies := []Policy{
+		{Algorithm: "argon2id", Params: "m=1024,t=1,p=1"},
+		{Algorithm: "scrypt", Params: "ln=10,r=8,p=1"},
+		{Algorithm: "bcrypt", Params: "r=4"},
+		{Algorithm: "bcrypt", Params: "r=4", Pepper: []byte("pepper")},
+	}
+	for _, policy := range policies {
+		t.Run(policy.Algorithm, func(t *testing.T) {
+			h := newHasher(t, policy)
+			encoded, err := h.Hash("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(encoded, "$"+policy.Algorithm+"$") {
+				t.Fatalf("hash %q is not a %s PHC string", encoded, policy.Algorithm)
+			}
+
+			ok, rehash, err := h.Verify("correct horse", encoded)
+			if err != nil || !ok || rehash {
+				t.Fatalf("Verify(right) = %v, %v, %v; want true, false, nil", ok, rehash, err)
+			}
+			if ok, _, _ := h.Verify("wrong horse", encoded); ok {
+				t.Fatal("Verify(wrong) = true")
+			}
+		})
+	}
+}
+
+func TestVerifyAskForRehash(t *testing.T) {
+	h := newHasher(t, Policy{Algorithm: "argon2id", Params: "m=1024,t=1,p=1"})
+
+	legacy, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weaker, err := newHasher(t, Policy{Algorithm: "argon2id", Params: "m=512,t=1,p=1"}).Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, encoded := range map[string]string{"legacy bcrypt": string(legacy), "older params": weaker} {
+		ok, rehash, err := h.Verify("correct horse", encoded)
+		if err != nil || !ok || !rehash {
+			t.Errorf("%s: Verify = %v, %v, %v; want true, true, nil", name, ok, rehash, err)
+		}
+	}
+}
+
+func TestMaxPasswordBytes(t *testing.T) {
+	cases := []struct {
+		policy Policy
+		want   int
+	}{
+		{Policy{Algorithm: "bcrypt", Params: "r=4"}, 72},
+		{Policy{Algorithm: "bcrypt", Params: "r=4", Pepper: []byte("pepper")}, 1024},
+		{Policy{Algorithm: "argon2id", Params: "m=1024,t=1,p=1"}, 1024},
+		{Policy{Algorithm: "scrypt", Params: "ln=10,r=8,p=1"}, 1024},
+	}
+	for _, tt := range cases {
+		if got := newHasher(t, tt.policy).MaxPasswordBytes(); got != tt.want {
+			t.Errorf("MaxPasswordBytes(%s, pepper %t) = %d, want %d", tt.policy.Algorithm, tt.policy.Pepper != nil, got, tt.want)
+		}
+	}
+}
+
+func TestNewPrecomputesDummy(t *testing.T) {
+	h := newHasher(t, cheapPolicy)
+	if !strings.HasPrefix(h.dummy, "$argon2id$") {
+		t.Fatalf("dummy hash = %q, want one under the current policy", h.dummy)
+	}
+	if h.cost.Load() <= 0 {
+		t.Fatal("cost of a check was not measured")
+	}
+}
+
+// median returns the median of samples, which it sorts
+func median(samples []time.Duration) time.Duration {
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return samples[len(samples)/2]
+}
+
+// TestVerifyTiming compares how long failed checks take for an unknown user
+// (the dummy hash) and for known users with current, legacy and weaker
+// hashes. The checks are interleaved so drift in machine load affects every
+// case alike, and medians are compared so outliers do not.
+func TestVerifyTiming(t *testing.T) {
+	if testing.Short() {
+		t.Skip("timing test")
+	}
+	h := newHasher(t, cheapPolicy)
+
+	current, err := h.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weaker, err := newHasher(t, Policy{Algorithm: "argon2id", Params: "m=1024,t=1,p=1"}).Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := map[string]func(){
+		"unknown user":  func() { h.VerifyDummy("wrong horse") },
+		"current hash":  func() { h.Verify("wrong horse", current) },
+		"legacy bcrypt": func() { h.Verify("wrong horse", string(legacy)) },
+		"weaker params": func() { h.Verify("wrong horse", weaker) },
+	}
+	names := []string{"unknown user", "current hash", "legacy bcrypt", "weaker params"}
+
+	const rounds = 40
+	samples := make(map[string][]time.Duration)
+	for i := 0; i < rounds; i++ {
+		for j := range names {
+			// Rotate the order so no case always runs first
+			name := names[(i+j)%len(names)]
+			start := time.Now()
+			checks[name]()
+			samples[name] = append(samples[name], time.Since(start))
+		}
+	}
+
+	unknown := median(samples["unknown user"])
+	for _, name := range names[1:] {
+		known := median(samples[name])
+		ratio := float64(known) / float64(unknown)
+		t.Logf("%s: median %s, unknown user %s, ratio %.2f", name, known, unknown, ratio)
+		if ratio < 0.75 || ratio > 1.33 {
+			t.Errorf("%s: median check takes %s, unknown user %s", name, known, unknown)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"strconv"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// scryptAlgorithm hashes with scrypt. ln is log2 of the cost N; the
+// defaults (N=32768, r=8, p=1) use 32 MiB.
+type scryptAlgorithm struct {
+	ln int
+	r  int
+	p  int
+}
+
+const (
+	scryptSaltLen = 16
+	scryptKeyLen  = 32
+)
+
+func newScrypt(params []param) (*scryptAlgorithm, error) {
+	ln, err := intParam(params, "ln", 15)
+	if err != nil {
+		return nil, err
+	}
+	r, err := intParam(params, "r", 8)
+	if err != nil {
+		return nil, err
+	}
+	p, err := intParam(params, "p", 1)
+	if err != nil {
+		return nil, err
+	}
+	if ln > 30 {
+		return nil, errInvalidParams("scrypt", "ln must be at most 30")
+	}
+	return &scryptAlgorithm{ln: ln, r: r, p: p}, nil
+}
+
+func (s *scryptAlgorithm) hash(password []byte, extra []param) (string, error) {
+	salt := make([]byte, scryptSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key(password, salt, 1<<s.ln, s.r, s.p, scryptKeyLen)
+	if err != nil {
+		return "", err
+	}
+	return encodePHC("scrypt", "", append(s.params(), extra...),
+		b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func (s *scryptAlgorithm) verify(password []byte, h phc) (bool, error) {
+	stored, err := newScrypt(h.params)
+	if err != nil {
+		return false, ErrUnsupported
+	}
+	salt, err := b64.DecodeString(h.salt)
+	if err != nil {
+		return false, ErrUnsupported
+	}
+	want, err := b64.DecodeString(h.hash)
+	if err != nil || len(want) == 0 {
+		return false, ErrUnsupported
+	}
+
+	key, err := scrypt.Key(password, salt, 1<<stored.ln, stored.r, stored.p, len(want))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, want) == 1, nil
+}
+
+func (s *scryptAlgorithm) current(h phc) bool {
+	stored, err := newScrypt(h.params)
+	return err == nil && *stored == *s
+}
+
+func (s *scryptAlgorithm) params() []param {
+	return []param{
+		{"ln", strconv.Itoa(s.ln)},
+		{"r", strconv.Itoa(s.r)},
+		{"p", strconv.Itoa(s.p)},
+	}
+}
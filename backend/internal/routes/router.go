@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"log"
 	"time"
 
 	"github.com/NoorBnHossam/Authentication_Types/internal/auth"
@@ -16,8 +17,38 @@ func SetupRouter(cfg *config.Config) *gin.Engine {
 
 	router := gin.Default()
 
-	// Initialize rate limiter
-	rateLimiter := middleware.NewRateLimiter(100, time.Minute) // 100 requests per minute
+	if cfg.RBACRolesFile != "" {
+		if err := auth.LoadRolePermissions(cfg.RBACRolesFile); err != nil {
+			log.Fatal("Failed to load role permissions:", err)
+		}
+	}
+
+	// Routes that check credentials or send mail get much tighter limits
+	// than reads, per address and per account being tried
+	credentialRoutes := []string{
+		"/api/*/login",
+		"/api/mfa/verify",
+		"/api/webauthn/login/*",
+		"/api/magic-link",
+		"/api/sso/callback",
+		"/api/users/register",
+		"/api/users/verify/resend",
+		"/api/password/*",
+		"/token",
+	}
+	protectedRoutes := []string{"/api/protected", "/api/*/protected"}
+
+	rateLimiter := middleware.NewRateLimiter(
+		middleware.Policy{Name: "global", Limit: 100, Period: time.Minute},
+		middleware.Policy{Name: "login_ip", Limit: 10, Period: time.Minute, Routes: credentialRoutes},
+		middleware.Policy{Name: "login_username", Limit: 5, Period: time.Minute, Key: middleware.ByUsername, Routes: credentialRoutes},
+		middleware.Policy{Name: "protected_credential", Limit: 300, Period: time.Minute, Key: middleware.ByAPIKey(""), Routes: protectedRoutes},
+	)
+
+	// Account changes are limited per signed-in user
+	accountLimiter := middleware.NewRateLimiter(
+		middleware.Policy{Name: "account_user", Limit: 10, Period: time.Minute, Key: middleware.ByUser},
+	)
 
 	// Apply security middleware
 	router.Use(middleware.SecurityHeaders())
@@ -41,6 +72,7 @@ func SetupRouter(cfg *config.Config) *gin.Engine {
 			c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 			c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With, Accept, Origin")
 			c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+			c.Writer.Header().Set("Access-Control-Expose-Headers", "RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After")
 			c.Writer.Header().Set("Access-Control-Max-Age", "86400") // 24 hours
 			c.Writer.Header().Set("Vary", "Origin")                  // Important for caching
 		}
@@ -58,34 +90,52 @@ func SetupRouter(cfg *config.Config) *gin.Engine {
 		c.Next()
 	})
 
-	// Basic Auth routes
-	router.POST("/api/basic-auth/login", auth.BasicAuthLogin)
-	router.GET("/api/basic-auth/protected", auth.BasicAuthMiddleware(), auth.ProtectedRoute)
-
-	// Token Auth routes
-	router.POST("/api/token-auth/login", auth.TokenAuthLogin)
-	router.GET("/api/token-auth/protected", auth.TokenAuthMiddleware(), auth.ProtectedRoute)
-
-	// JWT Auth routes
-	router.POST("/api/jwt-auth/login", auth.JWTAuthLogin)
-	router.GET("/api/jwt-auth/protected", auth.JWTAuthMiddleware(), auth.ProtectedRoute)
-	router.POST("/api/jwt-auth/refresh", auth.RefreshToken)
-	router.POST("/api/jwt-auth/logout", auth.Logout)
-
-	// Session Auth routes
-	router.POST("/api/session-auth/login", auth.SessionAuthLogin)
-	router.GET("/api/session-auth/protected", auth.SessionAuthMiddleware(), auth.ProtectedRoute)
-	router.POST("/api/session-auth/logout", auth.SessionAuthLogout)
-
-	// OAuth routes
-	router.GET("/api/oauth/login", auth.OAuthLogin)
-	router.GET("/api/oauth/callback", auth.OAuthCallback)
-	router.GET("/api/oauth/protected", auth.OAuthMiddleware(), auth.ProtectedRoute)
-
-	// SSO routes
-	router.GET("/api/sso/login", auth.SSOLogin)
-	router.GET("/api/sso/callback", auth.SSOCallback)
-	router.GET("/api/sso/protected", auth.SSOMiddleware(), auth.ProtectedRoute)
+	// Accepts any of the credential types below
+	router.GET("/api/protected", auth.Authenticate(), auth.ProtectedRoute)
+
+	// Registration routes
+	router.POST("/api/users/register", auth.RegisterUser)
+	router.GET("/api/users/verify", auth.VerifyEmail)
+	router.POST("/api/users/verify/resend", auth.ResendVerification)
+	router.POST("/api/password/forgot", auth.ForgotPassword)
+	router.POST("/api/password/reset", auth.ResetPassword)
+
+	// Login, logout and protected routes of every registered authenticator
+	auth.MountRoutes(router)
+
+	// MFA routes
+	router.POST("/api/mfa/verify", auth.VerifyMFA)
+	mfa := router.Group("/api/mfa/totp", auth.Authenticate(), accountLimiter.RateLimit())
+	mfa.POST("/enroll", auth.EnrollTOTP)
+	mfa.POST("/confirm", auth.ConfirmTOTP)
+	mfa.POST("/disable", auth.DisableTOTP)
+
+	// WebAuthn routes
+	router.POST("/api/webauthn/login/begin", auth.BeginWebAuthnLogin)
+	router.POST("/api/webauthn/login/finish", auth.FinishWebAuthnLogin)
+	passkeys := router.Group("/api/webauthn/register", auth.Authenticate(), accountLimiter.RateLimit())
+	passkeys.POST("/begin", auth.BeginWebAuthnRegistration)
+	passkeys.POST("/finish", auth.FinishWebAuthnRegistration)
+
+	// Admin routes
+	admin := router.Group("/api/admin", auth.Authenticate())
+	admin.GET("/jwt-keys", auth.RequirePermission(auth.PermissionManageKeys), auth.ListJWTKeys)
+	admin.POST("/jwt-keys/reload", auth.RequirePermission(auth.PermissionManageKeys), auth.ReloadJWTKeysHandler)
+	admin.GET("/lockouts/:username", auth.RequirePermission(auth.PermissionManageUsers), auth.GetLockout)
+	admin.DELETE("/lockouts/:username", auth.RequirePermission(auth.PermissionManageUsers), auth.UnlockAccount)
+
+	// Embedded OpenID Connect provider
+	if cfg.OIDCProviderEnabled {
+		provider, err := auth.NewOIDCProvider(cfg)
+		if err != nil {
+			log.Fatal("Failed to start OIDC provider:", err)
+		}
+		router.GET("/.well-known/openid-configuration", provider.Discovery)
+		router.GET("/authorize", provider.Authorize)
+		router.POST("/token", provider.Token)
+		router.GET("/userinfo", provider.UserInfo)
+		router.POST("/userinfo", provider.UserInfo)
+	}
 
 	return router
 }
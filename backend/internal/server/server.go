@@ -0,0 +1,105 @@
+// Package server wires the configured stores, password hasher, audit log and
+// rate limit store into the handlers and runs the HTTP server. Both
+// entrypoints, main.go and cmd/server, start it.
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/audit"
+	"github.com/NoorBnHossam/Authentication_Types/internal/auth"
+	"github.com/NoorBnHossam/Authentication_Types/internal/config"
+	"github.com/NoorBnHossam/Authentication_Types/internal/db"
+	"github.com/NoorBnHossam/Authentication_Types/internal/middleware"
+	"github.com/NoorBnHossam/Authentication_Types/internal/password"
+	"github.com/NoorBnHossam/Authentication_Types/internal/routes"
+)
+
+// Run serves the API until SIGINT or SIGTERM, then shuts down gracefully.
+// It returns early if any dependency cannot be set up.
+func Run(cfg *config.Config) error {
+	stores, err := db.Stores(cfg)
+	if err != nil {
+		return fmt.Errorf("opening storage: %w", err)
+	}
+	defer db.Disconnect()
+	auth.UseStores(stores)
+
+	hasher, err := password.New(password.Policy{
+		Algorithm: cfg.PasswordHash,
+		Params:    cfg.PasswordHashParams,
+		Pepper:    []byte(cfg.PasswordPepper),
+	})
+	if err != nil {
+		return fmt.Errorf("invalid password hashing policy: %w", err)
+	}
+	auth.UsePasswordHasher(hasher)
+
+	auditLog, err := audit.Open(cfg)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	defer auditLog.Close()
+	auth.UseAuditLog(auditLog)
+
+	rateLimits, err := middleware.OpenRateLimitStore(cfg)
+	if err != nil {
+		return fmt.Errorf("opening rate limit store: %w", err)
+	}
+	middleware.UseRateLimitStore(rateLimits)
+
+	router := routes.SetupRouter(cfg)
+
+	srv := &http.Server{
+		Addr:         ":" + cfg.Port,
+		Handler:      router,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Printf("Server starting on port %s in %s mode", cfg.Port, cfg.Env)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			serveErr <- err
+		}
+	}()
+
+	// SIGHUP reloads the JWT key ring so keys can be rotated without a restart
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			if err := auth.ReloadJWTKeys(); err != nil {
+				log.Println("Failed to reload JWT keys:", err)
+			}
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("starting server: %w", err)
+	case <-quit:
+	}
+	log.Println("Shutting down server...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("server forced to shutdown: %w", err)
+	}
+
+	log.Println("Server exited gracefully")
+	return nil
+}
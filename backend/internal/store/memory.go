@@ -0,0 +1,667 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// NewMemory returns empty stores that keep everything in process memory. They
+// are safe for concurrent use and meant for tests and local development.
+func NewMemory() Stores {
+	return Stores{
+		Users:    &memoryUsers{users: make(map[primitive.ObjectID]models.User)},
+		Sessions: &memorySessions{sessions: make(map[string]models.Session)},
+		Tokens:   &memoryTokens{tokens: make(map[string]models.Token)},
+
+		States:          &memoryStates{states: make(map[string]State)},
+		Revocations:     &memoryRevocations{revoked: make(map[string]time.Time), users: make(map[string]userCutoff)},
+		RefreshFamilies: &memoryRefreshFamilies{families: make(map[string]RefreshFamily)},
+		Lockouts:        &memoryLockouts{failures: make(map[string]LoginFailures)},
+	}
+}
+
+type memoryUsers struct {
+	mu    sync.RWMutex
+	users map[primitive.ObjectID]models.User
+	// order keeps lookups that can match several users deterministic
+	order []primitive.ObjectID
+}
+
+// cloneUser copies the slices so callers cannot modify stored users
+func cloneUser(user models.User) models.User {
+	user.RecoveryCodes = append([]string(nil), user.RecoveryCodes...)
+	user.WebAuthnID = append([]byte(nil), user.WebAuthnID...)
+	user.WebAuthnCredentials = append([]models.WebAuthnCredential(nil), user.WebAuthnCredentials...)
+	user.Identities = append([]models.Identity(nil), user.Identities...)
+	return user
+}
+
+func (s *memoryUsers) find(match func(models.User) bool) (models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, id := range s.order {
+		if user := s.users[id]; match(user) {
+			return cloneUser(user), nil
+		}
+	}
+	return models.User{}, ErrNotFound
+}
+
+// update applies change to the user under the write lock. change returns
+// false when its condition does not hold.
+func (s *memoryUsers) update(id string, change func(*models.User) bool) error {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[objectID]
+	if !ok {
+		return ErrNotFound
+	}
+	user = cloneUser(user)
+	if !change(&user) {
+		return ErrNotFound
+	}
+	user.UpdatedAt = time.Now()
+	s.users[objectID] = user
+	return nil
+}
+
+func (s *memoryUsers) FindByID(ctx context.Context, id string) (models.User, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return models.User{}, ErrNotFound
+	}
+	return s.find(func(u models.User) bool { return u.ID == objectID })
+}
+
+func (s *memoryUsers) FindByUsername(ctx context.Context, username string) (models.User, error) {
+	return s.find(func(u models.User) bool { return u.Username == username })
+}
+
+func (s *memoryUsers) FindByEmail(ctx context.Context, email string) (models.User, error) {
+	return s.find(func(u models.User) bool { return u.Email == email })
+}
+
+func (s *memoryUsers) FindByIdentity(ctx context.Context, provider, subject string) (models.User, error) {
+	return s.find(func(u models.User) bool {
+		for _, identity := range u.Identities {
+			if identity.Provider == provider && identity.Subject == subject {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (s *memoryUsers) FindByWebAuthnID(ctx context.Context, handle []byte) (models.User, error) {
+	return s.find(func(u models.User) bool { return len(u.WebAuthnID) > 0 && bytes.Equal(u.WebAuthnID, handle) })
+}
+
+func (s *memoryUsers) Create(ctx context.Context, user *models.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.users {
+		if existing.Username == user.Username {
+			return ErrDuplicate
+		}
+	}
+	if user.ID.IsZero() {
+		user.ID = primitive.NewObjectID()
+	}
+	if _, exists := s.users[user.ID]; exists {
+		return ErrDuplicate
+	}
+	s.users[user.ID] = cloneUser(*user)
+	s.order = append(s.order, user.ID)
+	return nil
+}
+
+func (s *memoryUsers) SetRole(ctx context.Context, id, role string) error {
+	return s.update(id, func(u *models.User) bool {
+		u.Role = role
+		return true
+	})
+}
+
+func (s *memoryUsers) SetPassword(ctx context.Context, id, hash string) error {
+	return s.update(id, func(u *models.User) bool {
+		u.Password = hash
+		return true
+	})
+}
+
+func (s *memoryUsers) ReplacePasswordHash(ctx context.Context, id, oldHash, newHash string) error {
+	return s.update(id, func(u *models.User) bool {
+		if u.Password != oldHash {
+			return false
+		}
+		u.Password = newHash
+		return true
+	})
+}
+
+func (s *memoryUsers) SetEmailVerified(ctx context.Context, id, email string) error {
+	return s.update(id, func(u *models.User) bool {
+		if u.Email != email {
+			return false
+		}
+		u.EmailVerified = true
+		return true
+	})
+}
+
+func (s *memoryUsers) AddIdentity(ctx context.Context, id string, identity models.Identity) error {
+	return s.update(id, func(u *models.User) bool {
+		u.Identities = append(u.Identities, identity)
+		return true
+	})
+}
+
+func (s *memoryUsers) SetPendingTOTPSecret(ctx context.Context, id, secret string) error {
+	return s.update(id, func(u *models.User) bool {
+		u.TOTPPendingSecret = secret
+		return true
+	})
+}
+
+func (s *memoryUsers) EnableMFA(ctx context.Context, id, pendingSecret string, lastStep int64, recoveryCodes []string) error {
+	return s.update(id, func(u *models.User) bool {
+		if u.TOTPPendingSecret != pendingSecret {
+			return false
+		}
+		u.MFAEnabled = true
+		u.TOTPSecret = pendingSecret
+		u.TOTPPendingSecret = ""
+		u.TOTPLastStep = lastStep
+		u.RecoveryCodes = append([]string(nil), recoveryCodes...)
+		return true
+	})
+}
+
+func (s *memoryUsers) DisableMFA(ctx context.Context, id string) error {
+	return s.update(id, func(u *models.User) bool {
+		u.MFAEnabled = false
+		u.TOTPSecret = ""
+		u.TOTPLastStep = 0
+		u.RecoveryCodes = nil
+		return true
+	})
+}
+
+func (s *memoryUsers) ConsumeTOTPStep(ctx context.Context, id string, step int64) error {
+	return s.update(id, func(u *models.User) bool {
+		if u.TOTPLastStep >= step {
+			return false
+		}
+		u.TOTPLastStep = step
+		return true
+	})
+}
+
+func (s *memoryUsers) ConsumeRecoveryCode(ctx context.Context, id, hash string) error {
+	return s.update(id, func(u *models.User) bool {
+		for i, code := range u.RecoveryCodes {
+			if code == hash {
+				u.RecoveryCodes = append(u.RecoveryCodes[:i], u.RecoveryCodes[i+1:]...)
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (s *memoryUsers) SetWebAuthnID(ctx context.Context, id string, handle []byte) error {
+	return s.update(id, func(u *models.User) bool {
+		if len(u.WebAuthnID) == 0 {
+			u.WebAuthnID = append([]byte(nil), handle...)
+		}
+		return true
+	})
+}
+
+func (s *memoryUsers) AddWebAuthnCredential(ctx context.Context, id string, credential models.WebAuthnCredential) error {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		for _, existing := range user.WebAuthnCredentials {
+			if bytes.Equal(existing.ID, credential.ID) {
+				return ErrDuplicate
+			}
+		}
+	}
+	user, ok := s.users[objectID]
+	if !ok {
+		return ErrNotFound
+	}
+	user = cloneUser(user)
+	user.WebAuthnCredentials = append(user.WebAuthnCredentials, credential)
+	user.UpdatedAt = time.Now()
+	s.users[objectID] = user
+	return nil
+}
+
+func (s *memoryUsers) UpdateWebAuthnCredential(ctx context.Context, id string, credential models.WebAuthnCredential) error {
+	return s.update(id, func(u *models.User) bool {
+		for i := range u.WebAuthnCredentials {
+			stored := &u.WebAuthnCredentials[i]
+			if !bytes.Equal(stored.ID, credential.ID) {
+				continue
+			}
+			if credential.SignCount != 0 && stored.SignCount >= credential.SignCount {
+				return false
+			}
+			stored.SignCount = credential.SignCount
+			stored.BackupState = credential.BackupState
+			stored.LastUsedAt = credential.LastUsedAt
+			stored.UserVerified = credential.UserVerified
+			return true
+		}
+		return false
+	})
+}
+
+type memorySessions struct {
+	mu       sync.RWMutex
+	sessions map[string]models.Session
+}
+
+func (s *memorySessions) Create(ctx context.Context, session models.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.sessions[session.ID]; exists {
+		return ErrDuplicate
+	}
+	s.sessions[session.ID] = session
+	return nil
+}
+
+func (s *memorySessions) FindValid(ctx context.Context, id string) (models.Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, ok := s.sessions[id]
+	if !ok || !session.IsValid || !session.ExpiresAt.After(time.Now()) {
+		return models.Session{}, ErrNotFound
+	}
+	return session, nil
+}
+
+func (s *memorySessions) ListValid(ctx context.Context, userID string) ([]models.Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var sessions []models.Session
+	for _, session := range s.sessions {
+		if session.UserID == userID && session.IsValid {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.Before(sessions[j].CreatedAt) })
+	return sessions, nil
+}
+
+func (s *memorySessions) set(id string, change func(*models.Session)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session, ok := s.sessions[id]; ok {
+		change(&session)
+		s.sessions[id] = session
+	}
+}
+
+func (s *memorySessions) Touch(ctx context.Context, id string) error {
+	s.set(id, func(session *models.Session) { session.LastActivity = time.Now() })
+	return nil
+}
+
+func (s *memorySessions) Invalidate(ctx context.Context, id string) error {
+	s.set(id, func(session *models.Session) { session.IsValid = false })
+	return nil
+}
+
+func (s *memorySessions) InvalidateUser(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, session := range s.sessions {
+		if session.UserID == userID {
+			session.IsValid = false
+			s.sessions[id] = session
+		}
+	}
+	return nil
+}
+
+type memoryTokens struct {
+	mu     sync.RWMutex
+	tokens map[string]models.Token
+}
+
+func (s *memoryTokens) Create(ctx context.Context, token models.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.tokens[token.Value]; exists {
+		return ErrDuplicate
+	}
+	s.tokens[token.Value] = token
+	return nil
+}
+
+func (s *memoryTokens) FindValid(ctx context.Context, value string) (models.Token, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	token, ok := s.tokens[value]
+	if !ok || !token.ExpiresAt.After(time.Now()) {
+		return models.Token{}, ErrNotFound
+	}
+	return token, nil
+}
+
+func (s *memoryTokens) DeleteUser(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for value, token := range s.tokens {
+		if token.UserID == userID {
+			delete(s.tokens, value)
+		}
+	}
+	return nil
+}
+
+type memoryStates struct {
+	mu     sync.Mutex
+	states map[string]State
+}
+
+// live returns the record if it has not expired. Call it with the lock held.
+func (s *memoryStates) live(id string) (State, bool) {
+	state, ok := s.states[id]
+	if !ok || !state.ExpiresAt.After(time.Now()) {
+		return State{}, false
+	}
+	return state, true
+}
+
+func (s *memoryStates) Create(ctx context.Context, state State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, existing := range s.states {
+		if !existing.ExpiresAt.After(now) {
+			delete(s.states, id)
+		}
+	}
+	if _, exists := s.states[state.ID]; exists {
+		return ErrDuplicate
+	}
+	state.Data = append([]byte(nil), state.Data...)
+	s.states[state.ID] = state
+	return nil
+}
+
+func (s *memoryStates) Find(ctx context.Context, id string) (State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.live(id)
+	if !ok {
+		return State{}, ErrNotFound
+	}
+	state.Data = append([]byte(nil), state.Data...)
+	return state, nil
+}
+
+func (s *memoryStates) Take(ctx context.Context, id string) (State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.live(id)
+	delete(s.states, id)
+	if !ok {
+		return State{}, ErrNotFound
+	}
+	return state, nil
+}
+
+func (s *memoryStates) CountAttempt(ctx context.Context, id string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.live(id)
+	if !ok {
+		return 0, ErrNotFound
+	}
+	state.Attempts++
+	s.states[id] = state
+	return state.Attempts, nil
+}
+
+func (s *memoryStates) DeleteUser(ctx context.Context, kind, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, state := range s.states {
+		if state.Kind == kind && state.UserID == userID {
+			delete(s.states, id)
+		}
+	}
+	return nil
+}
+
+type memoryRevocations struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+	users   map[string]userCutoff
+}
+
+type userCutoff struct {
+	before    time.Time
+	expiresAt time.Time
+}
+
+func (s *memoryRevocations) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Purge entries for tokens that have expired in the meantime
+	now := time.Now()
+	for id, exp := range s.revoked {
+		if now.After(exp) {
+			delete(s.revoked, id)
+		}
+	}
+
+	s.revoked[jti] = expiresAt
+	return nil
+}
+
+func (s *memoryRevocations) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exp, ok := s.revoked[jti]
+	return ok && time.Now().Before(exp), nil
+}
+
+func (s *memoryRevocations) RevokeUser(ctx context.Context, userID string, before, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, cutoff := range s.users {
+		if now.After(cutoff.expiresAt) {
+			delete(s.users, id)
+		}
+	}
+
+	s.users[userID] = userCutoff{before: before, expiresAt: expiresAt}
+	return nil
+}
+
+func (s *memoryRevocations) RevokedBefore(ctx context.Context, userID string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff, ok := s.users[userID]
+	if !ok || !time.Now().Before(cutoff.expiresAt) {
+		return time.Time{}, nil
+	}
+	return cutoff.before, nil
+}
+
+type memoryRefreshFamilies struct {
+	mu       sync.Mutex
+	families map[string]RefreshFamily
+}
+
+func (s *memoryRefreshFamilies) Create(ctx context.Context, family RefreshFamily) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, f := range s.families {
+		if now.After(f.ExpiresAt) {
+			delete(s.families, id)
+		}
+	}
+	if _, exists := s.families[family.ID]; exists {
+		return ErrDuplicate
+	}
+	s.families[family.ID] = family
+	return nil
+}
+
+func (s *memoryRefreshFamilies) Rotate(ctx context.Context, familyID, presentedJTI, nextJTI string, expiresAt time.Time) (RefreshFamily, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	family, ok := s.families[familyID]
+	if !ok || family.Revoked || time.Now().After(family.ExpiresAt) {
+		return RefreshFamily{}, ErrNotFound
+	}
+	family.UpdatedAt = time.Now()
+	if family.CurrentJTI != presentedJTI {
+		family.Revoked = true
+		family.RevokedReason = "reuse"
+		s.families[familyID] = family
+		return family, ErrReused
+	}
+
+	family.CurrentJTI = nextJTI
+	family.ExpiresAt = expiresAt
+	s.families[familyID] = family
+	return family, nil
+}
+
+func (s *memoryRefreshFamilies) Revoke(ctx context.Context, familyID, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if family, ok := s.families[familyID]; ok {
+		family.Revoked = true
+		family.RevokedReason = reason
+		family.UpdatedAt = time.Now()
+		s.families[familyID] = family
+	}
+	return nil
+}
+
+func (s *memoryRefreshFamilies) RevokeUser(ctx context.Context, userID, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, family := range s.families {
+		if family.UserID == userID && !family.Revoked {
+			family.Revoked = true
+			family.RevokedReason = reason
+			family.UpdatedAt = time.Now()
+			s.families[id] = family
+		}
+	}
+	return nil
+}
+
+type memoryLockouts struct {
+	mu       sync.Mutex
+	failures map[string]LoginFailures
+}
+
+func (s *memoryLockouts) Get(ctx context.Context, username string) (LoginFailures, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.failures[username]
+	if !ok || time.Now().After(f.ExpiresAt) {
+		return LoginFailures{Username: username}, nil
+	}
+	return f, nil
+}
+
+func (s *memoryLockouts) RecordFailure(ctx context.Context, username string, resetAfter time.Duration) (LoginFailures, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for name, f := range s.failures {
+		if now.After(f.ExpiresAt) {
+			delete(s.failures, name)
+		}
+	}
+
+	f := s.failures[username]
+	f.Username = username
+	f.Count++
+	f.LastFailure = now
+	if reset := now.Add(resetAfter); reset.After(f.ExpiresAt) {
+		f.ExpiresAt = reset
+	}
+	s.failures[username] = f
+	return f, nil
+}
+
+func (s *memoryLockouts) Lock(ctx context.Context, username string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.failures[username]; ok && until.After(f.LockedUntil) {
+		f.LockedUntil = until
+		if until.After(f.ExpiresAt) {
+			f.ExpiresAt = until
+		}
+		s.failures[username] = f
+	}
+	return nil
+}
+
+func (s *memoryLockouts) Reset(ctx context.Context, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.failures, username)
+	return nil
+}
@@ -0,0 +1,7 @@
+package store
+
+import "testing"
+
+func TestMemory(t *testing.T) {
+	testStores(t, func(t *testing.T) Stores { return NewMemory() })
+}
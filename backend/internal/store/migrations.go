@@ -0,0 +1,188 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// migrations are applied in order and recorded in schema_migrations. Never
+// edit a released migration; append a new one. {{bytes}} and {{time}} are
+// replaced with the dialect's binary and timestamp types.
+var migrations = [][]string{
+	// 1: users, sessions and opaque tokens
+	{
+		`CREATE TABLE users (
+			id                  VARCHAR(24) PRIMARY KEY,
+			username            TEXT NOT NULL UNIQUE,
+			password            TEXT NOT NULL DEFAULT '',
+			email               TEXT NOT NULL DEFAULT '',
+			role                TEXT NOT NULL DEFAULT '',
+			email_verified      BOOLEAN NOT NULL DEFAULT FALSE,
+			mfa_enabled         BOOLEAN NOT NULL DEFAULT FALSE,
+			totp_secret         TEXT NOT NULL DEFAULT '',
+			totp_pending_secret TEXT NOT NULL DEFAULT '',
+			totp_last_step      BIGINT NOT NULL DEFAULT 0,
+			webauthn_id         {{bytes}} UNIQUE,
+			created_at          {{time}} NOT NULL,
+			updated_at          {{time}} NOT NULL
+		)`,
+		`CREATE INDEX users_email ON users (email)`,
+		`CREATE TABLE user_identities (
+			provider TEXT NOT NULL,
+			subject  TEXT NOT NULL,
+			user_id  VARCHAR(24) NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			PRIMARY KEY (provider, subject)
+		)`,
+		`CREATE INDEX user_identities_user_id ON user_identities (user_id)`,
+		`CREATE TABLE recovery_codes (
+			user_id VARCHAR(24) NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			hash    TEXT NOT NULL,
+			PRIMARY KEY (user_id, hash)
+		)`,
+		`CREATE TABLE webauthn_credentials (
+			id               {{bytes}} PRIMARY KEY,
+			user_id          VARCHAR(24) NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+			public_key       {{bytes}} NOT NULL,
+			attestation_type TEXT NOT NULL DEFAULT '',
+			transports       TEXT NOT NULL DEFAULT '',
+			aaguid           {{bytes}},
+			sign_count       BIGINT NOT NULL DEFAULT 0,
+			user_verified    BOOLEAN NOT NULL DEFAULT FALSE,
+			backup_eligible  BOOLEAN NOT NULL DEFAULT FALSE,
+			backup_state     BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at       {{time}} NOT NULL,
+			last_used_at     {{time}}
+		)`,
+		`CREATE INDEX webauthn_credentials_user_id ON webauthn_credentials (user_id)`,
+		`CREATE TABLE sessions (
+			id            TEXT PRIMARY KEY,
+			user_id       VARCHAR(24) NOT NULL,
+			auth_method   TEXT NOT NULL DEFAULT '',
+			user_agent    TEXT NOT NULL DEFAULT '',
+			ip_address    TEXT NOT NULL DEFAULT '',
+			last_activity {{time}} NOT NULL,
+			created_at    {{time}} NOT NULL,
+			expires_at    {{time}} NOT NULL,
+			is_valid      BOOLEAN NOT NULL
+		)`,
+		`CREATE INDEX sessions_user_id ON sessions (user_id, is_valid)`,
+		`CREATE TABLE tokens (
+			value      TEXT PRIMARY KEY,
+			user_id    VARCHAR(24) NOT NULL,
+			created_at {{time}} NOT NULL,
+			expires_at {{time}} NOT NULL
+		)`,
+		`CREATE INDEX tokens_user_id ON tokens (user_id)`,
+	},
+	// 2: flow state, JWT revocations, refresh token families and lockouts
+	{
+		`CREATE TABLE auth_states (
+			id         TEXT PRIMARY KEY,
+			kind       TEXT NOT NULL,
+			user_id    VARCHAR(24) NOT NULL DEFAULT '',
+			data       {{bytes}} NOT NULL,
+			attempts   INTEGER NOT NULL DEFAULT 0,
+			created_at {{time}} NOT NULL,
+			expires_at {{time}} NOT NULL
+		)`,
+		`CREATE INDEX auth_states_user_id ON auth_states (kind, user_id)`,
+		`CREATE INDEX auth_states_expires_at ON auth_states (expires_at)`,
+		`CREATE TABLE revoked_tokens (
+			jti        TEXT PRIMARY KEY,
+			revoked_at {{time}} NOT NULL,
+			expires_at {{time}} NOT NULL
+		)`,
+		`CREATE INDEX revoked_tokens_expires_at ON revoked_tokens (expires_at)`,
+		`CREATE TABLE refresh_families (
+			id             TEXT PRIMARY KEY,
+			user_id        VARCHAR(24) NOT NULL,
+			current_jti    TEXT NOT NULL,
+			revoked        BOOLEAN NOT NULL DEFAULT FALSE,
+			revoked_reason TEXT NOT NULL DEFAULT '',
+			created_at     {{time}} NOT NULL,
+			updated_at     {{time}} NOT NULL,
+			expires_at     {{time}} NOT NULL
+		)`,
+		`CREATE INDEX refresh_families_user_id ON refresh_families (user_id, revoked)`,
+		`CREATE INDEX refresh_families_expires_at ON refresh_families (expires_at)`,
+		`CREATE TABLE login_failures (
+			username     TEXT PRIMARY KEY,
+			failures     INTEGER NOT NULL,
+			last_failure {{time}} NOT NULL,
+			locked_until {{time}} NOT NULL,
+			expires_at   {{time}} NOT NULL
+		)`,
+		`CREATE INDEX login_failures_expires_at ON login_failures (expires_at)`,
+	},
+	// 3: per-user JWT revocation cutoffs
+	{
+		`CREATE TABLE revoked_users (
+			user_id        VARCHAR(24) PRIMARY KEY,
+			revoked_before {{time}} NOT NULL,
+			expires_at     {{time}} NOT NULL
+		)`,
+		`CREATE INDEX revoked_users_expires_at ON revoked_users (expires_at)`,
+	},
+}
+
+// Migrate brings the schema up to date. dialect is "postgres" or "sqlite".
+func Migrate(ctx context.Context, db *sql.DB, dialect string) error {
+	types, err := dialectTypes(dialect)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at `+types.Replace("{{time}}")+` NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	var current int
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		if err := applyMigration(ctx, db, dialect, version, types.Replace); err != nil {
+			return fmt.Errorf("applying migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, dialect string, version int, expand func(string) string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range migrations[version-1] {
+		if _, err := tx.ExecContext(ctx, expand(statement)); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, rebind(dialect, `INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`),
+		version, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func dialectTypes(dialect string) (*strings.Replacer, error) {
+	switch dialect {
+	case "postgres":
+		return strings.NewReplacer("{{bytes}}", "BYTEA", "{{time}}", "TIMESTAMPTZ"), nil
+	case "sqlite":
+		return strings.NewReplacer("{{bytes}}", "BLOB", "{{time}}", "TIMESTAMP"), nil
+	}
+	return nil, fmt.Errorf("store: unsupported SQL dialect %q", dialect)
+}
@@ -0,0 +1,553 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoCollections names the collection behind each store. States,
+// RevokedTokens, RefreshFamilies and LoginFailures need a TTL index on
+// expires_at.
+type MongoCollections struct {
+	Users           *mongo.Collection
+	Sessions        *mongo.Collection
+	Tokens          *mongo.Collection
+	States          *mongo.Collection
+	RevokedTokens   *mongo.Collection
+	RefreshFamilies *mongo.Collection
+	LoginFailures   *mongo.Collection
+}
+
+// EnsureMongoIndexes creates the indexes the stores rely on in c
+func EnsureMongoIndexes(ctx context.Context, c MongoCollections) error {
+	// Expired records are removed by MongoDB's TTL monitor
+	for _, collection := range []*mongo.Collection{c.States, c.RevokedTokens, c.RefreshFamilies, c.LoginFailures} {
+		_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Logins look users up by username, so it has to be unique. WebAuthn
+	// user handles and credential IDs only exist on some users.
+	_, err := c.Users.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "username", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "webauthn_id", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"webauthn_id": bson.M{"$exists": true}}),
+		},
+		{
+			Keys: bson.D{{Key: "webauthn_credentials.id", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"webauthn_credentials.id": bson.M{"$exists": true}}),
+		},
+	})
+	return err
+}
+
+// NewMongo returns stores backed by the given collections
+func NewMongo(c MongoCollections) Stores {
+	return Stores{
+		Users:    &mongoUsers{c.Users},
+		Sessions: &mongoSessions{c.Sessions},
+		Tokens:   &mongoTokens{c.Tokens},
+
+		States:          &mongoStates{c.States},
+		Revocations:     &mongoRevocations{c.RevokedTokens},
+		RefreshFamilies: &mongoRefreshFamilies{c.RefreshFamilies},
+		Lockouts:        &mongoLockouts{c.LoginFailures},
+	}
+}
+
+// mongoError maps driver errors to the store errors
+func mongoError(err error) error {
+	switch {
+	case err == mongo.ErrNoDocuments:
+		return ErrNotFound
+	case mongo.IsDuplicateKeyError(err):
+		return ErrDuplicate
+	}
+	return err
+}
+
+type mongoUsers struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoUsers) findOne(ctx context.Context, filter bson.M) (models.User, error) {
+	var user models.User
+	err := s.collection.FindOne(ctx, filter).Decode(&user)
+	return user, mongoError(err)
+}
+
+// update applies the update to the user matching id and filter, and returns
+// ErrNotFound if there is none
+func (s *mongoUsers) update(ctx context.Context, id string, filter bson.M, update bson.M) error {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrNotFound
+	}
+	if filter == nil {
+		filter = bson.M{}
+	}
+	filter["_id"] = objectID
+
+	set, _ := update["$set"].(bson.M)
+	if set == nil {
+		set = bson.M{}
+		update["$set"] = set
+	}
+	set["updated_at"] = time.Now()
+
+	result, err := s.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return mongoError(err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoUsers) FindByID(ctx context.Context, id string) (models.User, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return models.User{}, ErrNotFound
+	}
+	return s.findOne(ctx, bson.M{"_id": objectID})
+}
+
+func (s *mongoUsers) FindByUsername(ctx context.Context, username string) (models.User, error) {
+	return s.findOne(ctx, bson.M{"username": username})
+}
+
+func (s *mongoUsers) FindByEmail(ctx context.Context, email string) (models.User, error) {
+	return s.findOne(ctx, bson.M{"email": email})
+}
+
+func (s *mongoUsers) FindByIdentity(ctx context.Context, provider, subject string) (models.User, error) {
+	return s.findOne(ctx, bson.M{
+		"identities": bson.M{"$elemMatch": bson.M{"provider": provider, "subject": subject}},
+	})
+}
+
+func (s *mongoUsers) FindByWebAuthnID(ctx context.Context, handle []byte) (models.User, error) {
+	user, err := s.findOne(ctx, bson.M{"webauthn_id": handle})
+	if err == nil && !bytes.Equal(user.WebAuthnID, handle) {
+		return models.User{}, ErrNotFound
+	}
+	return user, err
+}
+
+func (s *mongoUsers) Create(ctx context.Context, user *models.User) error {
+	if user.ID.IsZero() {
+		user.ID = primitive.NewObjectID()
+	}
+	_, err := s.collection.InsertOne(ctx, user)
+	return mongoError(err)
+}
+
+func (s *mongoUsers) SetRole(ctx context.Context, id, role string) error {
+	return s.update(ctx, id, nil, bson.M{"$set": bson.M{"role": role}})
+}
+
+func (s *mongoUsers) SetPassword(ctx context.Context, id, hash string) error {
+	return s.update(ctx, id, nil, bson.M{"$set": bson.M{"password": hash}})
+}
+
+func (s *mongoUsers) ReplacePasswordHash(ctx context.Context, id, oldHash, newHash string) error {
+	return s.update(ctx, id, bson.M{"password": oldHash}, bson.M{"$set": bson.M{"password": newHash}})
+}
+
+func (s *mongoUsers) SetEmailVerified(ctx context.Context, id, email string) error {
+	return s.update(ctx, id, bson.M{"email": email}, bson.M{"$set": bson.M{"email_verified": true}})
+}
+
+func (s *mongoUsers) AddIdentity(ctx context.Context, id string, identity models.Identity) error {
+	return s.update(ctx, id, nil, bson.M{"$push": bson.M{"identities": identity}})
+}
+
+func (s *mongoUsers) SetPendingTOTPSecret(ctx context.Context, id, secret string) error {
+	return s.update(ctx, id, nil, bson.M{"$set": bson.M{"totp_pending_secret": secret}})
+}
+
+func (s *mongoUsers) EnableMFA(ctx context.Context, id, pendingSecret string, lastStep int64, recoveryCodes []string) error {
+	return s.update(ctx, id, bson.M{"totp_pending_secret": pendingSecret}, bson.M{
+		"$set": bson.M{
+			"mfa_enabled":    true,
+			"totp_secret":    pendingSecret,
+			"totp_last_step": lastStep,
+			"recovery_codes": recoveryCodes,
+		},
+		"$unset": bson.M{"totp_pending_secret": ""},
+	})
+}
+
+func (s *mongoUsers) DisableMFA(ctx context.Context, id string) error {
+	return s.update(ctx, id, nil, bson.M{
+		"$set":   bson.M{"mfa_enabled": false},
+		"$unset": bson.M{"totp_secret": "", "totp_last_step": "", "recovery_codes": ""},
+	})
+}
+
+func (s *mongoUsers) ConsumeTOTPStep(ctx context.Context, id string, step int64) error {
+	return s.update(ctx, id,
+		bson.M{"totp_last_step": bson.M{"$not": bson.M{"$gte": step}}},
+		bson.M{"$set": bson.M{"totp_last_step": step}},
+	)
+}
+
+func (s *mongoUsers) ConsumeRecoveryCode(ctx context.Context, id, hash string) error {
+	return s.update(ctx, id,
+		bson.M{"recovery_codes": hash},
+		bson.M{"$pull": bson.M{"recovery_codes": hash}},
+	)
+}
+
+func (s *mongoUsers) SetWebAuthnID(ctx context.Context, id string, handle []byte) error {
+	err := s.update(ctx, id,
+		bson.M{"webauthn_id": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"webauthn_id": handle}},
+	)
+	if err == ErrNotFound {
+		// Either the user is gone or a concurrent request set a handle first
+		if _, err := s.FindByID(ctx, id); err != nil {
+			return err
+		}
+		return nil
+	}
+	return err
+}
+
+func (s *mongoUsers) AddWebAuthnCredential(ctx context.Context, id string, credential models.WebAuthnCredential) error {
+	// The unique index on webauthn_credentials.id only covers other users
+	count, err := s.collection.CountDocuments(ctx, bson.M{"webauthn_credentials.id": credential.ID})
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrDuplicate
+	}
+	return s.update(ctx, id, nil, bson.M{"$push": bson.M{"webauthn_credentials": credential}})
+}
+
+func (s *mongoUsers) UpdateWebAuthnCredential(ctx context.Context, id string, credential models.WebAuthnCredential) error {
+	match := bson.M{"id": credential.ID}
+	if credential.SignCount != 0 {
+		match["sign_count"] = bson.M{"$lt": credential.SignCount}
+	}
+	return s.update(ctx, id,
+		bson.M{"webauthn_credentials": bson.M{"$elemMatch": match}},
+		bson.M{"$set": bson.M{
+			"webauthn_credentials.$.sign_count":    credential.SignCount,
+			"webauthn_credentials.$.backup_state":  credential.BackupState,
+			"webauthn_credentials.$.last_used_at":  credential.LastUsedAt,
+			"webauthn_credentials.$.user_verified": credential.UserVerified,
+		}},
+	)
+}
+
+type mongoSessions struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoSessions) Create(ctx context.Context, session models.Session) error {
+	_, err := s.collection.InsertOne(ctx, session)
+	return mongoError(err)
+}
+
+func (s *mongoSessions) FindValid(ctx context.Context, id string) (models.Session, error) {
+	var session models.Session
+	err := s.collection.FindOne(ctx, bson.M{
+		"_id":        id,
+		"is_valid":   true,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&session)
+	return session, mongoError(err)
+}
+
+func (s *mongoSessions) ListValid(ctx context.Context, userID string) ([]models.Session, error) {
+	cursor, err := s.collection.Find(ctx,
+		bson.M{"user_id": userID, "is_valid": true},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var sessions []models.Session
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (s *mongoSessions) Touch(ctx context.Context, id string) error {
+	_, err := s.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"last_activity": time.Now()}})
+	return err
+}
+
+func (s *mongoSessions) Invalidate(ctx context.Context, id string) error {
+	_, err := s.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"is_valid": false}})
+	return err
+}
+
+func (s *mongoSessions) InvalidateUser(ctx context.Context, userID string) error {
+	_, err := s.collection.UpdateMany(ctx,
+		bson.M{"user_id": userID, "is_valid": true},
+		bson.M{"$set": bson.M{"is_valid": false}},
+	)
+	return err
+}
+
+type mongoTokens struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoTokens) Create(ctx context.Context, token models.Token) error {
+	_, err := s.collection.InsertOne(ctx, token)
+	return mongoError(err)
+}
+
+func (s *mongoTokens) FindValid(ctx context.Context, value string) (models.Token, error) {
+	var token models.Token
+	err := s.collection.FindOne(ctx, bson.M{
+		"value":      value,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&token)
+	return token, mongoError(err)
+}
+
+func (s *mongoTokens) DeleteUser(ctx context.Context, userID string) error {
+	_, err := s.collection.DeleteMany(ctx, bson.M{"user_id": userID})
+	return err
+}
+
+// The TTL monitor only runs once a minute, so the stores below also check
+// expires_at themselves
+
+type mongoStates struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoStates) Create(ctx context.Context, state State) error {
+	_, err := s.collection.InsertOne(ctx, state)
+	return mongoError(err)
+}
+
+func (s *mongoStates) Find(ctx context.Context, id string) (State, error) {
+	var state State
+	err := s.collection.FindOne(ctx, bson.M{
+		"_id":        id,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&state)
+	return state, mongoError(err)
+}
+
+func (s *mongoStates) Take(ctx context.Context, id string) (State, error) {
+	var state State
+	err := s.collection.FindOneAndDelete(ctx, bson.M{"_id": id}).Decode(&state)
+	if err != nil {
+		return State{}, mongoError(err)
+	}
+	if !state.ExpiresAt.After(time.Now()) {
+		return State{}, ErrNotFound
+	}
+	return state, nil
+}
+
+func (s *mongoStates) CountAttempt(ctx context.Context, id string) (int, error) {
+	var state State
+	err := s.collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "expires_at": bson.M{"$gt": time.Now()}},
+		bson.M{"$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&state)
+	return state.Attempts, mongoError(err)
+}
+
+func (s *mongoStates) DeleteUser(ctx context.Context, kind, userID string) error {
+	_, err := s.collection.DeleteMany(ctx, bson.M{"kind": kind, "user_id": userID})
+	return err
+}
+
+type mongoRevocations struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoRevocations) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	_, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": jti},
+		bson.M{"$set": bson.M{"expires_at": expiresAt, "revoked_at": time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *mongoRevocations) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	count, err := s.collection.CountDocuments(ctx, bson.M{
+		"_id":        jti,
+		"expires_at": bson.M{"$gt": time.Now()},
+	})
+	return count > 0, err
+}
+
+// Per-user cutoffs share the collection, and its TTL index, with revoked
+// JWT IDs. The prefix cannot clash with a jti, which is a UUID.
+func userCutoffID(userID string) string {
+	return "user:" + userID
+}
+
+func (s *mongoRevocations) RevokeUser(ctx context.Context, userID string, before, expiresAt time.Time) error {
+	_, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": userCutoffID(userID)},
+		bson.M{"$set": bson.M{"revoked_before": before, "expires_at": expiresAt, "revoked_at": time.Now()}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *mongoRevocations) RevokedBefore(ctx context.Context, userID string) (time.Time, error) {
+	var cutoff struct {
+		RevokedBefore time.Time `bson:"revoked_before"`
+	}
+	err := s.collection.FindOne(ctx, bson.M{
+		"_id":        userCutoffID(userID),
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&cutoff)
+	if err == mongo.ErrNoDocuments {
+		return time.Time{}, nil
+	}
+	return cutoff.RevokedBefore, err
+}
+
+type mongoRefreshFamilies struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoRefreshFamilies) Create(ctx context.Context, family RefreshFamily) error {
+	_, err := s.collection.InsertOne(ctx, family)
+	return mongoError(err)
+}
+
+func (s *mongoRefreshFamilies) Rotate(ctx context.Context, familyID, presentedJTI, nextJTI string, expiresAt time.Time) (RefreshFamily, error) {
+	now := time.Now()
+
+	// Compare-and-swap on current_jti so two concurrent redemptions of the
+	// same token cannot both succeed
+	var family RefreshFamily
+	err := s.collection.FindOneAndUpdate(ctx, bson.M{
+		"_id":         familyID,
+		"current_jti": presentedJTI,
+		"revoked":     false,
+		"expires_at":  bson.M{"$gt": now},
+	}, bson.M{"$set": bson.M{
+		"current_jti": nextJTI,
+		"updated_at":  now,
+		"expires_at":  expiresAt,
+	}}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&family)
+	if err != mongo.ErrNoDocuments {
+		return family, mongoError(err)
+	}
+
+	// Not the current token: revoke the family if it was still live
+	err = s.collection.FindOneAndUpdate(ctx, bson.M{
+		"_id":        familyID,
+		"revoked":    false,
+		"expires_at": bson.M{"$gt": now},
+	}, bson.M{"$set": bson.M{
+		"revoked":        true,
+		"revoked_reason": "reuse",
+		"updated_at":     now,
+	}}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&family)
+	if err != nil {
+		return RefreshFamily{}, mongoError(err)
+	}
+	return family, ErrReused
+}
+
+func (s *mongoRefreshFamilies) Revoke(ctx context.Context, familyID, reason string) error {
+	_, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": familyID},
+		bson.M{"$set": bson.M{"revoked": true, "revoked_reason": reason, "updated_at": time.Now()}},
+	)
+	return err
+}
+
+func (s *mongoRefreshFamilies) RevokeUser(ctx context.Context, userID, reason string) error {
+	_, err := s.collection.UpdateMany(ctx,
+		bson.M{"user_id": userID, "revoked": false},
+		bson.M{"$set": bson.M{"revoked": true, "revoked_reason": reason, "updated_at": time.Now()}},
+	)
+	return err
+}
+
+type mongoLockouts struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoLockouts) Get(ctx context.Context, username string) (LoginFailures, error) {
+	var f LoginFailures
+	err := s.collection.FindOne(ctx, bson.M{
+		"_id":        username,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&f)
+	if err == mongo.ErrNoDocuments {
+		return LoginFailures{Username: username}, nil
+	}
+	return f, err
+}
+
+func (s *mongoLockouts) RecordFailure(ctx context.Context, username string, resetAfter time.Duration) (LoginFailures, error) {
+	now := time.Now()
+
+	// One pipeline update, so concurrent failures are all counted
+	var f LoginFailures
+	err := s.collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": username},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"count": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{"$expires_at", now}},
+				bson.M{"$add": bson.A{"$count", 1}},
+				1,
+			}},
+			"locked_until": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{"$expires_at", now}},
+				"$locked_until",
+				time.Time{},
+			}},
+			"last_failure": now,
+			"expires_at":   bson.M{"$max": bson.A{"$locked_until", now.Add(resetAfter)}},
+		}}}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&f)
+	return f, err
+}
+
+func (s *mongoLockouts) Lock(ctx context.Context, username string, until time.Time) error {
+	_, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": username},
+		bson.M{"$max": bson.M{"locked_until": until, "expires_at": until}},
+	)
+	return err
+}
+
+func (s *mongoLockouts) Reset(ctx context.Context, username string) error {
+	_, err := s.collection.DeleteOne(ctx, bson.M{"_id": username})
+	return err
+}
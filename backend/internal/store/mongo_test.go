@@ -0,0 +1,62 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// openMongo returns stores in a fresh database on the server at MONGODB_URI,
+// dropped when the test ends
+func openMongo(t *testing.T, client *mongo.Client) Stores {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		t.Fatal(err)
+	}
+	database := client.Database("auth_store_test_" + hex.EncodeToString(suffix))
+	t.Cleanup(func() { database.Drop(context.Background()) })
+
+	collections := MongoCollections{
+		Users:           database.Collection("users"),
+		Sessions:        database.Collection("sessions"),
+		Tokens:          database.Collection("tokens"),
+		States:          database.Collection("auth_states"),
+		RevokedTokens:   database.Collection("revoked_tokens"),
+		RefreshFamilies: database.Collection("refresh_families"),
+		LoginFailures:   database.Collection("login_failures"),
+	}
+	if err := EnsureMongoIndexes(ctx, collections); err != nil {
+		t.Fatalf("EnsureMongoIndexes: %v", err)
+	}
+	return NewMongo(collections)
+}
+
+func TestMongo(t *testing.T) {
+	uri := os.Getenv("MONGODB_URI")
+	if uri == "" {
+		t.Skip("MONGODB_URI is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	if err := client.Ping(ctx, nil); err != nil {
+		t.Fatalf("MongoDB at MONGODB_URI is not reachable: %v", err)
+	}
+
+	testStores(t, func(t *testing.T) Stores { return openMongo(t, client) })
+}
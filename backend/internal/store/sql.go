@@ -0,0 +1,737 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+	"github.com/lib/pq"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// NewSQL returns stores backed by a PostgreSQL or SQLite database. dialect is
+// "postgres" or "sqlite"; run Migrate first.
+func NewSQL(db *sql.DB, dialect string) Stores {
+	s := &sqlStore{db: db, dialect: dialect}
+	return Stores{
+		Users:    &sqlUsers{s},
+		Sessions: &sqlSessions{s},
+		Tokens:   &sqlTokens{s},
+
+		States:          &sqlStates{s},
+		Revocations:     &sqlRevocations{s},
+		RefreshFamilies: &sqlRefreshFamilies{s},
+		Lockouts:        &sqlLockouts{s},
+	}
+}
+
+type sqlStore struct {
+	db      *sql.DB
+	dialect string
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// rebind rewrites ? placeholders to $1, $2, ... for PostgreSQL
+func rebind(dialect, query string) string {
+	if dialect != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) exec(ctx context.Context, q queryer, query string, args ...any) (int64, error) {
+	result, err := q.ExecContext(ctx, rebind(s.dialect, query), args...)
+	if err != nil {
+		return 0, sqlError(err)
+	}
+	return result.RowsAffected()
+}
+
+// inTx runs fn in a transaction, committing if it returns nil
+func (s *sqlStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqlError maps driver errors to the store errors
+func sqlError(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrDuplicate
+	}
+	var liteErr *sqlite.Error
+	if errors.As(err, &liteErr) {
+		switch liteErr.Code() {
+		case sqlite3.SQLITE_CONSTRAINT_UNIQUE, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+			return ErrDuplicate
+		}
+	}
+	return err
+}
+
+func affected(rows int64, err error) error {
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// purgeExpired deletes expired rows from table, standing in for MongoDB's TTL
+// indexes. Timestamps are always written in UTC, so they also compare
+// correctly where SQLite stores them as text.
+func (s *sqlStore) purgeExpired(ctx context.Context, table string) error {
+	_, err := s.exec(ctx, s.db, `DELETE FROM `+table+` WHERE expires_at < ?`, time.Now().UTC())
+	return err
+}
+
+type sqlUsers struct {
+	*sqlStore
+}
+
+const userColumns = `id, username, password, email, role, email_verified, mfa_enabled,
+	totp_secret, totp_pending_secret, totp_last_step, webauthn_id, created_at, updated_at`
+
+// findOne loads the first user matching where, along with the rows that
+// hang off it
+func (s *sqlUsers) findOne(ctx context.Context, where string, args ...any) (models.User, error) {
+	var user models.User
+	var id string
+	err := s.db.QueryRowContext(ctx,
+		rebind(s.dialect, `SELECT `+userColumns+` FROM users WHERE `+where+` ORDER BY created_at LIMIT 1`),
+		args...,
+	).Scan(&id, &user.Username, &user.Password, &user.Email, &user.Role, &user.EmailVerified, &user.MFAEnabled,
+		&user.TOTPSecret, &user.TOTPPendingSecret, &user.TOTPLastStep, &user.WebAuthnID, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		return models.User{}, sqlError(err)
+	}
+	if user.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return models.User{}, err
+	}
+
+	if err := s.loadIdentities(ctx, id, &user); err != nil {
+		return models.User{}, err
+	}
+	if err := s.loadRecoveryCodes(ctx, id, &user); err != nil {
+		return models.User{}, err
+	}
+	if err := s.loadCredentials(ctx, id, &user); err != nil {
+		return models.User{}, err
+	}
+	return user, nil
+}
+
+func (s *sqlUsers) loadIdentities(ctx context.Context, id string, user *models.User) error {
+	rows, err := s.db.QueryContext(ctx, rebind(s.dialect, `SELECT provider, subject FROM user_identities WHERE user_id = ?`), id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var identity models.Identity
+		if err := rows.Scan(&identity.Provider, &identity.Subject); err != nil {
+			return err
+		}
+		user.Identities = append(user.Identities, identity)
+	}
+	return rows.Err()
+}
+
+func (s *sqlUsers) loadRecoveryCodes(ctx context.Context, id string, user *models.User) error {
+	rows, err := s.db.QueryContext(ctx, rebind(s.dialect, `SELECT hash FROM recovery_codes WHERE user_id = ?`), id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return err
+		}
+		user.RecoveryCodes = append(user.RecoveryCodes, hash)
+	}
+	return rows.Err()
+}
+
+func (s *sqlUsers) loadCredentials(ctx context.Context, id string, user *models.User) error {
+	rows, err := s.db.QueryContext(ctx, rebind(s.dialect, `SELECT id, public_key, attestation_type, transports, aaguid,
+		sign_count, user_verified, backup_eligible, backup_state, created_at, last_used_at
+		FROM webauthn_credentials WHERE user_id = ?`), id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var credential models.WebAuthnCredential
+		var transports string
+		var signCount int64
+		var lastUsed sql.NullTime
+		err := rows.Scan(&credential.ID, &credential.PublicKey, &credential.AttestationType, &transports, &credential.AAGUID,
+			&signCount, &credential.UserVerified, &credential.BackupEligible, &credential.BackupState, &credential.CreatedAt, &lastUsed)
+		if err != nil {
+			return err
+		}
+		credential.Transports = strings.Fields(transports)
+		credential.SignCount = uint32(signCount)
+		credential.LastUsedAt = lastUsed.Time
+		user.WebAuthnCredentials = append(user.WebAuthnCredentials, credential)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	sort.Slice(user.WebAuthnCredentials, func(i, j int) bool {
+		return user.WebAuthnCredentials[i].CreatedAt.Before(user.WebAuthnCredentials[j].CreatedAt)
+	})
+	return nil
+}
+
+// touch bumps updated_at and reports ErrNotFound for an unknown user
+func (s *sqlUsers) touch(ctx context.Context, q queryer, id string) error {
+	return affected(s.exec(ctx, q, `UPDATE users SET updated_at = ? WHERE id = ?`, time.Now().UTC(), id))
+}
+
+func (s *sqlUsers) FindByID(ctx context.Context, id string) (models.User, error) {
+	return s.findOne(ctx, `id = ?`, id)
+}
+
+func (s *sqlUsers) FindByUsername(ctx context.Context, username string) (models.User, error) {
+	return s.findOne(ctx, `username = ?`, username)
+}
+
+func (s *sqlUsers) FindByEmail(ctx context.Context, email string) (models.User, error) {
+	return s.findOne(ctx, `email = ?`, email)
+}
+
+func (s *sqlUsers) FindByIdentity(ctx context.Context, provider, subject string) (models.User, error) {
+	return s.findOne(ctx, `id = (SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?)`, provider, subject)
+}
+
+func (s *sqlUsers) FindByWebAuthnID(ctx context.Context, handle []byte) (models.User, error) {
+	if len(handle) == 0 {
+		return models.User{}, ErrNotFound
+	}
+	return s.findOne(ctx, `webauthn_id = ?`, handle)
+}
+
+func (s *sqlUsers) Create(ctx context.Context, user *models.User) error {
+	if user.ID.IsZero() {
+		user.ID = primitive.NewObjectID()
+	}
+	id := user.ID.Hex()
+
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		var webauthnID []byte
+		if len(user.WebAuthnID) > 0 {
+			webauthnID = user.WebAuthnID
+		}
+		_, err := s.exec(ctx, tx, `INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, user.Username, user.Password, user.Email, user.Role, user.EmailVerified, user.MFAEnabled,
+			user.TOTPSecret, user.TOTPPendingSecret, user.TOTPLastStep, webauthnID, user.CreatedAt.UTC(), user.UpdatedAt.UTC())
+		if err != nil {
+			return err
+		}
+
+		for _, identity := range user.Identities {
+			if _, err := s.exec(ctx, tx, `INSERT INTO user_identities (provider, subject, user_id) VALUES (?, ?, ?)`,
+				identity.Provider, identity.Subject, id); err != nil {
+				return err
+			}
+		}
+		for _, hash := range user.RecoveryCodes {
+			if _, err := s.exec(ctx, tx, `INSERT INTO recovery_codes (user_id, hash) VALUES (?, ?)`, id, hash); err != nil {
+				return err
+			}
+		}
+		for _, credential := range user.WebAuthnCredentials {
+			if err := s.insertCredential(ctx, tx, id, credential); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlUsers) insertCredential(ctx context.Context, q queryer, id string, credential models.WebAuthnCredential) error {
+	var lastUsed sql.NullTime
+	if !credential.LastUsedAt.IsZero() {
+		lastUsed = sql.NullTime{Time: credential.LastUsedAt.UTC(), Valid: true}
+	}
+	_, err := s.exec(ctx, q, `INSERT INTO webauthn_credentials (id, user_id, public_key, attestation_type, transports, aaguid,
+		sign_count, user_verified, backup_eligible, backup_state, created_at, last_used_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		credential.ID, id, credential.PublicKey, credential.AttestationType, strings.Join(credential.Transports, " "), credential.AAGUID,
+		int64(credential.SignCount), credential.UserVerified, credential.BackupEligible, credential.BackupState,
+		credential.CreatedAt.UTC(), lastUsed)
+	return err
+}
+
+func (s *sqlUsers) SetRole(ctx context.Context, id, role string) error {
+	return affected(s.exec(ctx, s.db, `UPDATE users SET role = ?, updated_at = ? WHERE id = ?`, role, time.Now().UTC(), id))
+}
+
+func (s *sqlUsers) SetPassword(ctx context.Context, id, hash string) error {
+	return affected(s.exec(ctx, s.db, `UPDATE users SET password = ?, updated_at = ? WHERE id = ?`, hash, time.Now().UTC(), id))
+}
+
+func (s *sqlUsers) ReplacePasswordHash(ctx context.Context, id, oldHash, newHash string) error {
+	return affected(s.exec(ctx, s.db, `UPDATE users SET password = ?, updated_at = ? WHERE id = ? AND password = ?`,
+		newHash, time.Now().UTC(), id, oldHash))
+}
+
+func (s *sqlUsers) SetEmailVerified(ctx context.Context, id, email string) error {
+	return affected(s.exec(ctx, s.db, `UPDATE users SET email_verified = ?, updated_at = ? WHERE id = ? AND email = ?`,
+		true, time.Now().UTC(), id, email))
+}
+
+func (s *sqlUsers) AddIdentity(ctx context.Context, id string, identity models.Identity) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := s.touch(ctx, tx, id); err != nil {
+			return err
+		}
+		_, err := s.exec(ctx, tx, `INSERT INTO user_identities (provider, subject, user_id) VALUES (?, ?, ?)`,
+			identity.Provider, identity.Subject, id)
+		return err
+	})
+}
+
+func (s *sqlUsers) SetPendingTOTPSecret(ctx context.Context, id, secret string) error {
+	return affected(s.exec(ctx, s.db, `UPDATE users SET totp_pending_secret = ?, updated_at = ? WHERE id = ?`,
+		secret, time.Now().UTC(), id))
+}
+
+func (s *sqlUsers) EnableMFA(ctx context.Context, id, pendingSecret string, lastStep int64, recoveryCodes []string) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		err := affected(s.exec(ctx, tx, `UPDATE users
+			SET mfa_enabled = ?, totp_secret = totp_pending_secret, totp_pending_secret = '', totp_last_step = ?, updated_at = ?
+			WHERE id = ? AND totp_pending_secret = ? AND totp_pending_secret <> ''`,
+			true, lastStep, time.Now().UTC(), id, pendingSecret))
+		if err != nil {
+			return err
+		}
+		if _, err := s.exec(ctx, tx, `DELETE FROM recovery_codes WHERE user_id = ?`, id); err != nil {
+			return err
+		}
+		for _, hash := range recoveryCodes {
+			if _, err := s.exec(ctx, tx, `INSERT INTO recovery_codes (user_id, hash) VALUES (?, ?)`, id, hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlUsers) DisableMFA(ctx context.Context, id string) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		err := affected(s.exec(ctx, tx, `UPDATE users SET mfa_enabled = ?, totp_secret = '', totp_last_step = 0, updated_at = ? WHERE id = ?`,
+			false, time.Now().UTC(), id))
+		if err != nil {
+			return err
+		}
+		_, err = s.exec(ctx, tx, `DELETE FROM recovery_codes WHERE user_id = ?`, id)
+		return err
+	})
+}
+
+func (s *sqlUsers) ConsumeTOTPStep(ctx context.Context, id string, step int64) error {
+	return affected(s.exec(ctx, s.db, `UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?`, step, id, step))
+}
+
+func (s *sqlUsers) ConsumeRecoveryCode(ctx context.Context, id, hash string) error {
+	return affected(s.exec(ctx, s.db, `DELETE FROM recovery_codes WHERE user_id = ? AND hash = ?`, id, hash))
+}
+
+func (s *sqlUsers) SetWebAuthnID(ctx context.Context, id string, handle []byte) error {
+	rows, err := s.exec(ctx, s.db, `UPDATE users SET webauthn_id = ?, updated_at = ? WHERE id = ? AND webauthn_id IS NULL`,
+		handle, time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		// Either the user is gone or a concurrent request set a handle first
+		var exists int
+		err := s.db.QueryRowContext(ctx, rebind(s.dialect, `SELECT 1 FROM users WHERE id = ?`), id).Scan(&exists)
+		return sqlError(err)
+	}
+	return nil
+}
+
+func (s *sqlUsers) AddWebAuthnCredential(ctx context.Context, id string, credential models.WebAuthnCredential) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := s.touch(ctx, tx, id); err != nil {
+			return err
+		}
+		return s.insertCredential(ctx, tx, id, credential)
+	})
+}
+
+func (s *sqlUsers) UpdateWebAuthnCredential(ctx context.Context, id string, credential models.WebAuthnCredential) error {
+	signCount := int64(credential.SignCount)
+	return affected(s.exec(ctx, s.db, `UPDATE webauthn_credentials
+		SET sign_count = ?, backup_state = ?, last_used_at = ?, user_verified = ?
+		WHERE id = ? AND user_id = ? AND (? = 0 OR sign_count < ?)`,
+		signCount, credential.BackupState, credential.LastUsedAt.UTC(), credential.UserVerified,
+		credential.ID, id, signCount, signCount))
+}
+
+type sqlSessions struct {
+	*sqlStore
+}
+
+const sessionColumns = `id, user_id, auth_method, user_agent, ip_address, last_activity, created_at, expires_at, is_valid`
+
+func scanSession(row interface{ Scan(...any) error }) (models.Session, error) {
+	var session models.Session
+	err := row.Scan(&session.ID, &session.UserID, &session.AuthMethod, &session.UserAgent, &session.IPAddress,
+		&session.LastActivity, &session.CreatedAt, &session.ExpiresAt, &session.IsValid)
+	return session, err
+}
+
+func (s *sqlSessions) Create(ctx context.Context, session models.Session) error {
+	if err := s.purgeExpired(ctx, "sessions"); err != nil {
+		return err
+	}
+	_, err := s.exec(ctx, s.db, `INSERT INTO sessions (`+sessionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.ID, session.UserID, session.AuthMethod, session.UserAgent, session.IPAddress,
+		session.LastActivity.UTC(), session.CreatedAt.UTC(), session.ExpiresAt.UTC(), session.IsValid)
+	return err
+}
+
+func (s *sqlSessions) FindValid(ctx context.Context, id string) (models.Session, error) {
+	session, err := scanSession(s.db.QueryRowContext(ctx,
+		rebind(s.dialect, `SELECT `+sessionColumns+` FROM sessions WHERE id = ?`), id))
+	if err != nil {
+		return models.Session{}, sqlError(err)
+	}
+	if !session.IsValid || !session.ExpiresAt.After(time.Now()) {
+		return models.Session{}, ErrNotFound
+	}
+	return session, nil
+}
+
+func (s *sqlSessions) ListValid(ctx context.Context, userID string) ([]models.Session, error) {
+	rows, err := s.db.QueryContext(ctx,
+		rebind(s.dialect, `SELECT `+sessionColumns+` FROM sessions WHERE user_id = ? AND is_valid = ?`), userID, true)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []models.Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.Before(sessions[j].CreatedAt) })
+	return sessions, nil
+}
+
+func (s *sqlSessions) Touch(ctx context.Context, id string) error {
+	_, err := s.exec(ctx, s.db, `UPDATE sessions SET last_activity = ? WHERE id = ?`, time.Now().UTC(), id)
+	return err
+}
+
+func (s *sqlSessions) Invalidate(ctx context.Context, id string) error {
+	_, err := s.exec(ctx, s.db, `UPDATE sessions SET is_valid = ? WHERE id = ?`, false, id)
+	return err
+}
+
+func (s *sqlSessions) InvalidateUser(ctx context.Context, userID string) error {
+	_, err := s.exec(ctx, s.db, `UPDATE sessions SET is_valid = ? WHERE user_id = ? AND is_valid = ?`, false, userID, true)
+	return err
+}
+
+type sqlTokens struct {
+	*sqlStore
+}
+
+func (s *sqlTokens) Create(ctx context.Context, token models.Token) error {
+	if err := s.purgeExpired(ctx, "tokens"); err != nil {
+		return err
+	}
+	_, err := s.exec(ctx, s.db, `INSERT INTO tokens (value, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		token.Value, token.UserID, token.CreatedAt.UTC(), token.ExpiresAt.UTC())
+	return err
+}
+
+func (s *sqlTokens) FindValid(ctx context.Context, value string) (models.Token, error) {
+	var token models.Token
+	err := s.db.QueryRowContext(ctx,
+		rebind(s.dialect, `SELECT value, user_id, created_at, expires_at FROM tokens WHERE value = ?`), value,
+	).Scan(&token.Value, &token.UserID, &token.CreatedAt, &token.ExpiresAt)
+	if err != nil {
+		return models.Token{}, sqlError(err)
+	}
+	if !token.ExpiresAt.After(time.Now()) {
+		return models.Token{}, ErrNotFound
+	}
+	return token, nil
+}
+
+func (s *sqlTokens) DeleteUser(ctx context.Context, userID string) error {
+	_, err := s.exec(ctx, s.db, `DELETE FROM tokens WHERE user_id = ?`, userID)
+	return err
+}
+
+type sqlStates struct {
+	*sqlStore
+}
+
+const stateColumns = `id, kind, user_id, data, attempts, created_at, expires_at`
+
+func scanState(row interface{ Scan(...any) error }) (State, error) {
+	var state State
+	err := row.Scan(&state.ID, &state.Kind, &state.UserID, &state.Data, &state.Attempts, &state.CreatedAt, &state.ExpiresAt)
+	return state, sqlError(err)
+}
+
+func (s *sqlStates) Create(ctx context.Context, state State) error {
+	if err := s.purgeExpired(ctx, "auth_states"); err != nil {
+		return err
+	}
+	_, err := s.exec(ctx, s.db, `INSERT INTO auth_states (`+stateColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		state.ID, state.Kind, state.UserID, state.Data, state.Attempts, state.CreatedAt.UTC(), state.ExpiresAt.UTC())
+	return err
+}
+
+func (s *sqlStates) Find(ctx context.Context, id string) (State, error) {
+	return scanState(s.db.QueryRowContext(ctx,
+		rebind(s.dialect, `SELECT `+stateColumns+` FROM auth_states WHERE id = ? AND expires_at > ?`), id, time.Now().UTC()))
+}
+
+func (s *sqlStates) Take(ctx context.Context, id string) (State, error) {
+	state, err := scanState(s.db.QueryRowContext(ctx,
+		rebind(s.dialect, `DELETE FROM auth_states WHERE id = ? RETURNING `+stateColumns), id))
+	if err != nil {
+		return State{}, err
+	}
+	if !state.ExpiresAt.After(time.Now()) {
+		return State{}, ErrNotFound
+	}
+	return state, nil
+}
+
+func (s *sqlStates) CountAttempt(ctx context.Context, id string) (int, error) {
+	var attempts int
+	err := s.db.QueryRowContext(ctx,
+		rebind(s.dialect, `UPDATE auth_states SET attempts = attempts + 1 WHERE id = ? AND expires_at > ? RETURNING attempts`),
+		id, time.Now().UTC(),
+	).Scan(&attempts)
+	return attempts, sqlError(err)
+}
+
+func (s *sqlStates) DeleteUser(ctx context.Context, kind, userID string) error {
+	_, err := s.exec(ctx, s.db, `DELETE FROM auth_states WHERE kind = ? AND user_id = ?`, kind, userID)
+	return err
+}
+
+type sqlRevocations struct {
+	*sqlStore
+}
+
+func (s *sqlRevocations) Revoke(ctx context.Context, jti string, expiresAt time.Time) error {
+	if err := s.purgeExpired(ctx, "revoked_tokens"); err != nil {
+		return err
+	}
+	_, err := s.exec(ctx, s.db, `INSERT INTO revoked_tokens (jti, revoked_at, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (jti) DO UPDATE SET revoked_at = excluded.revoked_at, expires_at = excluded.expires_at`,
+		jti, time.Now().UTC(), expiresAt.UTC())
+	return err
+}
+
+func (s *sqlRevocations) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	var revoked int
+	err := s.db.QueryRowContext(ctx,
+		rebind(s.dialect, `SELECT 1 FROM revoked_tokens WHERE jti = ? AND expires_at > ?`), jti, time.Now().UTC(),
+	).Scan(&revoked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *sqlRevocations) RevokeUser(ctx context.Context, userID string, before, expiresAt time.Time) error {
+	if err := s.purgeExpired(ctx, "revoked_users"); err != nil {
+		return err
+	}
+	_, err := s.exec(ctx, s.db, `INSERT INTO revoked_users (user_id, revoked_before, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET revoked_before = excluded.revoked_before, expires_at = excluded.expires_at`,
+		userID, before.UTC(), expiresAt.UTC())
+	return err
+}
+
+func (s *sqlRevocations) RevokedBefore(ctx context.Context, userID string) (time.Time, error) {
+	var before time.Time
+	err := s.db.QueryRowContext(ctx,
+		rebind(s.dialect, `SELECT revoked_before FROM revoked_users WHERE user_id = ? AND expires_at > ?`), userID, time.Now().UTC(),
+	).Scan(&before)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return before, err
+}
+
+type sqlRefreshFamilies struct {
+	*sqlStore
+}
+
+const familyColumns = `id, user_id, current_jti, revoked, revoked_reason, created_at, updated_at, expires_at`
+
+func scanFamily(row interface{ Scan(...any) error }) (RefreshFamily, error) {
+	var family RefreshFamily
+	err := row.Scan(&family.ID, &family.UserID, &family.CurrentJTI, &family.Revoked, &family.RevokedReason,
+		&family.CreatedAt, &family.UpdatedAt, &family.ExpiresAt)
+	return family, sqlError(err)
+}
+
+func (s *sqlRefreshFamilies) Create(ctx context.Context, family RefreshFamily) error {
+	if err := s.purgeExpired(ctx, "refresh_families"); err != nil {
+		return err
+	}
+	_, err := s.exec(ctx, s.db, `INSERT INTO refresh_families (`+familyColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		family.ID, family.UserID, family.CurrentJTI, family.Revoked, family.RevokedReason,
+		family.CreatedAt.UTC(), family.UpdatedAt.UTC(), family.ExpiresAt.UTC())
+	return err
+}
+
+func (s *sqlRefreshFamilies) Rotate(ctx context.Context, familyID, presentedJTI, nextJTI string, expiresAt time.Time) (RefreshFamily, error) {
+	now := time.Now().UTC()
+
+	// Compare-and-swap on current_jti so two concurrent redemptions of the
+	// same token cannot both succeed
+	family, err := scanFamily(s.db.QueryRowContext(ctx, rebind(s.dialect, `UPDATE refresh_families
+		SET current_jti = ?, updated_at = ?, expires_at = ?
+		WHERE id = ? AND current_jti = ? AND revoked = ? AND expires_at > ?
+		RETURNING `+familyColumns),
+		nextJTI, now, expiresAt.UTC(), familyID, presentedJTI, false, now))
+	if err != ErrNotFound {
+		return family, err
+	}
+
+	// Not the current token: revoke the family if it was still live
+	family, err = scanFamily(s.db.QueryRowContext(ctx, rebind(s.dialect, `UPDATE refresh_families
+		SET revoked = ?, revoked_reason = ?, updated_at = ?
+		WHERE id = ? AND revoked = ? AND expires_at > ?
+		RETURNING `+familyColumns),
+		true, "reuse", now, familyID, false, now))
+	if err != nil {
+		return RefreshFamily{}, err
+	}
+	return family, ErrReused
+}
+
+func (s *sqlRefreshFamilies) Revoke(ctx context.Context, familyID, reason string) error {
+	_, err := s.exec(ctx, s.db, `UPDATE refresh_families SET revoked = ?, revoked_reason = ?, updated_at = ? WHERE id = ?`,
+		true, reason, time.Now().UTC(), familyID)
+	return err
+}
+
+func (s *sqlRefreshFamilies) RevokeUser(ctx context.Context, userID, reason string) error {
+	_, err := s.exec(ctx, s.db, `UPDATE refresh_families SET revoked = ?, revoked_reason = ?, updated_at = ?
+		WHERE user_id = ? AND revoked = ?`,
+		true, reason, time.Now().UTC(), userID, false)
+	return err
+}
+
+type sqlLockouts struct {
+	*sqlStore
+}
+
+const lockoutColumns = `username, failures, last_failure, locked_until, expires_at`
+
+func scanLoginFailures(row interface{ Scan(...any) error }) (LoginFailures, error) {
+	var f LoginFailures
+	err := row.Scan(&f.Username, &f.Count, &f.LastFailure, &f.LockedUntil, &f.ExpiresAt)
+	return f, sqlError(err)
+}
+
+func (s *sqlLockouts) Get(ctx context.Context, username string) (LoginFailures, error) {
+	f, err := scanLoginFailures(s.db.QueryRowContext(ctx,
+		rebind(s.dialect, `SELECT `+lockoutColumns+` FROM login_failures WHERE username = ? AND expires_at > ?`),
+		username, time.Now().UTC()))
+	if err == ErrNotFound {
+		return LoginFailures{Username: username}, nil
+	}
+	return f, err
+}
+
+func (s *sqlLockouts) RecordFailure(ctx context.Context, username string, resetAfter time.Duration) (LoginFailures, error) {
+	if err := s.purgeExpired(ctx, "login_failures"); err != nil {
+		return LoginFailures{}, err
+	}
+
+	// One upsert, so concurrent failures are all counted. A count that has
+	// expired but not yet been purged starts over.
+	now := time.Now().UTC()
+	return scanLoginFailures(s.db.QueryRowContext(ctx, rebind(s.dialect, `INSERT INTO login_failures (`+lockoutColumns+`)
+		VALUES (?, 1, ?, ?, ?)
+		ON CONFLICT (username) DO UPDATE SET
+			failures = CASE WHEN login_failures.expires_at > excluded.last_failure
+				THEN login_failures.failures + 1 ELSE 1 END,
+			locked_until = CASE WHEN login_failures.expires_at > excluded.last_failure
+				THEN login_failures.locked_until ELSE excluded.locked_until END,
+			expires_at = CASE WHEN login_failures.locked_until > excluded.expires_at
+				THEN login_failures.locked_until ELSE excluded.expires_at END,
+			last_failure = excluded.last_failure
+		RETURNING `+lockoutColumns),
+		username, now, time.Time{}.UTC(), now.Add(resetAfter)))
+}
+
+func (s *sqlLockouts) Lock(ctx context.Context, username string, until time.Time) error {
+	until = until.UTC()
+	_, err := s.exec(ctx, s.db, `UPDATE login_failures SET
+		locked_until = CASE WHEN locked_until < ? THEN ? ELSE locked_until END,
+		expires_at = CASE WHEN expires_at < ? THEN ? ELSE expires_at END
+		WHERE username = ?`,
+		until, until, until, until, username)
+	return err
+}
+
+func (s *sqlLockouts) Reset(ctx context.Context, username string) error {
+	_, err := s.exec(ctx, s.db, `DELETE FROM login_failures WHERE username = ?`, username)
+	return err
+}
@@ -0,0 +1,67 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+// openSQLite returns a migrated database in a temporary file
+func openSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	if err := Migrate(context.Background(), db, "sqlite"); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	return db
+}
+
+func TestSQLite(t *testing.T) {
+	testStores(t, func(t *testing.T) Stores { return NewSQL(openSQLite(t), "sqlite") })
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t)
+
+	// Running again applies nothing new
+	if err := Migrate(ctx, db, "sqlite"); err != nil {
+		t.Fatalf("second Migrate: %v", err)
+	}
+	var version, count int
+	if err := db.QueryRow(`SELECT MAX(version), COUNT(*) FROM schema_migrations`).Scan(&version, &count); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) || count != len(migrations) {
+		t.Fatalf("schema_migrations has %d rows up to version %d, want %d", count, version, len(migrations))
+	}
+
+	for _, table := range []string{"users", "sessions", "tokens", "auth_states", "revoked_tokens", "refresh_families", "login_failures", "revoked_users"} {
+		if _, err := db.Exec(`SELECT COUNT(*) FROM ` + table); err != nil {
+			t.Errorf("table %s: %v", table, err)
+		}
+	}
+
+	if err := Migrate(ctx, db, "oracle"); err == nil {
+		t.Fatal("Migrate accepted an unknown dialect")
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := `SELECT * FROM users WHERE id = ? AND email = ?`
+	if got := rebind("sqlite", query); got != query {
+		t.Fatalf("rebind(sqlite) = %q", got)
+	}
+	if got, want := rebind("postgres", query), `SELECT * FROM users WHERE id = $1 AND email = $2`; got != want {
+		t.Fatalf("rebind(postgres) = %q, want %q", got, want)
+	}
+}
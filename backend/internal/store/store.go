@@ -0,0 +1,189 @@
+// Package store defines the persistence interfaces the auth handlers use for
+// users, sessions, tokens and the security state around them, with MongoDB,
+// SQL and in-memory implementations.
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+)
+
+var (
+	// ErrNotFound is returned when no record matches. Conditional updates
+	// also return it when their condition does not hold.
+	ErrNotFound = errors.New("store: not found")
+	// ErrDuplicate is returned when a record would break a uniqueness rule,
+	// such as a taken username or an already registered WebAuthn credential
+	ErrDuplicate = errors.New("store: duplicate")
+	// ErrReused is returned by RefreshFamilyStore.Rotate when the presented
+	// token has already been rotated
+	ErrReused = errors.New("store: refresh token reused")
+)
+
+// Stores groups the stores the auth handlers depend on
+type Stores struct {
+	Users           UserStore
+	Sessions        SessionStore
+	Tokens          TokenStore
+	States          StateStore
+	Revocations     RevocationStore
+	RefreshFamilies RefreshFamilyStore
+	Lockouts        LockoutStore
+}
+
+// UserStore persists user accounts. IDs are hex encoded ObjectIDs.
+type UserStore interface {
+	FindByID(ctx context.Context, id string) (models.User, error)
+	FindByUsername(ctx context.Context, username string) (models.User, error)
+	// FindByEmail returns a user with the address. Addresses are not unique,
+	// so unverified OAuth accounts may share one with another user.
+	FindByEmail(ctx context.Context, email string) (models.User, error)
+	FindByIdentity(ctx context.Context, provider, subject string) (models.User, error)
+	FindByWebAuthnID(ctx context.Context, handle []byte) (models.User, error)
+
+	// Create inserts the user and sets its ID. It returns ErrDuplicate if the
+	// username is taken.
+	Create(ctx context.Context, user *models.User) error
+	SetRole(ctx context.Context, id, role string) error
+	SetPassword(ctx context.Context, id, hash string) error
+	// ReplacePasswordHash swaps in a new hash of the same password, provided
+	// the stored hash is still oldHash
+	ReplacePasswordHash(ctx context.Context, id, oldHash, newHash string) error
+	// SetEmailVerified marks the address verified, provided it is still the
+	// user's address
+	SetEmailVerified(ctx context.Context, id, email string) error
+	AddIdentity(ctx context.Context, id string, identity models.Identity) error
+
+	SetPendingTOTPSecret(ctx context.Context, id, secret string) error
+	// EnableMFA promotes the pending TOTP secret, provided it is still
+	// pendingSecret, and stores the hashed recovery codes
+	EnableMFA(ctx context.Context, id, pendingSecret string, lastStep int64, recoveryCodes []string) error
+	DisableMFA(ctx context.Context, id string) error
+	// ConsumeTOTPStep records step as used, provided it is later than the last
+	// used step
+	ConsumeTOTPStep(ctx context.Context, id string, step int64) error
+	// ConsumeRecoveryCode removes the hashed recovery code, provided the user
+	// still has it
+	ConsumeRecoveryCode(ctx context.Context, id, hash string) error
+
+	// SetWebAuthnID sets the user handle unless the user already has one
+	SetWebAuthnID(ctx context.Context, id string, handle []byte) error
+	// AddWebAuthnCredential returns ErrDuplicate if any user has already
+	// registered the credential
+	AddWebAuthnCredential(ctx context.Context, id string, credential models.WebAuthnCredential) error
+	// UpdateWebAuthnCredential stores the sign count, flags and last use of a
+	// credential. A non-zero sign count must be higher than the stored one, so
+	// a replayed assertion is rejected.
+	UpdateWebAuthnCredential(ctx context.Context, id string, credential models.WebAuthnCredential) error
+}
+
+// SessionStore persists login sessions
+type SessionStore interface {
+	// Create returns ErrDuplicate if the session ID is taken
+	Create(ctx context.Context, session models.Session) error
+	// FindValid returns the session if it is valid and has not expired
+	FindValid(ctx context.Context, id string) (models.Session, error)
+	// ListValid returns the user's valid sessions, oldest first
+	ListValid(ctx context.Context, userID string) ([]models.Session, error)
+	Touch(ctx context.Context, id string) error
+	Invalidate(ctx context.Context, id string) error
+	InvalidateUser(ctx context.Context, userID string) error
+}
+
+// TokenStore persists opaque bearer tokens
+type TokenStore interface {
+	Create(ctx context.Context, token models.Token) error
+	// FindValid returns the token if it has not expired
+	FindValid(ctx context.Context, value string) (models.Token, error)
+	DeleteUser(ctx context.Context, userID string) error
+}
+
+// State is a short-lived, single-use record kept between two legs of a flow,
+// such as an OAuth redirect and its callback. ID is derived from the secret
+// the client holds, never the secret itself.
+type State struct {
+	ID   string `bson:"_id"`
+	Kind string `bson:"kind"`
+	// UserID is set for records a user's credential change should cancel
+	UserID    string    `bson:"user_id,omitempty"`
+	Data      []byte    `bson:"data"`
+	Attempts  int       `bson:"attempts"`
+	CreatedAt time.Time `bson:"created_at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// StateStore persists flow state. Expired records are treated as missing.
+type StateStore interface {
+	// Create returns ErrDuplicate if the ID is taken
+	Create(ctx context.Context, state State) error
+	Find(ctx context.Context, id string) (State, error)
+	// Take removes the record and returns it, so it can only be redeemed once
+	Take(ctx context.Context, id string) (State, error)
+	// CountAttempt increments the record's attempt count and returns it
+	CountAttempt(ctx context.Context, id string) (int, error)
+	// DeleteUser removes the user's records of the given kind
+	DeleteUser(ctx context.Context, kind, userID string) error
+}
+
+// RevocationStore records revoked JWT IDs (jti) until the tokens would have
+// expired anyway
+type RevocationStore interface {
+	Revoke(ctx context.Context, jti string, expiresAt time.Time) error
+	IsRevoked(ctx context.Context, jti string) (bool, error)
+	// RevokeUser revokes every token issued to the user before the cutoff,
+	// replacing any earlier cutoff. The record is kept until expiresAt, by
+	// which time those tokens have run out.
+	RevokeUser(ctx context.Context, userID string, before, expiresAt time.Time) error
+	// RevokedBefore returns the user's cutoff, or the zero time if none
+	RevokedBefore(ctx context.Context, userID string) (time.Time, error)
+}
+
+// RefreshFamily tracks the chain of refresh tokens issued from one login.
+// Only the most recently issued token (CurrentJTI) may be redeemed.
+type RefreshFamily struct {
+	ID            string    `bson:"_id"`
+	UserID        string    `bson:"user_id"`
+	CurrentJTI    string    `bson:"current_jti"`
+	Revoked       bool      `bson:"revoked"`
+	RevokedReason string    `bson:"revoked_reason,omitempty"`
+	CreatedAt     time.Time `bson:"created_at"`
+	UpdatedAt     time.Time `bson:"updated_at"`
+	ExpiresAt     time.Time `bson:"expires_at"`
+}
+
+// RefreshFamilyStore persists refresh token families
+type RefreshFamilyStore interface {
+	Create(ctx context.Context, family RefreshFamily) error
+	// Rotate replaces presentedJTI with nextJTI, provided presentedJTI is the
+	// current token. Otherwise it revokes the family and returns ErrReused.
+	// Unknown, revoked and expired families give ErrNotFound.
+	Rotate(ctx context.Context, familyID, presentedJTI, nextJTI string, expiresAt time.Time) (RefreshFamily, error)
+	Revoke(ctx context.Context, familyID, reason string) error
+	RevokeUser(ctx context.Context, userID, reason string) error
+}
+
+// LoginFailures counts consecutive failed logins for a username. Usernames
+// are tracked whether or not an account exists, so lockouts reveal nothing.
+type LoginFailures struct {
+	Username    string    `bson:"_id"`
+	Count       int       `bson:"count"`
+	LastFailure time.Time `bson:"last_failure"`
+	LockedUntil time.Time `bson:"locked_until"`
+	// ExpiresAt is when the count is forgotten without further failures
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// LockoutStore persists failed login counts
+type LockoutStore interface {
+	// Get returns the failures for username, or a zero count
+	Get(ctx context.Context, username string) (LoginFailures, error)
+	// RecordFailure counts a failure and returns the updated record. Counts
+	// that have expired start over.
+	RecordFailure(ctx context.Context, username string, resetAfter time.Duration) (LoginFailures, error)
+	// Lock keeps username locked until at least until
+	Lock(ctx context.Context, username string, until time.Time) error
+	Reset(ctx context.Context, username string) error
+}
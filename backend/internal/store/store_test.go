@@ -0,0 +1,470 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NoorBnHossam/Authentication_Types/internal/models"
+)
+
+// testStores runs the behaviour every implementation must share against
+// fresh stores from open
+func testStores(t *testing.T, open func(t *testing.T) Stores) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s Stores)
+	}{
+		{"Users", testUsers},
+		{"Sessions", testSessions},
+		{"Tokens", testTokens},
+		{"States", testStates},
+		{"Revocations", testRevocations},
+		{"RefreshFamilies", testRefreshFamilies},
+		{"Lockouts", testLockouts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, open(t))
+		})
+	}
+}
+
+func newUser(username string) *models.User {
+	now := time.Now().Truncate(time.Millisecond)
+	return &models.User{Username: username, Password: "hash", Email: username + "@example.com", CreatedAt: now, UpdatedAt: now}
+}
+
+func testUsers(t *testing.T, s Stores) {
+	ctx := context.Background()
+
+	alice := newUser("alice")
+	if err := s.Users.Create(ctx, alice); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if alice.ID.IsZero() {
+		t.Fatal("Create did not set the ID")
+	}
+	if err := s.Users.Create(ctx, newUser("alice")); err != ErrDuplicate {
+		t.Fatalf("Create with a taken username = %v, want ErrDuplicate", err)
+	}
+
+	id := alice.ID.Hex()
+	got, err := s.Users.FindByUsername(ctx, "alice")
+	if err != nil || got.ID != alice.ID || got.Email != alice.Email {
+		t.Fatalf("FindByUsername = %+v, %v", got, err)
+	}
+	if _, err := s.Users.FindByUsername(ctx, "bob"); err != ErrNotFound {
+		t.Fatalf("FindByUsername(unknown) = %v, want ErrNotFound", err)
+	}
+	if _, err := s.Users.FindByID(ctx, "not-an-id"); err != ErrNotFound {
+		t.Fatalf("FindByID(malformed) = %v, want ErrNotFound", err)
+	}
+
+	if err := s.Users.ReplacePasswordHash(ctx, id, "stale", "new"); err != ErrNotFound {
+		t.Fatalf("ReplacePasswordHash with a stale hash = %v, want ErrNotFound", err)
+	}
+	if err := s.Users.ReplacePasswordHash(ctx, id, "hash", "new"); err != nil {
+		t.Fatalf("ReplacePasswordHash: %v", err)
+	}
+	if got, _ := s.Users.FindByID(ctx, id); got.Password != "new" {
+		t.Fatalf("password = %q after ReplacePasswordHash, want new", got.Password)
+	}
+
+	if err := s.Users.SetEmailVerified(ctx, id, "other@example.com"); err != ErrNotFound {
+		t.Fatalf("SetEmailVerified for another address = %v, want ErrNotFound", err)
+	}
+	if err := s.Users.SetEmailVerified(ctx, id, alice.Email); err != nil {
+		t.Fatalf("SetEmailVerified: %v", err)
+	}
+
+	identity := models.Identity{Provider: "oauth", Subject: "123"}
+	if err := s.Users.AddIdentity(ctx, id, identity); err != nil {
+		t.Fatalf("AddIdentity: %v", err)
+	}
+	got, err = s.Users.FindByIdentity(ctx, "oauth", "123")
+	if err != nil || got.ID != alice.ID || !got.EmailVerified {
+		t.Fatalf("FindByIdentity = %+v, %v", got, err)
+	}
+
+	if err := s.Users.SetPendingTOTPSecret(ctx, id, "secret"); err != nil {
+		t.Fatalf("SetPendingTOTPSecret: %v", err)
+	}
+	if err := s.Users.EnableMFA(ctx, id, "other", 1, nil); err != ErrNotFound {
+		t.Fatalf("EnableMFA with another pending secret = %v, want ErrNotFound", err)
+	}
+	if err := s.Users.EnableMFA(ctx, id, "secret", 1, []string{"a", "b"}); err != nil {
+		t.Fatalf("EnableMFA: %v", err)
+	}
+	if err := s.Users.ConsumeTOTPStep(ctx, id, 1); err != ErrNotFound {
+		t.Fatalf("ConsumeTOTPStep(replayed step) = %v, want ErrNotFound", err)
+	}
+	if err := s.Users.ConsumeTOTPStep(ctx, id, 2); err != nil {
+		t.Fatalf("ConsumeTOTPStep: %v", err)
+	}
+	if err := s.Users.ConsumeRecoveryCode(ctx, id, "a"); err != nil {
+		t.Fatalf("ConsumeRecoveryCode: %v", err)
+	}
+	if err := s.Users.ConsumeRecoveryCode(ctx, id, "a"); err != ErrNotFound {
+		t.Fatalf("ConsumeRecoveryCode(used code) = %v, want ErrNotFound", err)
+	}
+	got, _ = s.Users.FindByID(ctx, id)
+	if !got.MFAEnabled || got.TOTPSecret != "secret" || len(got.RecoveryCodes) != 1 {
+		t.Fatalf("user after enabling MFA = %+v", got)
+	}
+
+	credential := models.WebAuthnCredential{ID: []byte{1, 2, 3}, PublicKey: []byte{4}, SignCount: 5, CreatedAt: time.Now()}
+	if err := s.Users.AddWebAuthnCredential(ctx, id, credential); err != nil {
+		t.Fatalf("AddWebAuthnCredential: %v", err)
+	}
+	bob := newUser("bob")
+	if err := s.Users.Create(ctx, bob); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Users.AddWebAuthnCredential(ctx, bob.ID.Hex(), credential); err != ErrDuplicate {
+		t.Fatalf("AddWebAuthnCredential(registered credential) = %v, want ErrDuplicate", err)
+	}
+	credential.SignCount = 5
+	if err := s.Users.UpdateWebAuthnCredential(ctx, id, credential); err != ErrNotFound {
+		t.Fatalf("UpdateWebAuthnCredential(sign count not increased) = %v, want ErrNotFound", err)
+	}
+	credential.SignCount = 6
+	if err := s.Users.UpdateWebAuthnCredential(ctx, id, credential); err != nil {
+		t.Fatalf("UpdateWebAuthnCredential: %v", err)
+	}
+}
+
+func testSessions(t *testing.T, s Stores) {
+	ctx := context.Background()
+	now := time.Now()
+	session := func(id string, created time.Time) models.Session {
+		return models.Session{ID: id, UserID: "u1", AuthMethod: "session", LastActivity: now, CreatedAt: created, ExpiresAt: now.Add(time.Hour), IsValid: true}
+	}
+
+	if err := s.Sessions.Create(ctx, session("b", now)); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := s.Sessions.Create(ctx, session("a", now.Add(-time.Minute))); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := s.Sessions.Create(ctx, session("a", now)); err != ErrDuplicate {
+		t.Fatalf("Create with a taken ID = %v, want ErrDuplicate", err)
+	}
+	expired := session("c", now)
+	expired.ExpiresAt = now.Add(-time.Second)
+	if err := s.Sessions.Create(ctx, expired); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := s.Sessions.FindValid(ctx, "c"); err != ErrNotFound {
+		t.Fatalf("FindValid(expired) = %v, want ErrNotFound", err)
+	}
+
+	list, err := s.Sessions.ListValid(ctx, "u1")
+	if err != nil || len(list) < 2 || list[0].ID != "a" || list[1].ID != "b" {
+		t.Fatalf("ListValid = %+v, %v; want a then b", list, err)
+	}
+
+	if err := s.Sessions.Invalidate(ctx, "a"); err != nil {
+		t.Fatalf("Invalidate: %v", err)
+	}
+	if _, err := s.Sessions.FindValid(ctx, "a"); err != ErrNotFound {
+		t.Fatalf("FindValid(invalidated) = %v, want ErrNotFound", err)
+	}
+	if err := s.Sessions.InvalidateUser(ctx, "u1"); err != nil {
+		t.Fatalf("InvalidateUser: %v", err)
+	}
+	if _, err := s.Sessions.FindValid(ctx, "b"); err != ErrNotFound {
+		t.Fatalf("FindValid after InvalidateUser = %v, want ErrNotFound", err)
+	}
+}
+
+func testTokens(t *testing.T, s Stores) {
+	ctx := context.Background()
+	now := time.Now()
+
+	if err := s.Tokens.Create(ctx, models.Token{Value: "t1", UserID: "u1", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if token, err := s.Tokens.FindValid(ctx, "t1"); err != nil || token.UserID != "u1" {
+		t.Fatalf("FindValid = %+v, %v", token, err)
+	}
+	if err := s.Tokens.DeleteUser(ctx, "u1"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if _, err := s.Tokens.FindValid(ctx, "t1"); err != ErrNotFound {
+		t.Fatalf("FindValid after DeleteUser = %v, want ErrNotFound", err)
+	}
+}
+
+func testStates(t *testing.T, s Stores) {
+	ctx := context.Background()
+	now := time.Now()
+	state := func(id, userID string, ttl time.Duration) State {
+		return State{ID: id, Kind: "kind", UserID: userID, Data: []byte("data:" + id), CreatedAt: now, ExpiresAt: now.Add(ttl)}
+	}
+
+	if err := s.States.Create(ctx, state("a", "", time.Minute)); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := s.States.Create(ctx, state("a", "", time.Minute)); err != ErrDuplicate {
+		t.Fatalf("Create with a taken ID = %v, want ErrDuplicate", err)
+	}
+
+	found, err := s.States.Find(ctx, "a")
+	if err != nil || string(found.Data) != "data:a" {
+		t.Fatalf("Find = %+v, %v", found, err)
+	}
+	for want := 1; want <= 2; want++ {
+		if attempts, err := s.States.CountAttempt(ctx, "a"); err != nil || attempts != want {
+			t.Fatalf("CountAttempt = %d, %v; want %d", attempts, err, want)
+		}
+	}
+
+	taken, err := s.States.Take(ctx, "a")
+	if err != nil || string(taken.Data) != "data:a" || taken.Attempts != 2 {
+		t.Fatalf("Take = %+v, %v", taken, err)
+	}
+	if _, err := s.States.Take(ctx, "a"); err != ErrNotFound {
+		t.Fatalf("second Take = %v, want ErrNotFound", err)
+	}
+	if _, err := s.States.CountAttempt(ctx, "a"); err != ErrNotFound {
+		t.Fatalf("CountAttempt(taken) = %v, want ErrNotFound", err)
+	}
+
+	if err := s.States.Create(ctx, state("expired", "", -time.Second)); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := s.States.Find(ctx, "expired"); err != ErrNotFound {
+		t.Fatalf("Find(expired) = %v, want ErrNotFound", err)
+	}
+	if _, err := s.States.Take(ctx, "expired"); err != ErrNotFound {
+		t.Fatalf("Take(expired) = %v, want ErrNotFound", err)
+	}
+
+	for _, id := range []string{"u1-a", "u1-b"} {
+		if err := s.States.Create(ctx, state(id, "u1", time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.States.Create(ctx, state("u2-a", "u2", time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.States.DeleteUser(ctx, "kind", "u1"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if _, err := s.States.Find(ctx, "u1-b"); err != ErrNotFound {
+		t.Fatalf("Find after DeleteUser = %v, want ErrNotFound", err)
+	}
+	if _, err := s.States.Find(ctx, "u2-a"); err != nil {
+		t.Fatalf("DeleteUser removed another user's record: %v", err)
+	}
+
+	// A record can only be redeemed once, however many try at the same time
+	if err := s.States.Create(ctx, state("race", "", time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	taken2 := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.States.Take(ctx, "race"); err == nil {
+				mu.Lock()
+				taken2++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if taken2 != 1 {
+		t.Fatalf("record taken %d times, want once", taken2)
+	}
+}
+
+func testRevocations(t *testing.T, s Stores) {
+	ctx := context.Background()
+
+	if revoked, err := s.Revocations.IsRevoked(ctx, "jti"); err != nil || revoked {
+		t.Fatalf("IsRevoked before Revoke = %v, %v", revoked, err)
+	}
+	if err := s.Revocations.Revoke(ctx, "jti", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	// Revoking twice is not an error
+	if err := s.Revocations.Revoke(ctx, "jti", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("second Revoke: %v", err)
+	}
+	if revoked, err := s.Revocations.IsRevoked(ctx, "jti"); err != nil || !revoked {
+		t.Fatalf("IsRevoked = %v, %v; want true", revoked, err)
+	}
+
+	if err := s.Revocations.Revoke(ctx, "old", time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if revoked, err := s.Revocations.IsRevoked(ctx, "old"); err != nil || revoked {
+		t.Fatalf("IsRevoked(expired) = %v, %v; want false", revoked, err)
+	}
+
+	userID := "0123456789abcdef01234567"
+	if before, err := s.Revocations.RevokedBefore(ctx, userID); err != nil || !before.IsZero() {
+		t.Fatalf("RevokedBefore without a cutoff = %v, %v", before, err)
+	}
+	first := time.Now().Add(-time.Minute).Truncate(time.Second)
+	second := first.Add(30 * time.Second)
+	for _, cutoff := range []time.Time{first, second} {
+		if err := s.Revocations.RevokeUser(ctx, userID, cutoff, time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("RevokeUser: %v", err)
+		}
+	}
+	if before, err := s.Revocations.RevokedBefore(ctx, userID); err != nil || !before.Equal(second) {
+		t.Fatalf("RevokedBefore = %v, %v; want the later cutoff %v", before, err, second)
+	}
+
+	expired := "76543210fedcba9876543210"
+	if err := s.Revocations.RevokeUser(ctx, expired, first, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("RevokeUser: %v", err)
+	}
+	if before, err := s.Revocations.RevokedBefore(ctx, expired); err != nil || !before.IsZero() {
+		t.Fatalf("RevokedBefore(expired) = %v, %v; want zero", before, err)
+	}
+}
+
+func testRefreshFamilies(t *testing.T, s Stores) {
+	ctx := context.Background()
+	now := time.Now()
+	family := func(id, userID string) RefreshFamily {
+		return RefreshFamily{ID: id, UserID: userID, CurrentJTI: "j1", CreatedAt: now, UpdatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	}
+
+	if err := s.RefreshFamilies.Create(ctx, family("f1", "u1")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	rotated, err := s.RefreshFamilies.Rotate(ctx, "f1", "j1", "j2", now.Add(2*time.Hour))
+	if err != nil || rotated.CurrentJTI != "j2" {
+		t.Fatalf("Rotate = %+v, %v", rotated, err)
+	}
+
+	// Replaying j1 revokes the family, and then even j2 stops working
+	if _, err := s.RefreshFamilies.Rotate(ctx, "f1", "j1", "j3", now.Add(2*time.Hour)); !errors.Is(err, ErrReused) {
+		t.Fatalf("Rotate(replayed token) = %v, want ErrReused", err)
+	}
+	if _, err := s.RefreshFamilies.Rotate(ctx, "f1", "j2", "j3", now.Add(2*time.Hour)); err != ErrNotFound {
+		t.Fatalf("Rotate(revoked family) = %v, want ErrNotFound", err)
+	}
+	if _, err := s.RefreshFamilies.Rotate(ctx, "unknown", "j1", "j2", now.Add(time.Hour)); err != ErrNotFound {
+		t.Fatalf("Rotate(unknown family) = %v, want ErrNotFound", err)
+	}
+
+	if err := s.RefreshFamilies.Create(ctx, family("f2", "u2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RefreshFamilies.Revoke(ctx, "f2", "logout"); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if _, err := s.RefreshFamilies.Rotate(ctx, "f2", "j1", "j2", now.Add(time.Hour)); err != ErrNotFound {
+		t.Fatalf("Rotate after Revoke = %v, want ErrNotFound", err)
+	}
+
+	if err := s.RefreshFamilies.Create(ctx, family("f3", "u3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RefreshFamilies.RevokeUser(ctx, "u3", "password_reset"); err != nil {
+		t.Fatalf("RevokeUser: %v", err)
+	}
+	if _, err := s.RefreshFamilies.Rotate(ctx, "f3", "j1", "j2", now.Add(time.Hour)); err != ErrNotFound {
+		t.Fatalf("Rotate after RevokeUser = %v, want ErrNotFound", err)
+	}
+
+	// Of concurrent redemptions of one token, exactly one succeeds
+	if err := s.RefreshFamilies.Create(ctx, family("f4", "u4")); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			next := "next-" + string(rune('a'+i))
+			if _, err := s.RefreshFamilies.Rotate(ctx, "f4", "j1", next, now.Add(time.Hour)); err == nil {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if succeeded != 1 {
+		t.Fatalf("%d concurrent rotations succeeded, want 1", succeeded)
+	}
+}
+
+func testLockouts(t *testing.T, s Stores) {
+	ctx := context.Background()
+
+	if f, err := s.Lockouts.Get(ctx, "alice"); err != nil || f.Count != 0 || f.Username != "alice" {
+		t.Fatalf("Get before any failure = %+v, %v", f, err)
+	}
+	for want := 1; want <= 3; want++ {
+		f, err := s.Lockouts.RecordFailure(ctx, "alice", time.Hour)
+		if err != nil || f.Count != want {
+			t.Fatalf("RecordFailure = %+v, %v; want count %d", f, err, want)
+		}
+	}
+
+	until := time.Now().Add(2 * time.Hour).Truncate(time.Millisecond)
+	if err := s.Lockouts.Lock(ctx, "alice", until); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	// An earlier lock does not shorten the current one
+	if err := s.Lockouts.Lock(ctx, "alice", time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	f, err := s.Lockouts.Get(ctx, "alice")
+	if err != nil || f.Count != 3 || !f.LockedUntil.Equal(until) {
+		t.Fatalf("Get after Lock = %+v, %v; want locked until %v", f, err, until)
+	}
+	// The record outlives the lock, so the count is not forgotten early
+	if f.ExpiresAt.Before(until) {
+		t.Fatalf("ExpiresAt %v is before LockedUntil %v", f.ExpiresAt, until)
+	}
+	if f, err := s.Lockouts.RecordFailure(ctx, "alice", time.Hour); err != nil || !f.LockedUntil.Equal(until) || f.Count != 4 {
+		t.Fatalf("RecordFailure while locked = %+v, %v", f, err)
+	}
+
+	if err := s.Lockouts.Reset(ctx, "alice"); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	if f, err := s.Lockouts.Get(ctx, "alice"); err != nil || f.Count != 0 || !f.LockedUntil.IsZero() {
+		t.Fatalf("Get after Reset = %+v, %v", f, err)
+	}
+
+	// Counts that have expired start over
+	if _, err := s.Lockouts.RecordFailure(ctx, "bob", -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := s.Lockouts.RecordFailure(ctx, "bob", time.Hour); err != nil || f.Count != 1 {
+		t.Fatalf("RecordFailure after expiry = %+v, %v; want count 1", f, err)
+	}
+
+	// Concurrent failures are all counted
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Lockouts.RecordFailure(ctx, "carol", time.Hour); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if f, _ := s.Lockouts.Get(ctx, "carol"); f.Count != 10 {
+		t.Fatalf("count after 10 concurrent failures = %d", f.Count)
+	}
+}
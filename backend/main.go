@@ -4,8 +4,7 @@ import (
 	"log"
 
 	"github.com/NoorBnHossam/Authentication_Types/internal/config"
-	"github.com/NoorBnHossam/Authentication_Types/internal/db"
-	"github.com/NoorBnHossam/Authentication_Types/internal/routes"
+	"github.com/NoorBnHossam/Authentication_Types/internal/server"
 	"github.com/joho/godotenv"
 )
 
@@ -15,21 +14,8 @@ func main() {
 		log.Println("Warning: No .env file found, using environment variables")
 	}
 
-	// Load configuration
-	cfg := config.Load()
-
-	// Connect to MongoDB
-	if err := db.Connect(); err != nil {
-		log.Fatal("Failed to connect to MongoDB:", err)
-	}
-	defer db.Disconnect()
-
-	// Setup router with configuration
-	router := routes.SetupRouter(cfg)
-
-	// Start server
-	log.Printf("Server starting on port %s in %s mode", cfg.Port, cfg.Env)
-	if err := router.Run(":" + cfg.Port); err != nil {
-		log.Fatal("Failed to start server:", err)
+	// Same server as cmd/server
+	if err := server.Run(config.Load()); err != nil {
+		log.Fatal(err)
 	}
 }